@@ -1,19 +1,19 @@
 package api
 
 import (
-	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
+	"io"
 	"net/http"
-	"path"
-	"sort"
 	"strconv"
 	"strings"
 	"time"
-	"unicode/utf8"
 
 	"github.com/andrebq/boombox/cassette"
+	"github.com/andrebq/boombox/internal/logutil"
 	"github.com/andrebq/boombox/internal/lua/bindings/httplua"
 	"github.com/andrebq/boombox/internal/lua/ltoj"
 	"github.com/andrebq/boombox/internal/lua/luadefaults"
@@ -22,6 +22,8 @@ import (
 )
 
 var (
+	errBodyTooLarge = errors.New("request body too large")
+
 	assetListTemplate = template.Must(template.New("__root__").Parse(`
 <!doctype html>
 <html>
@@ -40,55 +42,118 @@ var (
 `))
 )
 
+const (
+	// defaultRouteTimeout is used by routes which do not set a timeout
+	defaultRouteTimeout = time.Second * 10
+)
+
 type (
 	assetListTemplateModel struct {
 		Assets []string
 	}
+
+	routeEntry struct {
+		cassette.RouteHandler
+		handler http.HandlerFunc
+	}
+
+	// limitedBody enforces the max_body option of a route,
+	// even when the request does not declare its Content-Length
+	limitedBody struct {
+		io.ReadCloser
+		remaining int64
+		exceeded  bool
+	}
 )
 
 func AsHandler(ctx context.Context, c *cassette.Control, tapedeckModule lua.LGFunction) (http.Handler, error) {
-	assets, err := c.ListAssets(ctx)
+	table, err := routeTable(ctx, c, tapedeckModule)
 	if err != nil {
 		return nil, err
 	}
+	return newRouter(table)
+}
 
-	// using reverse sort makes longer paths to appear before smaller ones
-	// which makes handling `index.html` default much simpler
-	sort.Sort(sort.Reverse(sort.StringSlice(assets)))
-
-	router := httprouter.New()
-	for _, s := range assets {
-		router.HandlerFunc("GET", fmt.Sprintf("/%v", s), serveAsset(c, s))
-		if path.Base(s) == "index.html" {
-			dir := path.Dir(s)
-			if dir == "." {
-				dir = "/"
-			}
-			switch {
-			case !strings.HasPrefix(dir, "/") && !strings.HasSuffix(dir, "/"):
-				dir = fmt.Sprintf("/%v/", dir)
-			case !strings.HasPrefix(dir, "/"):
-				dir = fmt.Sprintf("/%v", dir)
-			case !strings.HasSuffix(dir, "/"):
-				dir = fmt.Sprintf("%v/", dir)
-			}
-			router.HandlerFunc("GET", dir, serveAsset(c, s))
-		}
+func routeTable(ctx context.Context, c *cassette.Control, tapedeckModule lua.LGFunction) ([]routeEntry, error) {
+	handlers, err := c.RouteHandlers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if conflicts := cassette.FindRouteConflicts(handlers); len(conflicts) > 0 {
+		return nil, cassette.RouteConflicts{Conflicts: conflicts}
 	}
-
-	router.HandlerFunc("GET", "/.internals/asset-list", listAssets(c))
-
 	routes, err := c.ListRoutes(ctx)
 	if err != nil {
 		return nil, err
 	}
+	code := make(map[string]cassette.Code, len(routes))
 	for _, r := range routes {
-		apiRoute := path.Join("/api", r.Route)
-		for _, m := range r.Methods {
-			router.HandlerFunc(m, apiRoute, serveDynamicCode(r.Code, tapedeckModule))
+		code[r.Route] = r
+	}
+	// canned queries are registered even on writable cassettes,
+	// but they only run on read-only ones, which are the only ones with a stable digest
+	var digest []byte
+	if c.Queryable() {
+		queries, err := c.ListQueries(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if len(queries) > 0 {
+			digest = cassetteDigest(ctx, c)
 		}
 	}
+	internal := map[string]http.HandlerFunc{
+		"/.internals/asset-list": listAssets(c),
+		"/.internals/manifest":   serveManifest(c),
+		"/.queries":              listCannedQueries(c),
+		"/.queries/:name":        serveCannedQuery(c, queryRunner(ctx, c, nil, digest)),
+	}
+
+	table := make([]routeEntry, 0, len(handlers))
+	for _, h := range handlers {
+		var handler http.HandlerFunc
+		switch {
+		case h.Asset != "":
+			handler = serveAsset(c, h.Asset)
+		case h.Route != "":
+			handler = serveDynamicCode(code[h.Route], tapedeckModule)
+		default:
+			handler = internal[h.Path]
+		}
+		if handler == nil {
+			return nil, fmt.Errorf("unable to serve %v %v (%v), handler not found", h.Method, h.Path, h.Source)
+		}
+		table = append(table, routeEntry{RouteHandler: h, handler: handler})
+	}
+	return table, nil
+}
 
+func newRouter(table []routeEntry) (_ http.Handler, err error) {
+	defer func() {
+		// routeTable should catch every conflict, but a panic here
+		// would take the whole server down
+		if r := recover(); r != nil {
+			err = fmt.Errorf("unable to register routes, cause %v", r)
+		}
+	}()
+	router := httprouter.New()
+	exact := map[string]http.HandlerFunc{}
+	for _, e := range table {
+		if e.ExactMatch() {
+			exact[e.Path] = e.handler
+			continue
+		}
+		router.HandlerFunc(e.Method, e.Path, e.handler)
+	}
+	if len(exact) > 0 {
+		router.NotFound = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if h, ok := exact[r.URL.Path]; ok && r.Method == "GET" {
+				h(w, r)
+				return
+			}
+			http.NotFound(w, r)
+		})
+	}
 	return router, nil
 }
 
@@ -103,9 +168,44 @@ func listAssets(c *cassette.Control) http.HandlerFunc {
 	}
 }
 
-func serveDynamicCode(code string, tapedeckModule lua.LGFunction) http.HandlerFunc {
+func serveManifest(c *cassette.Control) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		manifest, err := c.Manifest(r.Context())
+		if errors.Is(err, cassette.ManifestNotFound{}) {
+			http.Error(w, "cassette does not have a manifest", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Unable to fetch cassette manifest, please try again later", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Add("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(manifest)
+	}
+}
+
+func serveDynamicCode(route cassette.Code, tapedeckModule lua.LGFunction) http.HandlerFunc {
+	opts := route.Options
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = defaultRouteTimeout
+	}
 	return func(w http.ResponseWriter, r *http.Request) {
-		timeoutCtx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+		var body *limitedBody
+		if opts.MaxBody > 0 {
+			if r.ContentLength > opts.MaxBody {
+				http.Error(w, fmt.Sprintf("request body is larger than %v bytes", opts.MaxBody), http.StatusRequestEntityTooLarge)
+				return
+			}
+			body = &limitedBody{ReadCloser: r.Body, remaining: opts.MaxBody}
+			r.Body = body
+		}
+		if opts.ContentType != "" {
+			w.Header().Set("Content-Type", opts.ContentType)
+		}
+		if opts.Cache != "" {
+			w.Header().Set("Cache-Control", opts.Cache)
+		}
+		timeoutCtx, cancel := context.WithTimeout(r.Context(), timeout)
 		defer cancel()
 		r = r.WithContext(timeoutCtx)
 		L := lua.NewState(lua.Options{
@@ -119,30 +219,73 @@ func serveDynamicCode(code string, tapedeckModule lua.LGFunction) http.HandlerFu
 		if tapedeckModule != nil {
 			L.PreloadModule("tapedeck", tapedeckModule)
 		}
-		err := L.DoString(code)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Dynamic page failed with unexpected error:\n%v\n\n\n----\n\n\n%v", err, code), http.StatusBadGateway)
+		err := L.DoString(route.Code)
+		switch {
+		case err == nil:
+		case body != nil && body.exceeded:
+			http.Error(w, fmt.Sprintf("request body is larger than %v bytes", opts.MaxBody), http.StatusRequestEntityTooLarge)
+		case errors.Is(timeoutCtx.Err(), context.DeadlineExceeded):
+			http.Error(w, fmt.Sprintf("Dynamic page did not finish within %v", timeout), http.StatusGatewayTimeout)
+		default:
+			http.Error(w, fmt.Sprintf("Dynamic page failed with unexpected error:\n%v\n\n\n----\n\n\n%v", err, route.Code), http.StatusBadGateway)
 		}
 	}
 }
 
+// Read returns an error once more than remaining bytes are read from the body
+func (l *limitedBody) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if l.remaining <= 0 {
+		// the body might end exactly at the limit
+		n, err := l.ReadCloser.Read(p[:1])
+		if n > 0 {
+			l.exceeded = true
+			return 0, errBodyTooLarge
+		}
+		return 0, err
+	}
+	if int64(len(p)) > l.remaining {
+		p = p[:l.remaining]
+	}
+	n, err := l.ReadCloser.Read(p)
+	l.remaining -= int64(n)
+	return n, err
+}
+
 func serveAsset(c *cassette.Control, assetPath string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		var buf bytes.Buffer
-		// TODO: copying to memory instead of directly to the network stream
-		// while it may sound stupid, releasing the lock is more important than client latency,
-		// it is fine if the client needs to wait a couple of extra millis if that means
-		// less lock contention at the database layer
-		_, mt, err := c.CopyAsset(r.Context(), &buf, assetPath)
+		asset, err := c.StatAsset(r.Context(), assetPath)
 		if err != nil {
 			http.Error(w, "unable to fetch desired asset, server is mis-behaving", http.StatusBadGateway)
+			return
+		}
+		variants, err := c.ListVariants(r.Context(), assetPath)
+		if err != nil {
+			http.Error(w, "unable to fetch desired asset, server is mis-behaving", http.StatusBadGateway)
+			return
 		}
+		contentHash, size := asset.ContentHash, asset.Size
+		variant, encoded := negotiateEncoding(r.Header.Get("Accept-Encoding"), variants)
+		if len(variants) > 0 {
+			w.Header().Add("Vary", "Accept-Encoding")
+		}
+		if encoded {
+			contentHash, size = variant.ContentHash, variant.Size
+		}
+		// content is addressed by its hash, so the hash is a strong validator
+		etag := fmt.Sprintf(`"%v"`, contentHash)
+		w.Header().Set("ETag", etag)
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		mt := asset.MimeType
 		if mt == "text/x-lua" {
 			mt = "text/plain"
 		}
-		// TODO: this is absurdly stupid since we could extract this info directly from the database
-		// but I'm on a rush to get this working...
-		if utf8.Valid(buf.Bytes()) {
+		if asset.UTF8 {
 			w.Header().Add("Content-Type", fmt.Sprintf("%v; charset=utf-8", mt))
 		} else {
 			w.Header().Add("Content-Type", mt)
@@ -151,10 +294,78 @@ func serveAsset(c *cassette.Control, assetPath string) http.HandlerFunc {
 		case "text/plain":
 			w.Header().Add("Content-Disposition", "inline")
 		}
-		w.Header().Add("Content-Length", strconv.Itoa(buf.Len()))
-		// TODO: think about some caching with ETags and stuff
-		// the data is already here and the database lock was released a long time ago
+		if encoded {
+			w.Header().Add("Content-Encoding", variant.Encoding)
+		}
+		w.Header().Add("Content-Length", strconv.FormatInt(size, 10))
 		w.WriteHeader(http.StatusOK)
-		w.Write(buf.Bytes())
+		if encoded {
+			err = c.CopyAssetVariant(r.Context(), w, assetPath, variant.Encoding)
+		} else {
+			_, _, err = c.CopyAsset(r.Context(), w, assetPath)
+		}
+		if err != nil {
+			// headers are gone already, the best we can do is to log
+			// and let the client detect the short body
+			log := logutil.GetOrDefault(r.Context())
+			log.Error().Err(err).Str("asset", assetPath).Msg("unable to stream asset to client")
+		}
+	}
+}
+
+// negotiateEncoding picks the variant with the highest quality value
+// from the Accept-Encoding header, ties are broken by the smallest variant.
+//
+// If no variant is acceptable, or identity is explicitly preferred over all of them,
+// the original content should be used.
+func negotiateEncoding(acceptEncoding string, variants []cassette.Variant) (cassette.Variant, bool) {
+	if len(acceptEncoding) == 0 || len(variants) == 0 {
+		return cassette.Variant{}, false
+	}
+	accepted := map[string]float64{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		q := 1.0
+		for _, p := range params[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				if v, err := strconv.ParseFloat(p[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		accepted[name] = q
+	}
+	var best cassette.Variant
+	var bestQ float64
+	for _, v := range variants {
+		q, ok := accepted[v.Encoding]
+		if !ok {
+			q = accepted["*"]
+		}
+		if q <= 0 {
+			continue
+		}
+		if q > bestQ || (q == bestQ && v.Size < best.Size) {
+			best, bestQ = v, q
+		}
+	}
+	if identity, ok := accepted["identity"]; ok && identity > bestQ {
+		return cassette.Variant{}, false
+	}
+	return best, bestQ > 0
+}
+
+func etagMatches(ifNoneMatch string, etag string) bool {
+	if len(ifNoneMatch) == 0 {
+		return false
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
 	}
+	return false
 }
@@ -1,14 +1,19 @@
 package api
 
 import (
+	"compress/gzip"
 	"context"
+	"errors"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/andrebq/boombox/cassette"
+	"github.com/andrebq/boombox/cassette/importer"
 	"github.com/steinfletcher/apitest"
 )
 
@@ -165,6 +170,292 @@ func TestApi(t *testing.T) {
 		End()
 }
 
+func TestAssetETag(t *testing.T) {
+	ctx := context.Background()
+	cassette, cleanup := tempCassette(ctx, t, "test")
+	defer cleanup()
+	_, err := cassette.StoreAsset(ctx, "index.html", "text/html", `<h1>it works</h1>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	asset, err := cassette.StatAsset(ctx, "index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler, err := AsHandler(ctx, cassette, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	etag := `"` + asset.ContentHash + `"`
+	apitest.New().
+		Handler(handler).
+		Get("/index.html").
+		Expect(t).
+		Header("ETag", etag).
+		Body(`<h1>it works</h1>`).
+		Status(http.StatusOK).
+		End()
+	apitest.New().
+		Handler(handler).
+		Get("/index.html").
+		Header("If-None-Match", etag).
+		Expect(t).
+		Body(``).
+		Status(http.StatusNotModified).
+		End()
+}
+
+func TestAssetEncodingNegotiation(t *testing.T) {
+	ctx := context.Background()
+	c, cleanup := tempCassette(ctx, t, "test")
+	defer cleanup()
+	content := strings.Repeat("<p>boombox</p>", 1000)
+	_, err := c.StoreAsset(ctx, "index.html", "text/html", content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	variants, err := c.CompressAsset(ctx, "index.html", cassette.EncodingGzip)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(variants) != 1 {
+		t.Fatalf("Should have stored the gzip variant, got %#v", variants)
+	}
+	handler, err := AsHandler(ctx, c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	apitest.New().
+		Handler(handler).
+		Get("/index.html").
+		Header("Accept-Encoding", "br;q=1.0, gzip;q=0.8").
+		Expect(t).
+		Header("Content-Encoding", "gzip").
+		Header("Vary", "Accept-Encoding").
+		Header("ETag", `"`+variants[0].ContentHash+`"`).
+		Assert(func(res *http.Response, _ *http.Request) error {
+			gz, err := gzip.NewReader(res.Body)
+			if err != nil {
+				return err
+			}
+			body, err := ioutil.ReadAll(gz)
+			if err != nil {
+				return err
+			} else if string(body) != content {
+				return errors.New("decompressed body does not match the asset")
+			}
+			return nil
+		}).
+		Status(http.StatusOK).
+		End()
+	apitest.New().
+		Handler(handler).
+		Get("/index.html").
+		Header("Accept-Encoding", "gzip;q=0").
+		Expect(t).
+		HeaderNotPresent("Content-Encoding").
+		Body(content).
+		Status(http.StatusOK).
+		End()
+	apitest.New().
+		Handler(handler).
+		Get("/index.html").
+		Header("Accept-Encoding", "gzip;q=0.1, identity;q=1").
+		Expect(t).
+		HeaderNotPresent("Content-Encoding").
+		Body(content).
+		Status(http.StatusOK).
+		End()
+}
+
+func TestManifest(t *testing.T) {
+	ctx := context.Background()
+	c, cleanup := tempCassette(ctx, t, "test")
+	defer cleanup()
+	handler, err := AsHandler(ctx, c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	apitest.New().
+		Handler(handler).
+		Get("/.internals/manifest").
+		Expect(t).
+		Status(http.StatusNotFound).
+		End()
+
+	err = c.StoreManifest(ctx, cassette.Manifest{Name: "people", Title: "People", Authors: []string{"bob"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	apitest.New().
+		Handler(handler).
+		Get("/.internals/manifest").
+		Expect(t).
+		Body(`{"name":"people","title":"People","authors":["bob"]}`).
+		Status(http.StatusOK).
+		End()
+}
+
+func TestRouteOptions(t *testing.T) {
+	ctx := context.Background()
+	ctl, cleanup := tempCassette(ctx, t, "test")
+	defer cleanup()
+	for path, code := range map[string]string{
+		"codebase/echo.lua": `
+	local ctx = require('ctx')
+	local body = ctx.req.parse_body() or "missing"
+	ctx.res:write_body(require('json').to_json(body))
+	`,
+		"codebase/loop.lua": `
+	while true do end
+	`,
+	} {
+		if _, err := ctl.StoreAsset(ctx, path, "text/x-lua", code); err != nil {
+			t.Fatal(err)
+		}
+		if err := ctl.ToggleCodebase(ctx, path, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := ctl.MapRouteWithOptions(ctx, []string{"POST"}, "/echo", "codebase/echo.lua", cassette.RouteOptions{
+		MaxBody:     16,
+		Cache:       "max-age=60",
+		ContentType: "application/json",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ctl.MapRouteWithOptions(ctx, []string{"GET"}, "/loop", "codebase/loop.lua", cassette.RouteOptions{
+		Timeout: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler, err := AsHandler(ctx, ctl, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	apitest.New().
+		Handler(handler).
+		Post("/api/echo").
+		JSON(`{"a":1}`).
+		Expect(t).
+		Status(http.StatusOK).
+		Header("Content-Type", "application/json").
+		Header("Cache-Control", "max-age=60").
+		Body(`{"a":1}`).
+		End()
+	apitest.New().
+		Handler(handler).
+		Post("/api/echo").
+		JSON(`{"a":"this body is too large"}`).
+		Expect(t).
+		Status(http.StatusRequestEntityTooLarge).
+		End()
+	apitest.New().
+		Handler(handler).
+		Get("/api/loop").
+		Expect(t).
+		Status(http.StatusGatewayTimeout).
+		End()
+}
+
+func TestAssetNames(t *testing.T) {
+	ctx := context.Background()
+	ctl, cleanup := tempCassette(ctx, t, "test")
+	defer cleanup()
+	dir, err := ioutil.TempDir("", "boombox-tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// none of these names is a valid route, but all of them are valid assets
+	for name, content := range map[string]string{
+		"my page.html": "<h1>space</h1>",
+		"a:b.html":     "<h1>colon</h1>",
+		"star*.html":   "<h1>star</h1>",
+	} {
+		if err := os.MkdirAll(filepath.Join(dir, "site"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "site", name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := importer.Directory(ctx, ctl, dir, false); err != nil {
+		t.Fatal(err)
+	}
+	handler, err := AsHandler(ctx, ctl, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, body := range map[string]string{
+		"/site/my%20page.html": "<h1>space</h1>",
+		"/site/a:b.html":       "<h1>colon</h1>",
+		"/site/star*.html":     "<h1>star</h1>",
+	} {
+		apitest.New().
+			Handler(handler).
+			Get(path).
+			Expect(t).
+			Body(body).
+			Status(http.StatusOK).
+			End()
+	}
+	apitest.New().
+		Handler(handler).
+		Get("/site/a:c.html").
+		Expect(t).
+		Status(http.StatusNotFound).
+		End()
+}
+
+func TestRouteConflicts(t *testing.T) {
+	ctx := context.Background()
+	ctl, cleanup := tempCassette(ctx, t, "test")
+	defer cleanup()
+	if _, err := ctl.StoreAsset(ctx, "codebase/index.lua", "text/x-lua", `require('ctx').res:write_body("ok")`); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctl.ToggleCodebase(ctx, "codebase/index.lua", true); err != nil {
+		t.Fatal(err)
+	}
+	for _, route := range []string{"/users/:id", "/users/:id/posts", "/files/*path"} {
+		if err := ctl.MapRoute(ctx, []string{"GET"}, route, "codebase/index.lua"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ctl.ValidateRoutes(ctx); err != nil {
+		t.Fatalf("Routes without conflicts should be valid, got %v", err)
+	}
+	// /users/me and /users/:name/comments conflict with the /users/:id routes
+	for _, route := range []string{"/users/me", "/users/:name/comments"} {
+		err := ctl.MapRoute(ctx, []string{"GET"}, route, "codebase/index.lua")
+		if !errors.As(err, &cassette.RouteConflicts{}) {
+			t.Fatalf("Mapping %v should fail with RouteConflicts, got %v", route, err)
+		}
+	}
+	if routes, err := ctl.ListRoutes(ctx); err != nil {
+		t.Fatal(err)
+	} else if len(routes) != 3 {
+		t.Fatalf("Conflicting routes should not be saved, got %v routes", len(routes))
+	}
+	if _, err := ctl.StoreAsset(ctx, "api/files/index.html", "text/html", "<h1>files</h1>"); err != nil {
+		t.Fatal(err)
+	}
+	_, err := AsHandler(ctx, ctl, nil)
+	var conflicts cassette.RouteConflicts
+	if !errors.As(err, &conflicts) {
+		t.Fatalf("Conflicting routes should return RouteConflicts, got %v", err)
+	}
+	// /files/*path conflicts with both paths of api/files/index.html
+	if len(conflicts.Conflicts) != 2 {
+		t.Fatalf("Expecting 2 conflicts got %v", err)
+	}
+	if !strings.Contains(err.Error(), "GET /api/files/*path (route /files/*path) conflicts with /api/files/ (asset api/files/index.html)") {
+		t.Fatalf("Error should describe the conflict with the asset, got %v", err)
+	}
+}
+
 func tempCassette(ctx context.Context, t interface {
 	Fatal(...interface{})
 	Log(...interface{})
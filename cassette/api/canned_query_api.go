@@ -0,0 +1,59 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/andrebq/boombox/cassette"
+	"github.com/andrebq/boombox/internal/logutil"
+	"github.com/julienschmidt/httprouter"
+)
+
+func listCannedQueries(c *cassette.Control) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		queries, err := c.ListQueries(r.Context())
+		if err != nil {
+			log := logutil.GetOrDefault(r.Context())
+			log.Error().Err(err).Msg("Unable to list queries")
+			http.Error(w, "Unable to fetch list of queries, please try again later", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(map[string]interface{}{"queries": queries})
+	}
+}
+
+// serveCannedQuery runs the query named by the request path, the form values are
+// bound to its parameters and the remaining options work like the /.query endpoint
+func serveCannedQuery(c *cassette.Control, run queryRunFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := httprouter.ParamsFromContext(r.Context()).ByName("name")
+		query, err := c.LookupQuery(r.Context(), name)
+		var notFound cassette.QueryNotFound
+		if errors.As(err, &notFound) {
+			http.Error(w, notFound.Error(), http.StatusNotFound)
+			return
+		} else if err != nil {
+			log := logutil.GetOrDefault(r.Context())
+			log.Error().Err(err).Str("query", name).Msg("Unable to load query")
+			http.Error(w, "Unable to load query, please try again later", http.StatusInternalServerError)
+			return
+		}
+		err = r.ParseForm()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		values := make(map[string]string, len(r.Form))
+		for k := range r.Form {
+			values[k] = r.Form.Get(k)
+		}
+		args, err := query.Bind(values)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		run(w, r, query.SQL, args)
+	}
+}
@@ -0,0 +1,105 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/andrebq/boombox/cassette"
+	"github.com/andrebq/boombox/cassette/querycache"
+	"github.com/steinfletcher/apitest"
+)
+
+func TestCannedQueryApi(t *testing.T) {
+	ctx := context.Background()
+	ctl, cleanup := tempQueryCassette(ctx, t, "test", func(ctx context.Context, c *cassette.Control) error {
+		_, _, err := c.ImportCSVDataset(ctx, "names", bytes.NewBufferString("name,age\nbob,30\ncharlie,31\n"))
+		if err != nil {
+			return err
+		}
+		return c.StoreQuery(ctx, cassette.CannedQuery{
+			Name:        "older-than",
+			SQL:         "select name from names where age > :age order by name",
+			Description: "People older than age",
+			Params:      []cassette.QueryParam{{Name: "age", Type: "int", Default: "0"}},
+		})
+	})
+	defer cleanup()
+	handler, err := AsHandler(ctx, ctl, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	apitest.New().
+		Handler(handler).
+		Get("/.queries").
+		Expect(t).
+		Body(`{"queries":[{"name":"older-than","sql":"select name from names where age > :age order by name","description":"People older than age","params":[{"name":"age","type":"int","default":"0"}]}]}`).
+		Status(http.StatusOK).
+		End()
+
+	apitest.New().
+		Handler(handler).
+		Get("/.queries/older-than").
+		Query("age", "30").
+		Expect(t).
+		Body(`{"columns":["name"],"rows":[["charlie"]]}`).
+		Status(http.StatusOK).
+		End()
+
+	apitest.New().
+		Handler(handler).
+		Get("/.queries/older-than").
+		Query("format", "csv").
+		Expect(t).
+		Body("name\nbob\ncharlie\n").
+		Status(http.StatusOK).
+		End()
+
+	apitest.New().
+		Handler(handler).
+		Get("/.queries/older-than").
+		Query("age", "thirty").
+		Expect(t).
+		Status(http.StatusBadRequest).
+		End()
+
+	apitest.New().
+		Handler(handler).
+		Get("/.queries/missing").
+		Expect(t).
+		Status(http.StatusNotFound).
+		End()
+
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest("GET", "/.queries/older-than?age=30", nil))
+	etag := res.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("Canned queries should have an ETag")
+	}
+	req := httptest.NewRequest("GET", "/.queries/older-than?age=30", nil)
+	req.Header.Set("If-None-Match", etag)
+	res = httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+	if res.Code != http.StatusNotModified {
+		t.Fatalf("Expecting status 304 got %v", res.Code)
+	}
+
+	cache, err := querycache.New(querycache.Options{MaxBytes: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cached, err := CachedQueryHandler(cache)(ctx, ctl, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"miss", "hit"} {
+		res = httptest.NewRecorder()
+		cached.ServeHTTP(res, httptest.NewRequest("GET", "/.queries/older-than?age=30", nil))
+		if res.Code != http.StatusOK || res.Header().Get("X-Cache") != expected {
+			t.Fatalf("Canned query should be a %v, got %v %v", expected, res.Code, res.Header())
+		}
+	}
+}
@@ -3,35 +3,79 @@ package api
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
-	"io"
+	"fmt"
+	"mime"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/andrebq/boombox/cassette"
+	"github.com/andrebq/boombox/cassette/querycache"
 	"github.com/andrebq/boombox/internal/logutil"
 	"github.com/julienschmidt/httprouter"
 	"github.com/rs/zerolog"
 	lua "github.com/yuin/gopher-lua"
 )
 
+var (
+	queryContentTypes = map[string]string{
+		"json": "application/json; charset=utf-8",
+		"csv":  "text/csv; charset=utf-8",
+		"tsv":  "text/tab-separated-values; charset=utf-8",
+		// ndjson and arrow responses are streamed instead of buffered
+		"ndjson": "application/x-ndjson",
+		"arrow":  "application/vnd.apache.arrow.stream",
+	}
+)
+
+type (
+	// queryRunFunc executes sql and writes its output to w
+	queryRunFunc func(w http.ResponseWriter, r *http.Request, sql string, args []interface{})
+
+	// streamWriter sends the headers on the first write
+	// and flushes each write to the client
+	streamWriter struct {
+		w           http.ResponseWriter
+		contentType string
+		started     bool
+	}
+)
+
 // AsQueryHandler allows arbitrary queries to cassettes
 func AsQueryHandler(ctx context.Context, c *cassette.Control, _ lua.LGFunction) (http.Handler, error) {
+	return queryHandler(ctx, c, nil)
+}
+
+// CachedQueryHandler works like AsQueryHandler but keeps the output of json, csv and tsv
+// queries (canned queries included) in cache, which can be shared by many cassettes since keys include their digest.
+func CachedQueryHandler(cache *querycache.Cache) func(context.Context, *cassette.Control, lua.LGFunction) (http.Handler, error) {
+	return func(ctx context.Context, c *cassette.Control, _ lua.LGFunction) (http.Handler, error) {
+		return queryHandler(ctx, c, cache)
+	}
+}
+
+func queryHandler(ctx context.Context, c *cassette.Control, cache *querycache.Cache) (http.Handler, error) {
 	router := httprouter.New()
 	if !c.Queryable() {
 		return nil, cassette.CannotQuery{}
 	}
-	router.HandlerFunc("GET", "/.query", queryCassette(ctx, c))
+	run := queryRunner(ctx, c, cache, cassetteDigest(ctx, c))
+	router.HandlerFunc("GET", "/.query", queryCassette(run))
+	router.HandlerFunc("POST", "/.query", queryCassette(run))
+	router.HandlerFunc("GET", "/.search/:table", searchCassette(c, run))
+	// canned queries are also served by AsHandler, but only here they share the cache
+	router.HandlerFunc("GET", "/.queries", listCannedQueries(c))
+	router.HandlerFunc("GET", "/.queries/:name", serveCannedQuery(c, run))
+	if cache != nil {
+		router.HandlerFunc("GET", "/.query/cache", serveCacheStats(cache))
+	}
 	return router, nil
 }
 
-func queryCassette(ctx context.Context, c *cassette.Control) http.HandlerFunc {
-	const (
-		OneMegabyte = 1_000_000
-		MaxBuffer   = OneMegabyte
-	)
-	log := logutil.GetOrDefault(ctx).Sample(zerolog.Often)
+func queryCassette(run queryRunFunc) http.HandlerFunc {
 	// TODO: this endpoint should ran under a separate user and process
 	// but for now, let's make everything available under the same process (everything is readonly so far...)
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -40,34 +84,270 @@ func queryCassette(ctx context.Context, c *cassette.Control) http.HandlerFunc {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		// TODO: handle sql query parameters, for now, deal with unparameterized queries
-		sql := r.FormValue("sql")
+		sql, args, err := queryRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		if len(sql) == 0 {
 			http.Error(w, "missing sql parameter", http.StatusBadRequest)
 			return
 		}
+		run(w, r, sql, args)
+	}
+}
+
+// cassetteDigest returns the digest used to cache and tag query results, it is computed
+// once when the handler is built, since cassettes are read-only while they can be queried.
+// Cassettes without a digest (eg.: no dataset) are neither cached nor tagged.
+func cassetteDigest(ctx context.Context, c *cassette.Control) []byte {
+	digest, err := c.Digest(ctx)
+	if err != nil {
+		log := logutil.GetOrDefault(ctx)
+		log.Warn().Err(err).Msg("unable to compute cassette digest, query results will not be cached")
+		return nil
+	}
+	return digest
+}
+
+// queryRunner returns the function which executes sql and writes its output in the format
+// requested by r, r.ParseForm must be called before it.
+//
+// Buffered results are cached under digest, when both cache and digest are available.
+func queryRunner(ctx context.Context, c *cassette.Control, cache *querycache.Cache, digest []byte) queryRunFunc {
+	const (
+		OneMegabyte = 1_000_000
+		MaxBuffer   = OneMegabyte
+
+		DefaultStreamRows    = 100_000
+		MaxStreamRows        = 10_000_000
+		DefaultStreamTimeout = 10 * time.Second
+		MaxStreamTimeout     = 5 * time.Minute
+
+		// DefaultInstructions limits buffered queries which do not set maxInstructions,
+		// streamed queries are already limited by maxRows and timeout
+		DefaultInstructions = 100_000_000
+	)
+	log := logutil.GetOrDefault(ctx).Sample(zerolog.Often)
+	return func(w http.ResponseWriter, r *http.Request, sql string, args []interface{}) {
+		format, err := queryFormat(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		budget, err := queryBudget(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if format == "ndjson" || format == "arrow" {
+			maxRows, err := strconv.ParseInt(r.FormValue("maxRows"), 10, 64)
+			if err != nil || maxRows <= 0 || maxRows > MaxStreamRows {
+				maxRows = DefaultStreamRows
+			}
+			timeout, err := time.ParseDuration(r.FormValue("timeout"))
+			if err != nil || timeout <= 0 {
+				timeout = DefaultStreamTimeout
+			} else if timeout > MaxStreamTimeout {
+				timeout = MaxStreamTimeout
+			}
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			ctx, cost := cassette.WithQueryBudget(ctx, budget)
+			out := &streamWriter{w: w, contentType: queryContentTypes[format]}
+			var status cassette.QueryStatus
+			if format == "arrow" {
+				status, err = c.QueryArrow(ctx, out, maxRows, sql, args...)
+			} else {
+				status, err = c.QueryNDJSON(ctx, out, maxRows, sql, args...)
+			}
+			if err != nil && !out.started {
+				log.Warn().Err(err).Str("sql", sql).Msg("unable to perform query")
+				w.Header().Set("X-Query-Instructions", strconv.FormatInt(cost.Instructions(), 10))
+				code, msg := queryErrorResponse(err)
+				http.Error(w, msg, code)
+				return
+			} else if err != nil {
+				log.Warn().Err(err).Str("sql", sql).Int64("rows", status.Rows).Msg("query stream interrupted")
+			}
+			// sent as trailers, since they are only known after the body
+			w.Header().Set("X-Query-Status", status.Status)
+			w.Header().Set("X-Query-Rows", strconv.FormatInt(status.Rows, 10))
+			w.Header().Set("X-Query-Instructions", strconv.FormatInt(cost.Instructions(), 10))
+			return
+		}
 		userMaxBuffer, err := strconv.Atoi(r.FormValue("maxBuffer"))
 		if err != nil || userMaxBuffer > MaxBuffer {
 			userMaxBuffer = MaxBuffer
 		}
+		orderBy := r.FormValue("orderBy")
+		limit, _ := strconv.Atoi(r.FormValue("limit"))
+		withMetadata, _ := strconv.ParseBool(r.FormValue("metadata"))
+		// limits are part of the key, so a result cached for a larger
+		// buffer or budget is not served to a request which sets a lower one
+		var key string
+		if digest != nil {
+			key = querycache.Key(digest, sql, args, format, orderBy, strconv.Itoa(limit), r.FormValue("cursor"), strconv.FormatBool(withMetadata),
+				strconv.Itoa(userMaxBuffer), strconv.FormatInt(budget.Instructions, 10), budget.Duration.String())
+		}
+		if cache != nil && key != "" {
+			if content, ok := cache.Get(key); ok {
+				w.Header().Set("X-Cache", "hit")
+				w.Header().Set("X-Query-Instructions", "0")
+				writeQueryResult(w, r, key, format, content)
+				return
+			}
+			w.Header().Set("X-Cache", "miss")
+		}
+		if budget.Instructions == 0 {
+			budget.Instructions = DefaultInstructions
+		}
 		// TODO: 10 seconds might be considered too generous for a sqlite query
 		ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
 		defer cancel()
+		ctx, cost := cassette.WithQueryBudget(ctx, budget)
 		var buf bytes.Buffer
-		err = c.Query(ctx, &buf, userMaxBuffer, sql)
-		if err != nil {
-			log.Warn().Err(err).Str("sql", sql).Msg("unable to perform query")
-			var writeOverflow cassette.WriteOverflow
-			if errors.As(err, &writeOverflow) {
-				// TODO: in theory, the request is small but the response is too big, not good but also not horribly incorrect
-				http.Error(w, "unable to perform query, your query returns too much data", http.StatusRequestEntityTooLarge)
+		switch format {
+		case "csv":
+			err = c.QueryCSV(ctx, &buf, userMaxBuffer, ',', sql, args...)
+		case "tsv":
+			err = c.QueryCSV(ctx, &buf, userMaxBuffer, '\t', sql, args...)
+		default:
+			if orderBy != "" {
+				page := cassette.Page{OrderBy: strings.Split(orderBy, ","), Limit: limit, Cursor: r.FormValue("cursor")}
+				_, err = c.QueryPage(ctx, &buf, userMaxBuffer, page, sql, args...)
+			} else if withMetadata {
+				err = c.QueryWithMetadata(ctx, &buf, userMaxBuffer, sql, args...)
 			} else {
-				http.Error(w, "unable to perform query, check logs for more information", http.StatusBadRequest)
+				err = c.Query(ctx, &buf, userMaxBuffer, sql, args...)
 			}
+		}
+		w.Header().Set("X-Query-Instructions", strconv.FormatInt(cost.Instructions(), 10))
+		if err != nil {
+			log.Warn().Err(err).Str("sql", sql).Msg("unable to perform query")
+			code, msg := queryErrorResponse(err)
+			http.Error(w, msg, code)
 			return
 		}
-		w.Header().Add("Content-Length", strconv.Itoa(len(buf.Bytes())))
-		w.Header().Add("Content-Type", "application/json; charset=utf-8")
-		io.Copy(w, &buf)
+		if cost.Volatile() {
+			// the output might change on the next request
+			key = ""
+		} else if cache != nil && key != "" {
+			cache.Put(key, buf.Bytes())
+		}
+		writeQueryResult(w, r, key, format, buf.Bytes())
+	}
+}
+
+// writeQueryResult writes the output of a buffered query, when etag is not empty
+// and matches If-None-Match, only the status 304 is sent
+func writeQueryResult(w http.ResponseWriter, r *http.Request, etag string, format string, content []byte) {
+	if etag != "" {
+		etag = fmt.Sprintf(`"%v"`, etag[:32])
+		w.Header().Set("ETag", etag)
+		for _, candidate := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == etag || candidate == "*" {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+	}
+	w.Header().Add("Content-Length", strconv.Itoa(len(content)))
+	w.Header().Add("Content-Type", queryContentTypes[format])
+	w.Write(content)
+}
+
+func serveCacheStats(cache *querycache.Cache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(cache.Stats())
+	}
+}
+
+// queryBudget returns the budget requested by the client,
+// the budget of the cassette still applies if it is lower
+func queryBudget(r *http.Request) (cassette.QueryBudget, error) {
+	var budget cassette.QueryBudget
+	var err error
+	if v := r.FormValue("maxInstructions"); v != "" {
+		budget.Instructions, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || budget.Instructions <= 0 {
+			return budget, fmt.Errorf("invalid maxInstructions %q", v)
+		}
+	}
+	if v := r.FormValue("maxDuration"); v != "" {
+		budget.Duration, err = time.ParseDuration(v)
+		if err != nil || budget.Duration <= 0 {
+			return budget, fmt.Errorf("invalid maxDuration %q", v)
+		}
+	}
+	return budget, nil
+}
+
+// queryErrorResponse returns the status and message sent when a query fails
+func queryErrorResponse(err error) (int, string) {
+	var writeOverflow cassette.WriteOverflow
+	var invalidPage cassette.InvalidPage
+	var notAllowed cassette.QueryNotAllowed
+	var budgetExceeded cassette.QueryBudgetExceeded
+	switch {
+	case errors.Is(err, cassette.CannotQuery{}):
+		return http.StatusServiceUnavailable, err.Error()
+	case errors.As(err, &notAllowed):
+		return http.StatusForbidden, notAllowed.Error()
+	case errors.As(err, &budgetExceeded):
+		return http.StatusUnprocessableEntity, budgetExceeded.Error()
+	case errors.As(err, &invalidPage):
+		return http.StatusBadRequest, invalidPage.Error()
+	case errors.As(err, &writeOverflow):
+		// TODO: in theory, the request is small but the response is too big, not good but also not horribly incorrect
+		return http.StatusRequestEntityTooLarge, "unable to perform query, your query returns too much data"
+	}
+	return http.StatusBadRequest, "unable to perform query, check logs for more information"
+}
+
+// queryFormat returns the output format requested by the client,
+// the format parameter takes precedence over the Accept header
+func queryFormat(r *http.Request) (string, error) {
+	if format := r.FormValue("format"); format != "" {
+		if _, ok := queryContentTypes[format]; !ok {
+			return "", fmt.Errorf("unsupported format %q, use json, csv, tsv, ndjson or arrow", format)
+		}
+		return format, nil
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mt, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+		switch mt {
+		case "application/json":
+			return "json", nil
+		case "text/csv":
+			return "csv", nil
+		case "text/tab-separated-values":
+			return "tsv", nil
+		case "application/x-ndjson":
+			return "ndjson", nil
+		case "application/vnd.apache.arrow.stream":
+			return "arrow", nil
+		}
+	}
+	return "json", nil
+}
+
+func (s *streamWriter) Write(buf []byte) (int, error) {
+	if !s.started {
+		s.started = true
+		s.w.Header().Set("Content-Type", s.contentType)
+		s.w.Header().Set("X-Content-Type-Options", "nosniff")
+		s.w.Header().Set("Trailer", "X-Query-Status, X-Query-Rows, X-Query-Instructions")
+		s.w.WriteHeader(http.StatusOK)
+	}
+	n, err := s.w.Write(buf)
+	if f, ok := s.w.(http.Flusher); ok && err == nil {
+		f.Flush()
 	}
+	return n, err
 }
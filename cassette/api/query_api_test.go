@@ -3,13 +3,20 @@ package api
 import (
 	"bytes"
 	"context"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"testing"
 
 	"github.com/andrebq/boombox/cassette"
+	"github.com/andrebq/boombox/cassette/querycache"
+	"github.com/apache/arrow/go/v7/arrow/ipc"
 	"github.com/steinfletcher/apitest"
 )
 
@@ -39,6 +46,349 @@ func TestQueryApi(t *testing.T) {
 ]}`).
 		Status(http.StatusOK).
 		End()
+
+	apitest.New().
+		Handler(handler).
+		Get("/.query").
+		Query("sql", "select name, age, null as nickname from names order by age asc").
+		Query("format", "csv").
+		Expect(t).
+		Header("Content-Type", "text/csv; charset=utf-8").
+		Body("name,age,nickname\nbob,30,\ncharlie,31,\n").
+		Status(http.StatusOK).
+		End()
+
+	apitest.New().
+		Handler(handler).
+		Get("/.query").
+		Query("sql", "select name, age from names order by age asc").
+		Header("Accept", "text/tab-separated-values").
+		Expect(t).
+		Header("Content-Type", "text/tab-separated-values; charset=utf-8").
+		Body("name\tage\nbob\t30\ncharlie\t31\n").
+		Status(http.StatusOK).
+		End()
+
+	apitest.New().
+		Handler(handler).
+		Get("/.query").
+		Query("sql", "select name, age from names order by age asc").
+		Query("format", "ndjson").
+		Query("maxRows", "1").
+		Expect(t).
+		Header("Content-Type", "application/x-ndjson").
+		Body(`{"name":"bob","age":30}
+{"$status":"truncated","rows":1,"reason":"row limit reached"}
+`).
+		Status(http.StatusOK).
+		End()
+
+	apitest.New().
+		Handler(handler).
+		Get("/.query").
+		Query("sql", "select * from missing_table").
+		Query("format", "ndjson").
+		Expect(t).
+		Status(http.StatusBadRequest).
+		End()
+
+	apitest.New().
+		Handler(handler).
+		Get("/.query").
+		Query("sql", "select name, age + 1 as next_age from names order by age asc limit 1").
+		Query("metadata", "true").
+		Expect(t).
+		Body(`{"columns":["name","next_age"]
+,"metadata":[{"name":"name","type":"TEXT","nullable":true,"table":"names","column":"name"},{"name":"next_age"}]
+,"rows": [["bob",31]
+]}`).
+		Status(http.StatusOK).
+		End()
+
+	apitest.New().
+		Handler(handler).
+		Get("/.query").
+		Query("sql", "attach database ':memory:' as other").
+		Expect(t).
+		Body("query not allowed: attach and detach are not allowed\n").
+		Status(http.StatusForbidden).
+		End()
+
+	apitest.New().
+		Handler(handler).
+		Get("/.query").
+		Query("sql", "pragma journal_mode").
+		Query("format", "ndjson").
+		Expect(t).
+		Status(http.StatusForbidden).
+		End()
+
+	apitest.New().
+		Handler(handler).
+		Get("/.query").
+		Query("sql", "select name from names").
+		Query("format", "xml").
+		Expect(t).
+		Status(http.StatusBadRequest).
+		End()
+}
+
+func TestQueryArrowApi(t *testing.T) {
+	ctx := context.Background()
+	ctl, cleanup := tempQueryCassette(ctx, t, "test", func(ctx context.Context, c *cassette.Control) error {
+		_, _, err := c.ImportCSVDataset(ctx, "names", bytes.NewBufferString("name,age\nbob,30\ncharlie,31\n"))
+		return err
+	})
+	defer cleanup()
+	handler, err := AsQueryHandler(ctx, ctl, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/.query?format=arrow&sql=" + url.QueryEscape("select name, age from names order by age"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); ct != "application/vnd.apache.arrow.stream" {
+		t.Fatalf("Unexpected content type %v", ct)
+	}
+	reader, err := ipc.NewReader(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Release()
+	var rows int64
+	for reader.Next() {
+		rows += reader.Record().NumRows()
+	}
+	if err := reader.Err(); err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, res.Body)
+	if rows != 2 {
+		t.Fatalf("Expecting 2 rows got %v", rows)
+	}
+	if status := res.Trailer.Get("X-Query-Status"); status != cassette.QueryCompleted {
+		t.Fatalf("Expecting status trailer %v got %q", cassette.QueryCompleted, status)
+	}
+}
+
+func TestQueryParams(t *testing.T) {
+	ctx := context.Background()
+	ctl, cleanup := tempQueryCassette(ctx, t, "test", func(ctx context.Context, c *cassette.Control) error {
+		_, _, err := c.ImportCSVDataset(ctx, "names", bytes.NewBufferString("name,age\nbob,30\ncharlie,31\n"))
+		return err
+	})
+	defer cleanup()
+	handler, err := AsQueryHandler(ctx, ctl, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	apitest.New().
+		Handler(handler).
+		Get("/.query").
+		Query("sql", "select name from names where age > ? and name <> ?").
+		Query("p1:int", "30").
+		Query("p2", "bob").
+		Expect(t).
+		Body(`{"columns":["name"]
+,"rows": [["charlie"]
+]}`).
+		Status(http.StatusOK).
+		End()
+
+	apitest.New().
+		Handler(handler).
+		Get("/.query").
+		Query("sql", "select age from names where name = :name").
+		Query(":name", "bob").
+		Expect(t).
+		Body(`{"columns":["age"]
+,"rows": [[30]
+]}`).
+		Status(http.StatusOK).
+		End()
+
+	apitest.New().
+		Handler(handler).
+		Post("/.query").
+		JSON(`{"sql":"select name from names where age < :age","params":{":age":{"value":"31","type":"int"}}}`).
+		Expect(t).
+		Body(`{"columns":["name"]
+,"rows": [["bob"]
+]}`).
+		Status(http.StatusOK).
+		End()
+
+	apitest.New().
+		Handler(handler).
+		Post("/.query").
+		JSON(`{"sql":"select name from names where age = ?","params":[31]}`).
+		Expect(t).
+		Body(`{"columns":["name"]
+,"rows": [["charlie"]
+]}`).
+		Status(http.StatusOK).
+		End()
+
+	apitest.New().
+		Handler(handler).
+		Get("/.query").
+		Query("sql", "select name from names where age = ?2").
+		Query("p2", "30").
+		Expect(t).
+		Status(http.StatusBadRequest).
+		End()
+
+	apitest.New().
+		Handler(handler).
+		Post("/.query").
+		JSON(`{"sql":"select name from names where age = ?","params":[{"value":30,"type":"date"}]}`).
+		Expect(t).
+		Status(http.StatusBadRequest).
+		End()
+}
+
+func TestQueryBudgetApi(t *testing.T) {
+	ctx := context.Background()
+	ctl, cleanup := tempQueryCassette(ctx, t, "test", func(ctx context.Context, c *cassette.Control) error {
+		_, _, err := c.ImportCSVDataset(ctx, "names", bytes.NewBufferString("name,age\nbob,30\ncharlie,31\n"))
+		return err
+	})
+	defer cleanup()
+	handler, err := AsQueryHandler(ctx, ctl, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const endless = "with recursive n(i) as (select 1 union all select i + 1 from n) select count(*) from n"
+
+	res := httptest.NewRecorder()
+	// instructions are counted in steps of 1000, so the query must do some work
+	handler.ServeHTTP(res, httptest.NewRequest("GET", "/.query?sql="+url.QueryEscape("with recursive n(i) as (select 1 union all select i + 1 from n where i < 10000) select count(*) from n"), nil))
+	if res.Code != http.StatusOK {
+		t.Fatalf("Expecting status 200 got %v: %v", res.Code, res.Body.String())
+	} else if n, err := strconv.ParseInt(res.Header().Get("X-Query-Instructions"), 10, 64); err != nil || n <= 0 {
+		t.Fatalf("X-Query-Instructions should report the instructions used, got %q", res.Header().Get("X-Query-Instructions"))
+	}
+
+	apitest.New().
+		Handler(handler).
+		Get("/.query").
+		Query("sql", endless).
+		Query("maxInstructions", "10000").
+		Expect(t).
+		Body("query budget exceeded: query used more than 10000 instructions\n").
+		Status(http.StatusUnprocessableEntity).
+		End()
+
+	apitest.New().
+		Handler(handler).
+		Get("/.query").
+		Query("sql", endless).
+		Query("format", "ndjson").
+		Query("maxDuration", "20ms").
+		Expect(t).
+		Body(`{"$status":"error","rows":0,"reason":"query budget exceeded: query ran for more than 20ms"}
+`).
+		Status(http.StatusOK).
+		End()
+
+	apitest.New().
+		Handler(handler).
+		Get("/.query").
+		Query("sql", "select name from names").
+		Query("maxDuration", "forever").
+		Expect(t).
+		Status(http.StatusBadRequest).
+		End()
+}
+
+func TestQueryCacheApi(t *testing.T) {
+	ctx := context.Background()
+	ctl, cleanup := tempQueryCassette(ctx, t, "test", func(ctx context.Context, c *cassette.Control) error {
+		_, _, err := c.ImportCSVDataset(ctx, "names", bytes.NewBufferString("name,age\nbob,30\ncharlie,31\n"))
+		return err
+	})
+	defer cleanup()
+	cache, err := querycache.New(querycache.Options{MaxBytes: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler, err := CachedQueryHandler(cache)(ctx, ctl, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := func(sql string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/.query?sql="+url.QueryEscape(sql), nil)
+		if len(header) > 0 {
+			req.Header.Set("If-None-Match", header[0])
+		}
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		return res
+	}
+
+	first := query("select name from names order by name")
+	if first.Code != http.StatusOK || first.Header().Get("X-Cache") != "miss" {
+		t.Fatalf("First query should be a miss, got %v %v", first.Code, first.Header())
+	}
+	etag := first.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("Query should have an ETag")
+	}
+	second := query("select name\n  from names order by name;")
+	if second.Header().Get("X-Cache") != "hit" || second.Header().Get("ETag") != etag || second.Body.String() != first.Body.String() {
+		t.Fatalf("Second query should be a hit with the same content, got %v %q", second.Header(), second.Body.String())
+	}
+	notModified := query("select name from names order by name", etag)
+	if notModified.Code != http.StatusNotModified || notModified.Body.Len() != 0 {
+		t.Fatalf("Expecting status 304 without a body got %v %q", notModified.Code, notModified.Body.String())
+	}
+
+	volatile := query("select name, random() from names")
+	if volatile.Code != http.StatusOK || volatile.Header().Get("ETag") != "" {
+		t.Fatalf("Volatile queries should not have an ETag, got %v %v", volatile.Code, volatile.Header())
+	}
+	if volatile = query("select name, random() from names"); volatile.Header().Get("X-Cache") != "miss" {
+		t.Fatal("Volatile queries should not be cached")
+	}
+
+	// cached results must not bypass the limits of the request
+	const counter = "with recursive n(i) as (select 1 union all select i + 1 from n where i < 10000) select count(*) as total from n"
+	counted := query(counter)
+	if counted.Code != http.StatusOK {
+		t.Fatalf("Expecting status 200 got %v", counted.Code)
+	}
+	for _, limited := range []struct {
+		sql    string
+		param  string
+		value  string
+		status int
+	}{
+		{"select name from names order by name", "maxBuffer", "1", http.StatusRequestEntityTooLarge},
+		{counter, "maxInstructions", "1000", http.StatusUnprocessableEntity},
+	} {
+		apitest.New().
+			Handler(handler).
+			Get("/.query").
+			Query("sql", limited.sql).
+			Query(limited.param, limited.value).
+			Expect(t).
+			Status(limited.status).
+			End()
+	}
+
+	apitest.New().
+		Handler(handler).
+		Get("/.query/cache").
+		Expect(t).
+		Body(fmt.Sprintf(`{"hits":2,"misses":6,"diskHits":0,"evictions":0,"entries":2,"bytes":%v,"diskBytes":0}`, 53+counted.Body.Len())).
+		Status(http.StatusOK).
+		End()
 }
 
 func tempQueryCassette(ctx context.Context, t interface {
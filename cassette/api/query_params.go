@@ -0,0 +1,188 @@
+package api
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxQueryBody = 1_000_000
+)
+
+type (
+	// queryBody is accepted by POST /.query, params use the same keys
+	// as the query string or an array for positional parameters
+	queryBody struct {
+		SQL    string          `json:"sql"`
+		Params json.RawMessage `json:"params"`
+	}
+)
+
+var (
+	reParamKey = regexp.MustCompile(`^(p[1-9][0-9]*|:[a-zA-Z_][a-zA-Z0-9_]*)(?::(int|real|text|null))?$`)
+)
+
+// queryRequest returns the sql and the parameters of the request.
+//
+// Parameters are either positional (p1, p2, ...) or named (:name) and can declare
+// their type with a suffix (p1:int, :name:real), without a type query string values
+// are bound as text and JSON values keep their own type.
+func queryRequest(r *http.Request) (string, []interface{}, error) {
+	if r.Method == http.MethodPost {
+		mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if mt == "application/json" {
+			return jsonQueryRequest(r)
+		}
+	}
+	params := map[string]interface{}{}
+	for key, values := range r.Form {
+		if reParamKey.MatchString(key) {
+			params[key] = values[len(values)-1]
+		}
+	}
+	args, err := bindParams(params)
+	return r.FormValue("sql"), args, err
+}
+
+func jsonQueryRequest(r *http.Request) (string, []interface{}, error) {
+	content, err := io.ReadAll(io.LimitReader(r.Body, maxQueryBody+1))
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to read request body, cause %w", err)
+	}
+	if len(content) > maxQueryBody {
+		return "", nil, errors.New("request body is too large")
+	}
+	var body queryBody
+	dec := json.NewDecoder(bytes.NewReader(content))
+	dec.UseNumber()
+	if err = dec.Decode(&body); err != nil {
+		return "", nil, fmt.Errorf("invalid request body, cause %w", err)
+	}
+	params := map[string]interface{}{}
+	dec = json.NewDecoder(bytes.NewReader(body.Params))
+	dec.UseNumber()
+	switch {
+	case len(body.Params) == 0 || string(body.Params) == "null":
+	case body.Params[0] == '[':
+		var list []interface{}
+		if err = dec.Decode(&list); err != nil {
+			return "", nil, fmt.Errorf("invalid params, cause %w", err)
+		}
+		for i, v := range list {
+			params[fmt.Sprintf("p%v", i+1)] = v
+		}
+	default:
+		if err = dec.Decode(&params); err != nil {
+			return "", nil, fmt.Errorf("invalid params, cause %w", err)
+		}
+	}
+	args, err := bindParams(params)
+	return body.SQL, args, err
+}
+
+// bindParams converts params to the arguments accepted by Control.Query,
+// positional parameters must start at p1 and cannot have gaps.
+func bindParams(params map[string]interface{}) ([]interface{}, error) {
+	var positional []interface{}
+	byIndex := map[int]interface{}{}
+	var named []interface{}
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		match := reParamKey.FindStringSubmatch(key)
+		if match == nil {
+			return nil, fmt.Errorf("invalid parameter %q, use p1, p2... or :name", key)
+		}
+		name, paramType, value := match[1], match[2], params[key]
+		// JSON bodies might use {"value": ..., "type": ...} instead of the key suffix
+		if typed, ok := value.(map[string]interface{}); ok {
+			valueType, _ := typed["type"].(string)
+			if paramType != "" && valueType != "" && valueType != paramType {
+				return nil, fmt.Errorf("parameter %v declares two types", name)
+			}
+			if valueType != "" {
+				paramType = valueType
+			}
+			value = typed["value"]
+		}
+		converted, err := convertParam(value, paramType)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for parameter %v, %v", name, err)
+		}
+		if strings.HasPrefix(name, ":") {
+			named = append(named, sql.Named(name[1:], converted))
+			continue
+		}
+		idx, _ := strconv.Atoi(name[1:])
+		if _, dup := byIndex[idx]; dup {
+			return nil, fmt.Errorf("parameter %v is declared more than once", name)
+		}
+		byIndex[idx] = converted
+	}
+	for i := 1; i <= len(byIndex); i++ {
+		v, ok := byIndex[i]
+		if !ok {
+			return nil, fmt.Errorf("parameter p%v is missing", i)
+		}
+		positional = append(positional, v)
+	}
+	return append(positional, named...), nil
+}
+
+func convertParam(value interface{}, paramType string) (interface{}, error) {
+	switch paramType {
+	case "", "int", "real", "text", "null":
+	default:
+		return nil, fmt.Errorf("unknown type %q, use int, real, text or null", paramType)
+	}
+	if paramType == "null" || value == nil {
+		return nil, nil
+	}
+	switch paramType {
+	case "":
+		switch v := value.(type) {
+		case json.Number:
+			if n, err := v.Int64(); err == nil {
+				return n, nil
+			}
+			return v.Float64()
+		case string, bool:
+			return v, nil
+		}
+	case "text":
+		switch v := value.(type) {
+		case string:
+			return v, nil
+		case json.Number:
+			return v.String(), nil
+		}
+	case "int":
+		switch v := value.(type) {
+		case string:
+			return strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		case json.Number:
+			return v.Int64()
+		}
+	case "real":
+		switch v := value.(type) {
+		case string:
+			return strconv.ParseFloat(strings.TrimSpace(v), 64)
+		case json.Number:
+			return v.Float64()
+		}
+	}
+	return nil, fmt.Errorf("unexpected value %v", value)
+}
@@ -0,0 +1,54 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/andrebq/boombox/cassette"
+	"github.com/julienschmidt/httprouter"
+)
+
+// searchCassette runs a full-text search over the index of the table named by the request path,
+// the output options work like the /.query endpoint.
+//
+// q contains the terms to search, mode=raw allows the FTS5 query syntax and limit
+// bounds the number of results.
+func searchCassette(c *cassette.Control, run queryRunFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		search := cassette.Search{Text: r.FormValue("q"), Raw: r.FormValue("mode") == "raw"}
+		if v := r.FormValue("limit"); v != "" {
+			search.Limit, err = strconv.Atoi(v)
+			if err != nil {
+				http.Error(w, "invalid limit parameter", http.StatusBadRequest)
+				return
+			}
+		}
+		table := httprouter.ParamsFromContext(r.Context()).ByName("table")
+		sql, args, err := c.SearchQuery(r.Context(), table, search)
+		var notFound cassette.FTSIndexNotFound
+		var invalidSearch cassette.InvalidSearch
+		var invalidTable cassette.InvalidTableName
+		switch {
+		case errors.As(err, &notFound):
+			http.Error(w, notFound.Error(), http.StatusNotFound)
+			return
+		case errors.As(err, &invalidSearch):
+			http.Error(w, invalidSearch.Error(), http.StatusBadRequest)
+			return
+		case errors.As(err, &invalidTable):
+			http.Error(w, invalidTable.Error(), http.StatusBadRequest)
+			return
+		case err != nil:
+			code, msg := queryErrorResponse(err)
+			http.Error(w, msg, code)
+			return
+		}
+		run(w, r, sql, args)
+	}
+}
@@ -0,0 +1,82 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andrebq/boombox/cassette"
+)
+
+func TestSearchApi(t *testing.T) {
+	ctx := context.Background()
+	var supported bool
+	ctl, cleanup := tempQueryCassette(ctx, t, "test", func(ctx context.Context, c *cassette.Control) error {
+		_, _, err := c.ImportCSVDataset(ctx, "notes", bytes.NewBufferString("id,text\n1,wind farm in the north\n2,solar panels\n"))
+		if err != nil {
+			return err
+		}
+		_, _, err = c.ImportCSVDataset(ctx, "plain", bytes.NewBufferString("id\n1\n"))
+		if err != nil {
+			return err
+		}
+		err = c.AddFTS(ctx, "notes", []string{"text"})
+		if errors.As(err, &cassette.FTSNotSupported{}) {
+			return nil
+		}
+		supported = err == nil
+		return err
+	})
+	defer cleanup()
+	if !supported {
+		t.Skip("SQLite was built without FTS5, use the sqlite_fts5 build tag")
+	}
+	handler, err := AsQueryHandler(ctx, ctl, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/.search/notes?q=wind", nil)
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("Expecting status 200 got %v %v", res.Code, res.Body.String())
+	}
+	var result struct {
+		Columns []string        `json:"columns"`
+		Rows    [][]interface{} `json:"rows"`
+	}
+	if err := json.Unmarshal(res.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Rows) != 1 || result.Rows[0][2] != "<mark>wind</mark> farm in the north" {
+		t.Fatalf("Unexpected search result %v", res.Body.String())
+	}
+
+	res = httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest("GET", "/.search/notes?q=panels&format=csv", nil))
+	if !strings.HasPrefix(res.Body.String(), "rowid,rank,snippet,id,text\n2,") || !strings.Contains(res.Body.String(), ",solar <mark>panels</mark>,2,solar panels\n") {
+		t.Fatalf("Search should support the same formats of /.query, got %v", res.Body.String())
+	}
+
+	for _, c := range []struct {
+		path   string
+		status int
+	}{
+		{"/.search/notes", http.StatusBadRequest},
+		{"/.search/notes?q=wind&limit=many", http.StatusBadRequest},
+		{"/.search/plain?q=wind", http.StatusNotFound},
+		{"/.search/notes?q=%22unbalanced&mode=raw", http.StatusBadRequest},
+	} {
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, httptest.NewRequest("GET", c.path, nil))
+		if res.Code != c.status {
+			t.Errorf("%v should return %v got %v %v", c.path, c.status, res.Code, res.Body.String())
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package cassette
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/apache/arrow/go/v7/arrow"
+	"github.com/apache/arrow/go/v7/arrow/array"
+	"github.com/apache/arrow/go/v7/arrow/ipc"
+	"github.com/apache/arrow/go/v7/arrow/memory"
+)
+
+const (
+	arrowBatchSize = 1024
+)
+
+// QueryArrow streams the result of query to out as an Arrow IPC stream,
+// a record batch is written for every 1024 rows.
+//
+// The schema is derived from the types declared by the columns, columns without
+// a declared type (eg.: expressions) use the type of the value found on the first row.
+// Values which cannot be converted to the type of their column fail the query,
+// the rows of the batch which contains the value are not written. Use cast to
+// give those columns a type which fits all values (eg.: cast(value as text)).
+//
+// maxRows and ctx limit the stream in the same way as QueryNDJSON, since Arrow streams
+// do not have a place for the status, it is only returned to the caller.
+func (c *Control) QueryArrow(ctx context.Context, out io.Writer, maxRows int64, query string, args ...interface{}) (QueryStatus, error) {
+	if c.writeable {
+		return QueryStatus{}, CannotQuery{}
+	}
+	rows, err := c.queryRows(ctx, query, args)
+	if err != nil {
+		return QueryStatus{}, err
+	}
+	defer rows.Close()
+	columnTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return QueryStatus{}, QueryError{Query: query, cause: err, Params: args}
+	}
+
+	r := make(Row, len(columnTypes))
+	scanTarget := make([]interface{}, len(r))
+	for i := range scanTarget {
+		scanTarget[i] = &r[i]
+	}
+	// the first row is scanned before the schema is known,
+	// so its values can be used for columns without a declared type
+	hasRow := rows.Next()
+	if hasRow {
+		err = rows.Scan(scanTarget...)
+	} else {
+		err = rows.Err()
+	}
+	if err != nil {
+		return QueryStatus{}, QueryError{Query: query, cause: err, Params: args}
+	}
+	fields := make([]arrow.Field, len(columnTypes))
+	for i, ct := range columnTypes {
+		nullable, ok := ct.Nullable()
+		fields[i] = arrow.Field{
+			Name:     ct.Name(),
+			Type:     arrowType(ct.DatabaseTypeName(), r[i]),
+			Nullable: nullable || !ok,
+		}
+	}
+	schema := arrow.NewSchema(fields, nil)
+	mem := memory.NewGoAllocator()
+	builder := array.NewRecordBuilder(mem, schema)
+	defer builder.Release()
+	w := ipc.NewWriter(out, ipc.WithSchema(schema), ipc.WithAllocator(mem))
+
+	var status QueryStatus
+	pending := 0
+	flush := func() error {
+		rec := builder.NewRecord()
+		defer rec.Release()
+		pending = 0
+		return w.Write(rec)
+	}
+	for hasRow {
+		if maxRows > 0 && status.Rows >= maxRows {
+			status.Status, status.Reason = QueryTruncated, "row limit reached"
+			break
+		}
+		for i, v := range r {
+			if !appendArrowValue(builder.Field(i), v) {
+				err = fmt.Errorf("value %v of column %v cannot be converted to %v", v, fields[i].Name, fields[i].Type)
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+		status.Rows++
+		pending++
+		if pending == arrowBatchSize {
+			if err = flush(); err != nil {
+				return status, err
+			}
+		}
+		if hasRow = rows.Next(); hasRow {
+			err = rows.Scan(scanTarget...)
+		} else {
+			err = rows.Err()
+		}
+		if err != nil {
+			break
+		}
+	}
+	// a failed row leaves the builder with columns of different lengths
+	if pending > 0 && err == nil {
+		if flushErr := flush(); flushErr != nil {
+			return status, flushErr
+		}
+	}
+	status, err = finishQuery(ctx, status, err, query, args)
+	if err != nil {
+		// the stream is left without its end marker, so readers know it is incomplete
+		return status, err
+	}
+	return status, w.Close()
+}
+
+// arrowType maps the declared type of a column to an Arrow type,
+// following the rules used by SQLite to compute column affinity.
+func arrowType(declared string, sample interface{}) arrow.DataType {
+	declared = strings.ToUpper(declared)
+	switch {
+	case declared == "DATE" || declared == "DATETIME" || declared == "TIMESTAMP":
+		// the driver parses those columns as time.Time
+		return arrow.FixedWidthTypes.Timestamp_us
+	case strings.Contains(declared, "BOOL"):
+		return arrow.FixedWidthTypes.Boolean
+	case strings.Contains(declared, "INT"):
+		return arrow.PrimitiveTypes.Int64
+	case strings.Contains(declared, "CHAR"), strings.Contains(declared, "CLOB"), strings.Contains(declared, "TEXT"):
+		return arrow.BinaryTypes.String
+	case strings.Contains(declared, "BLOB"):
+		return arrow.BinaryTypes.Binary
+	case strings.Contains(declared, "REAL"), strings.Contains(declared, "FLOA"), strings.Contains(declared, "DOUB"):
+		return arrow.PrimitiveTypes.Float64
+	}
+	switch sample.(type) {
+	case int64:
+		return arrow.PrimitiveTypes.Int64
+	case float64:
+		return arrow.PrimitiveTypes.Float64
+	case bool:
+		return arrow.FixedWidthTypes.Boolean
+	case []byte:
+		return arrow.BinaryTypes.Binary
+	case time.Time:
+		return arrow.FixedWidthTypes.Timestamp_us
+	}
+	return arrow.BinaryTypes.String
+}
+
+// appendArrowValue appends v to b, returning false if v
+// cannot be converted to the type of b
+func appendArrowValue(b array.Builder, v interface{}) bool {
+	if v == nil {
+		b.AppendNull()
+		return true
+	}
+	switch b := b.(type) {
+	case *array.Int64Builder:
+		switch v := v.(type) {
+		case int64:
+			b.Append(v)
+			return true
+		case float64:
+			if v == math.Trunc(v) && v >= math.MinInt64 && v < math.MaxInt64 {
+				b.Append(int64(v))
+				return true
+			}
+		case bool:
+			if v {
+				b.Append(1)
+			} else {
+				b.Append(0)
+			}
+			return true
+		}
+	case *array.Float64Builder:
+		switch v := v.(type) {
+		case float64:
+			b.Append(v)
+			return true
+		case int64:
+			b.Append(float64(v))
+			return true
+		}
+	case *array.BooleanBuilder:
+		switch v := v.(type) {
+		case bool:
+			b.Append(v)
+			return true
+		case int64:
+			b.Append(v != 0)
+			return true
+		}
+	case *array.TimestampBuilder:
+		if v, ok := v.(time.Time); ok {
+			b.Append(arrow.Timestamp(v.UnixMicro()))
+			return true
+		}
+	case *array.BinaryBuilder:
+		switch v := v.(type) {
+		case []byte:
+			b.Append(v)
+			return true
+		case string:
+			b.AppendString(v)
+			return true
+		}
+	case *array.StringBuilder:
+		b.Append(csvField(v))
+		return true
+	}
+	return false
+}
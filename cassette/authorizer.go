@@ -0,0 +1,308 @@
+package cassette
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// sqliteRecursive is the authorizer action of recursive CTEs,
+// it is not exported by go-sqlite3
+const sqliteRecursive = 33
+
+type (
+	// QueryPolicy controls which statements can be used by Query and its variants,
+	// it is checked by a SQLite authorizer while the statements are prepared.
+	//
+	// Queries are always read-only, ATTACH/DETACH and transactions are never allowed.
+	QueryPolicy struct {
+		// Pragmas are allowed in addition to the pragmas which describe the schema (table_info, index_list...)
+		Pragmas []string `json:"pragmas,omitempty"`
+		// DenyFunctions are rejected in addition to load_extension, randomblob and zeroblob
+		DenyFunctions []string `json:"deny_functions,omitempty"`
+		// TempTables allows queries to create and change temporary tables, views and indexes
+		TempTables bool `json:"temp_tables,omitempty"`
+		// MaxInstructions limits the SQLite VM instructions used by each query
+		MaxInstructions int64 `json:"max_instructions,omitempty"`
+		// MaxDuration limits the wall-clock time used by each query
+		MaxDuration time.Duration `json:"max_duration,omitempty"`
+	}
+
+	compiledPolicy struct {
+		pragmas       map[string]bool
+		denyFunctions map[string]bool
+		tempTables    bool
+		budget        QueryBudget
+	}
+
+	// queryGuard is the authorizer of a connection, it only checks statements
+	// while active, so the connection can still be used by the cassette itself
+	queryGuard struct {
+		policy   *compiledPolicy
+		active   bool
+		denied   string
+		volatile bool
+	}
+
+	// guardedConn is a connection with its own query authorizer,
+	// the guard lives as long as the connection
+	guardedConn struct {
+		*sqlite3.SQLiteConn
+		guard *queryGuard
+		// dataset is true once the dataset is attached to the connection
+		dataset bool
+	}
+
+	// sqliteConnector opens guarded connections, it is used
+	// instead of sql.Open to keep the guard on the connection
+	sqliteConnector struct {
+		dsn    string
+		driver sqlite3.SQLiteDriver
+	}
+
+	// queryRows keeps the connection used by a query until its rows are closed
+	queryRows struct {
+		*sql.Rows
+		conn  *sql.Conn
+		meter *queryMeter
+		query string
+	}
+)
+
+var (
+	// data_version is read by fts5 when a full-text index is used
+	defaultPragmas       = []string{"table_info", "table_xinfo", "table_list", "index_list", "index_info", "index_xinfo", "foreign_key_list", "data_version"}
+	defaultDenyFunctions = []string{"load_extension", "randomblob", "zeroblob"}
+	// volatileFunctions might return a different value each time a query runs,
+	// date functions are included since they accept 'now'
+	volatileFunctions = map[string]bool{
+		"random": true, "randomblob": true, "changes": true, "total_changes": true, "last_insert_rowid": true,
+		"date": true, "time": true, "datetime": true, "julianday": true, "unixepoch": true, "strftime": true,
+		"current_date": true, "current_time": true, "current_timestamp": true,
+	}
+)
+
+func (p QueryPolicy) validate() error {
+	for _, name := range append(append([]string{}, p.Pragmas...), p.DenyFunctions...) {
+		if !reValidIdentifiers.MatchString(name) {
+			return fmt.Errorf("%q is not a valid pragma or function name", name)
+		}
+	}
+	if p.MaxInstructions < 0 || p.MaxDuration < 0 {
+		return errors.New("query budgets cannot be negative")
+	}
+	return nil
+}
+
+func (p QueryPolicy) compile() *compiledPolicy {
+	cp := &compiledPolicy{
+		pragmas:       map[string]bool{},
+		denyFunctions: map[string]bool{},
+		tempTables:    p.TempTables,
+		budget:        QueryBudget{Instructions: p.MaxInstructions, Duration: p.MaxDuration},
+	}
+	for _, name := range append(append([]string{}, defaultPragmas...), p.Pragmas...) {
+		cp.pragmas[strings.ToLower(name)] = true
+	}
+	for _, name := range append(append([]string{}, defaultDenyFunctions...), p.DenyFunctions...) {
+		cp.denyFunctions[strings.ToLower(name)] = true
+	}
+	return cp
+}
+
+// check returns why the action is not allowed, or an empty string if it is,
+// see https://www.sqlite.org/c3ref/c_alter_table.html for the arguments of each action
+func (cp *compiledPolicy) check(op int, arg1, arg2, arg3 string) string {
+	switch op {
+	case sqlite3.SQLITE_SELECT, sqlite3.SQLITE_READ, sqliteRecursive:
+		return ""
+	case sqlite3.SQLITE_FUNCTION:
+		if cp.denyFunctions[strings.ToLower(arg2)] {
+			return fmt.Sprintf("function %v is not allowed", arg2)
+		}
+		return ""
+	case sqlite3.SQLITE_PRAGMA:
+		if cp.pragmas[strings.ToLower(arg1)] {
+			return ""
+		}
+		return fmt.Sprintf("pragma %v is not allowed", arg1)
+	case sqlite3.SQLITE_ATTACH, sqlite3.SQLITE_DETACH:
+		return "attach and detach are not allowed"
+	case sqlite3.SQLITE_CREATE_TEMP_TABLE, sqlite3.SQLITE_CREATE_TEMP_INDEX, sqlite3.SQLITE_CREATE_TEMP_VIEW,
+		sqlite3.SQLITE_DROP_TEMP_TABLE, sqlite3.SQLITE_DROP_TEMP_INDEX, sqlite3.SQLITE_DROP_TEMP_VIEW:
+		if cp.tempTables {
+			return ""
+		}
+		return "temporary tables are not allowed"
+	case sqlite3.SQLITE_INSERT, sqlite3.SQLITE_UPDATE, sqlite3.SQLITE_DELETE:
+		// arg3 is the database of the table
+		if cp.tempTables && arg3 == "temp" {
+			return ""
+		}
+	}
+	return "only read-only statements are allowed"
+}
+
+func (g *queryGuard) authorize(op int, arg1, arg2, arg3 string) int {
+	if !g.active {
+		return sqlite3.SQLITE_OK
+	}
+	if op == sqlite3.SQLITE_FUNCTION && volatileFunctions[strings.ToLower(arg2)] {
+		g.volatile = true
+	}
+	// the first use of a virtual table (eg.: fts5) calls sqlite3_declare_vtab,
+	// which checks an update of the schema table that is never executed,
+	// ignoring it allows the declaration and turns real attempts into no-ops
+	if op == sqlite3.SQLITE_UPDATE && (arg1 == "sqlite_master" || arg1 == "sqlite_schema") {
+		return sqlite3.SQLITE_IGNORE
+	}
+	if reason := g.policy.check(op, arg1, arg2, arg3); reason != "" {
+		if g.denied == "" {
+			g.denied = reason
+		}
+		return sqlite3.SQLITE_DENY
+	}
+	return sqlite3.SQLITE_OK
+}
+
+// SetQueryPolicy replaces the policy used by queries, by default the policy
+// is taken from the manifest of the cassette. Storing the manifest again
+// replaces the policy set by SetQueryPolicy.
+func (c *Control) SetQueryPolicy(p QueryPolicy) error {
+	if err := p.validate(); err != nil {
+		return InvalidManifest{Reason: err.Error()}
+	}
+	c.policyMu.Lock()
+	c.policy = p.compile()
+	c.policyMu.Unlock()
+	return nil
+}
+
+func (c *Control) queryPolicy(ctx context.Context) (*compiledPolicy, error) {
+	c.policyMu.Lock()
+	defer c.policyMu.Unlock()
+	if c.policy != nil {
+		return c.policy, nil
+	}
+	var p QueryPolicy
+	m, err := c.Manifest(ctx)
+	if err == nil && m.Query != nil {
+		p = *m.Query
+	} else if err != nil && !errors.As(err, &ManifestNotFound{}) {
+		return nil, err
+	}
+	c.policy = p.compile()
+	return c.policy, nil
+}
+
+// queryRows runs a query provided by the user, each statement is checked by
+// the query policy of the cassette while it is prepared.
+func (c *Control) queryRows(ctx context.Context, query string, args []interface{}) (*queryRows, error) {
+	policy, err := c.queryPolicy(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := c.db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to acquire connection, cause %w", err)
+	}
+	gc, err := c.connGuard(ctx, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// conn is not returned to the pool until the query ends,
+	// so gc can be used outside of conn.Raw
+	guard := gc.guard
+	meter, err := startMeter(ctx, gc.SQLiteConn, policy.budget)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("unable to start query meter, cause %w", err)
+	}
+	guard.policy, guard.active, guard.denied, guard.volatile = policy, true, "", false
+	rows, err := conn.QueryContext(ctx, query, args...)
+	guard.active = false
+	if guard.volatile {
+		queryCost(ctx).markVolatile()
+	}
+	if err != nil {
+		meter.stop()
+		conn.Close()
+		if guard.denied != "" {
+			return nil, QueryNotAllowed{Query: query, Reason: guard.denied}
+		} else if budgetErr := meter.err(query); budgetErr != nil {
+			return nil, budgetErr
+		}
+		return nil, QueryError{Query: query, cause: err, Params: args}
+	}
+	return &queryRows{Rows: rows, conn: conn, meter: meter, query: query}, nil
+}
+
+// connGuard returns the guarded connection behind conn and attaches the dataset
+// to it, if that was not done yet.
+func (c *Control) connGuard(ctx context.Context, conn *sql.Conn) (*guardedConn, error) {
+	var gc *guardedConn
+	err := conn.Raw(func(dc interface{}) error {
+		var ok bool
+		gc, ok = dc.(*guardedConn)
+		if !ok {
+			return fmt.Errorf("unexpected driver connection %T", dc)
+		}
+		return nil
+	})
+	if err != nil || gc.dataset || c.dataPath == "" {
+		return gc, err
+	}
+	// the dataset is attached by initData on a single connection,
+	// other connections from the pool need to attach it too
+	var attached int
+	err = conn.QueryRowContext(ctx, `select count(*) from pragma_database_list where name = 'dataset'`).Scan(&attached)
+	if err == nil && attached == 0 {
+		_, err = conn.ExecContext(ctx, `attach database ? as 'dataset'`, c.dataPath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to attach dataset, cause %w", err)
+	}
+	gc.dataset = true
+	return gc, nil
+}
+
+// Connect opens a connection and registers its authorizer,
+// go-sqlite3 releases the authorizer when the connection is closed
+func (s *sqliteConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := s.driver.Open(s.dsn)
+	if err != nil {
+		return nil, err
+	}
+	sc, ok := conn.(*sqlite3.SQLiteConn)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected driver connection %T", conn)
+	}
+	gc := &guardedConn{SQLiteConn: sc, guard: &queryGuard{}}
+	sc.RegisterAuthorizer(gc.guard.authorize)
+	return gc, nil
+}
+
+func (s *sqliteConnector) Driver() driver.Driver { return &s.driver }
+
+// Err returns QueryBudgetExceeded instead of the interruption reported by SQLite
+func (r *queryRows) Err() error {
+	if err := r.meter.err(r.query); err != nil {
+		return err
+	}
+	return r.Rows.Err()
+}
+
+func (r *queryRows) Close() error {
+	err := r.Rows.Close()
+	r.meter.stop()
+	r.conn.Close()
+	return err
+}
@@ -0,0 +1,242 @@
+package cassette
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+const (
+	// blobChunkSize is the maximum amount of bytes kept in a single row of blob_chunks
+	blobChunkSize = 64 * 1024
+
+	// pendingBlob is the temporary key used while the content of a blob is
+	// being written and its hash is still unknown, it never survives a transaction.
+	pendingBlob = "pending"
+)
+
+type (
+	// Asset contains the metadata about a given asset,
+	// without its content
+	Asset struct {
+		ID          int64
+		Path        string
+		MimeType    string
+		ContentHash string
+		Size        int64
+		// UTF8 indicates if the content is a valid utf-8 sequence
+		UTF8 bool
+	}
+
+	storedBlob struct {
+		hash string
+		size int64
+		utf8 bool
+	}
+
+	utf8Validator struct {
+		pending []byte
+		invalid bool
+	}
+)
+
+// IsTextMimeType returns true for mime-types which must be utf-8 encoded
+func IsTextMimeType(mimetype string) bool {
+	switch mimetype {
+	case "text/html", "text/json", "application/json", "application/x-lua", "text/x-lua":
+		return true
+	}
+	return false
+}
+
+// StatAsset returns the metadata of the asset stored at the given path.
+//
+// ContentHash is derived exclusively from the content of the asset,
+// which makes it usable as a strong ETag
+func (c *Control) StatAsset(ctx context.Context, assetPath string) (Asset, error) {
+	assetPath, pathHash := c.normalizeAssetPath(assetPath)
+	a := Asset{Path: assetPath}
+	err := c.db.QueryRowContext(ctx, `select a.asset_id, a.mime_type, a.content_hash, b.size, b.utf8 from assets a
+	inner join blobs b on a.content_hash = b.content_hash
+	where a.path_hash64 = ? and a.path = ?`, pathHash, assetPath).Scan(&a.ID, &a.MimeType, &a.ContentHash, &a.Size, &a.UTF8)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Asset{}, AssetNotFound{Path: assetPath}
+	} else if err != nil {
+		return Asset{}, fmt.Errorf("unable to load %v from cassete, cause %w", assetPath, err)
+	}
+	return a, nil
+}
+
+// storeBlob saves content under its hash, if the content is already
+// present in the cassette, it is not stored again.
+//
+// Content is written in chunks under a temporary key while the hash is computed,
+// once the reader is exhausted the chunks are either renamed to the actual hash
+// or discarded if that content was already known.
+func storeBlob(ctx context.Context, tx dbtx, content io.Reader) (storedBlob, error) {
+	_, err := tx.ExecContext(ctx, `delete from blob_chunks where content_hash = ?`, pendingBlob)
+	if err != nil {
+		return storedBlob{}, fmt.Errorf("unable to prepare blob storage, cause %w", err)
+	}
+	hash := sha256.New()
+	var validator utf8Validator
+	var blob storedBlob
+	buf := make([]byte, blobChunkSize)
+	for chunk := 0; ; chunk++ {
+		n, err := io.ReadFull(content, buf)
+		if n > 0 {
+			hash.Write(buf[:n])
+			validator.Write(buf[:n])
+			blob.size += int64(n)
+			_, insertErr := tx.ExecContext(ctx, `insert into blob_chunks(content_hash, chunk, data) values (?, ?, ?)`, pendingBlob, chunk, buf[:n])
+			if insertErr != nil {
+				return storedBlob{}, fmt.Errorf("unable to store blob chunk %v, cause %w", chunk, insertErr)
+			}
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		} else if err != nil {
+			return storedBlob{}, fmt.Errorf("unable to read content to store, cause %w", err)
+		}
+	}
+	blob.hash = hex.EncodeToString(hash.Sum(nil))
+	blob.utf8 = validator.Valid()
+	res, err := tx.ExecContext(ctx, `insert into blobs(content_hash, size, utf8) values (?, ?, ?) on conflict (content_hash) do nothing`,
+		blob.hash, blob.size, blob.utf8)
+	if err != nil {
+		return storedBlob{}, fmt.Errorf("unable to store blob %v, cause %w", blob.hash, err)
+	}
+	if inserted, _ := res.RowsAffected(); inserted == 0 {
+		_, err = tx.ExecContext(ctx, `delete from blob_chunks where content_hash = ?`, pendingBlob)
+	} else {
+		_, err = tx.ExecContext(ctx, `update blob_chunks set content_hash = ? where content_hash = ?`, blob.hash, pendingBlob)
+	}
+	if err != nil {
+		return storedBlob{}, fmt.Errorf("unable to store blob %v, cause %w", blob.hash, err)
+	}
+	return blob, nil
+}
+
+// copyBlob writes the content of a blob to out, one chunk at a time
+func (c *Control) copyBlob(ctx context.Context, tx dbtx, out io.Writer, contentHash string) error {
+	rows, err := tx.QueryContext(ctx, `select data from blob_chunks where content_hash = ? order by chunk asc`, contentHash)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var chunk sql.RawBytes
+	for rows.Next() {
+		err = rows.Scan(&chunk)
+		if err != nil {
+			return err
+		}
+		_, err = out.Write(chunk)
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// checkBlobs recomputes the hash of every blob from its chunks
+// and returns CorruptBlob for the first one which does not match
+func (c *Control) checkBlobs(ctx context.Context, tx dbtx) error {
+	rows, err := tx.QueryContext(ctx, `select content_hash from blobs order by content_hash asc`)
+	if err != nil {
+		return fmt.Errorf("unable to list blobs, cause %w", err)
+	}
+	var hashes []string
+	for rows.Next() {
+		var h string
+		if err := rows.Scan(&h); err != nil {
+			rows.Close()
+			return fmt.Errorf("unable to list blobs, cause %w", err)
+		}
+		hashes = append(hashes, h)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("unable to list blobs, cause %w", err)
+	}
+	for _, expected := range hashes {
+		actual, err := c.blobHash(ctx, tx, expected)
+		if err != nil {
+			return err
+		}
+		if actual != expected {
+			return CorruptBlob{ContentHash: expected, Actual: actual}
+		}
+	}
+	return nil
+}
+
+// blobHash computes the hash of the chunks stored for contentHash
+func (c *Control) blobHash(ctx context.Context, tx dbtx, contentHash string) (string, error) {
+	hash := sha256.New()
+	err := c.copyBlob(ctx, tx, hash, contentHash)
+	if err != nil {
+		return "", fmt.Errorf("unable to read blob %v, cause %w", contentHash, err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// pruneBlobs removes blobs which are not referenced by any asset, variant or revision
+func (c *Control) pruneBlobs(ctx context.Context, tx dbtx) error {
+	const unreferenced = `content_hash not in (
+		select content_hash from assets
+		union select content_hash from asset_variants
+		union select content_hash from asset_revisions)`
+	_, err := tx.ExecContext(ctx, `delete from blob_chunks where `+unreferenced)
+	if err == nil {
+		_, err = tx.ExecContext(ctx, `delete from blobs where `+unreferenced)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to remove unreferenced blobs, cause %w", err)
+	}
+	return nil
+}
+
+// Write feeds more data to the validator, a rune might be split
+// between two calls to Write
+func (v *utf8Validator) Write(p []byte) (int, error) {
+	n := len(p)
+	if v.invalid {
+		return n, nil
+	}
+	for len(v.pending) > 0 && len(p) > 0 {
+		v.pending = append(v.pending, p[0])
+		p = p[1:]
+		if utf8.FullRune(v.pending) {
+			if r, size := utf8.DecodeRune(v.pending); r == utf8.RuneError && size == 1 {
+				v.invalid = true
+				return n, nil
+			}
+			v.pending = v.pending[:0]
+		}
+	}
+	tail := len(p)
+	for i := len(p) - 1; i >= 0 && i >= len(p)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(p[i]) {
+			if !utf8.FullRune(p[i:]) {
+				tail = i
+			}
+			break
+		}
+	}
+	if !utf8.Valid(p[:tail]) {
+		v.invalid = true
+		return n, nil
+	}
+	v.pending = append(v.pending, p[tail:]...)
+	return n, nil
+}
+
+// Valid returns true if all the data written so far is valid utf-8
+func (v *utf8Validator) Valid() bool {
+	return !v.invalid && len(v.pending) == 0
+}
@@ -0,0 +1,220 @@
+package cassette
+
+/*
+#include <stdlib.h>
+#include <time.h>
+
+// go-sqlite3 does not expose the progress handler, the function
+// is provided by the SQLite amalgamation compiled by go-sqlite3
+typedef struct sqlite3 sqlite3;
+void sqlite3_progress_handler(sqlite3*, int, int(*)(void*), void*);
+
+typedef struct {
+	int period;
+	long long instructions;
+	long long max_instructions;
+	long long deadline;
+	// exceeded is 1 for the instructions budget and 2 for the duration
+	int exceeded;
+} query_budget;
+
+static long long monotonic_ns() {
+	struct timespec ts;
+	clock_gettime(CLOCK_MONOTONIC, &ts);
+	return (long long)ts.tv_sec * 1000000000LL + ts.tv_nsec;
+}
+
+static int budget_progress(void *arg) {
+	query_budget *b = arg;
+	b->instructions += b->period;
+	if (b->max_instructions > 0 && b->instructions > b->max_instructions) {
+		b->exceeded = 1;
+	} else if (b->deadline > 0 && monotonic_ns() > b->deadline) {
+		b->exceeded = 2;
+	}
+	return b->exceeded;
+}
+
+static query_budget* start_budget(void *db, int period, long long max_instructions, long long max_duration) {
+	query_budget *b = calloc(1, sizeof(query_budget));
+	if (b == NULL) {
+		return NULL;
+	}
+	b->period = period;
+	b->max_instructions = max_instructions;
+	if (max_duration > 0) {
+		b->deadline = monotonic_ns() + max_duration;
+	}
+	sqlite3_progress_handler((sqlite3*)db, period, budget_progress, b);
+	return b;
+}
+
+static void stop_budget(void *db, query_budget *b) {
+	sqlite3_progress_handler((sqlite3*)db, 0, NULL, NULL);
+	free(b);
+}
+*/
+import "C"
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// progressPeriod is the number of VM instructions between two checks of the budget,
+// instructions are counted in multiples of it
+const progressPeriod = 1000
+
+type (
+	// QueryBudget limits the resources used by a single query, zero means no limit
+	QueryBudget struct {
+		// Instructions is the number of SQLite VM instructions
+		Instructions int64
+		// Duration is the wall-clock time spent running the query
+		Duration time.Duration
+	}
+
+	// QueryCost accumulates the instructions used by the queries which share a context
+	QueryCost struct {
+		instructions int64
+		volatile     int32
+	}
+
+	budgetKey struct{}
+
+	callerBudget struct {
+		budget QueryBudget
+		cost   *QueryCost
+	}
+
+	// queryMeter enforces the budget of a query through the progress handler of its connection
+	queryMeter struct {
+		db     unsafe.Pointer
+		state  *C.query_budget
+		budget QueryBudget
+		cost   *QueryCost
+		used   int64
+		// exceeded keeps the result after the meter is stopped
+		exceeded C.int
+	}
+)
+
+// WithQueryBudget returns a context which limits the queries that use it,
+// the limits of the cassette still apply when they are lower than b.
+//
+// The returned QueryCost is updated when each query finishes.
+func WithQueryBudget(ctx context.Context, b QueryBudget) (context.Context, *QueryCost) {
+	cost := &QueryCost{}
+	return context.WithValue(ctx, budgetKey{}, callerBudget{budget: b, cost: cost}), cost
+}
+
+// Instructions returns the number of VM instructions used so far
+func (qc *QueryCost) Instructions() int64 {
+	if qc == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&qc.instructions)
+}
+
+// Volatile returns true if any query used a function whose result might change
+// between runs (eg.: random or datetime('now')), so its output should not be cached
+func (qc *QueryCost) Volatile() bool {
+	if qc == nil {
+		return false
+	}
+	return atomic.LoadInt32(&qc.volatile) != 0
+}
+
+func (qc *QueryCost) markVolatile() {
+	if qc != nil {
+		atomic.StoreInt32(&qc.volatile, 1)
+	}
+}
+
+func queryCost(ctx context.Context) *QueryCost {
+	caller, _ := ctx.Value(budgetKey{}).(callerBudget)
+	return caller.cost
+}
+
+// Min returns the lowest limit of each resource, ignoring the ones without a limit
+func (b QueryBudget) Min(other QueryBudget) QueryBudget {
+	if other.Instructions > 0 && (b.Instructions == 0 || other.Instructions < b.Instructions) {
+		b.Instructions = other.Instructions
+	}
+	if other.Duration > 0 && (b.Duration == 0 || other.Duration < b.Duration) {
+		b.Duration = other.Duration
+	}
+	return b
+}
+
+// startMeter installs the progress handler on sc. Queries without a budget run
+// unmetered if the handler cannot be installed, otherwise an error is returned,
+// so a budget is never silently ignored.
+func startMeter(ctx context.Context, sc *sqlite3.SQLiteConn, budget QueryBudget) (*queryMeter, error) {
+	m := &queryMeter{budget: budget}
+	if caller, ok := ctx.Value(budgetKey{}).(callerBudget); ok {
+		m.budget, m.cost = budget.Min(caller.budget), caller.cost
+	}
+	limited := m.budget.Instructions > 0 || m.budget.Duration > 0
+	m.db = sqliteHandle(sc)
+	if m.db == nil {
+		if limited {
+			return nil, errors.New("unable to find the sqlite handle of the connection")
+		}
+		return nil, nil
+	}
+	m.state = C.start_budget(m.db, progressPeriod, C.longlong(m.budget.Instructions), C.longlong(m.budget.Duration))
+	if m.state == nil {
+		if limited {
+			return nil, errors.New("unable to allocate the query budget")
+		}
+		return nil, nil
+	}
+	return m, nil
+}
+
+// sqliteHandle returns the sqlite3 pointer of sc, which is not exported by go-sqlite3
+func sqliteHandle(sc *sqlite3.SQLiteConn) unsafe.Pointer {
+	field := reflect.ValueOf(sc).Elem().FieldByName("db")
+	if !field.IsValid() || field.Kind() != reflect.Ptr {
+		return nil
+	}
+	return unsafe.Pointer(field.Pointer())
+}
+
+// stop removes the progress handler, it must be called before the connection is released
+func (m *queryMeter) stop() {
+	if m == nil || m.state == nil {
+		return
+	}
+	m.used, m.exceeded = int64(m.state.instructions), m.state.exceeded
+	C.stop_budget(m.db, m.state)
+	m.state = nil
+	if m.cost != nil {
+		atomic.AddInt64(&m.cost.instructions, m.used)
+	}
+}
+
+// err returns QueryBudgetExceeded if the query was interrupted by the meter
+func (m *queryMeter) err(query string) error {
+	if m == nil {
+		return nil
+	}
+	exceeded, used := m.exceeded, m.used
+	if m.state != nil {
+		exceeded, used = m.state.exceeded, int64(m.state.instructions)
+	}
+	switch exceeded {
+	case 1:
+		return QueryBudgetExceeded{Query: query, Resource: "instructions", Budget: m.budget, Instructions: used}
+	case 2:
+		return QueryBudgetExceeded{Query: query, Resource: "duration", Budget: m.budget, Instructions: used}
+	}
+	return nil
+}
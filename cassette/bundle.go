@@ -0,0 +1,377 @@
+package cassette
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// BundleExtension is the file extension used by single-file cassettes
+	BundleExtension = ".k7"
+
+	bundleFormat    = "boombox-k7-bundle-v1"
+	bundleIndexFile = "bundle.json"
+	maxBundleIndex  = 1_000_000
+)
+
+type (
+	// BundleFile describes a database stored inside a bundle
+	BundleFile struct {
+		Name   string `json:"name"`
+		Size   int64  `json:"size"`
+		SHA256 string `json:"sha256"`
+	}
+
+	bundleIndex struct {
+		Format   string       `json:"format"`
+		Manifest *Manifest    `json:"manifest,omitempty"`
+		Files    []BundleFile `json:"files"`
+	}
+)
+
+// Pack writes a single-file bundle of the cassette to out.
+//
+// The bundle is a tar archive whose first entry (bundle.json) contains the manifest
+// and the checksum of the databases which follow it. The dataset is
+// only included if the cassette was opened with it.
+func (c *Control) Pack(ctx context.Context, out io.Writer) ([]BundleFile, error) {
+	tmpdir, err := os.MkdirTemp("", "boombox-pack")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create temporary directory to pack cassette, cause %w", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	// vacuum creates a consistent and compact snapshot of the database
+	// which can be copied without worrying about the WAL files
+	type snapshot struct {
+		name string
+		stmt string
+		db   dbtx
+	}
+	snapshots := []snapshot{{"k7.db", `vacuum main into ?`, c.db}}
+	if c.datadb != nil {
+		snapshots = append(snapshots, snapshot{"datak7.db", `vacuum into ?`, c.datadb})
+	}
+	index := bundleIndex{Format: bundleFormat}
+	for _, s := range snapshots {
+		target := filepath.Join(tmpdir, s.name)
+		_, err = s.db.ExecContext(ctx, s.stmt, target)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create snapshot of %v, cause %w", s.name, err)
+		}
+		f, err := checksumFile(s.name, target)
+		if err != nil {
+			return nil, err
+		}
+		index.Files = append(index.Files, f)
+	}
+	manifest, err := c.Manifest(ctx)
+	if err == nil {
+		index.Manifest = &manifest
+	} else if !errors.As(err, &ManifestNotFound{}) {
+		return nil, err
+	}
+
+	tw := tar.NewWriter(out)
+	content, err := json.Marshal(index)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode bundle index, cause %w", err)
+	}
+	now := time.Now().UTC()
+	err = tw.WriteHeader(&tar.Header{Name: bundleIndexFile, Mode: 0644, Size: int64(len(content)), ModTime: now})
+	if err == nil {
+		_, err = tw.Write(content)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to write bundle index, cause %w", err)
+	}
+	for _, f := range index.Files {
+		err = copyToBundle(tw, f, filepath.Join(tmpdir, f.Name), now)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = tw.Close()
+	if err != nil {
+		return nil, fmt.Errorf("unable to finish bundle, cause %w", err)
+	}
+	return index.Files, nil
+}
+
+// Unpack extracts the databases from bundle into the tape directory,
+// the checksum of each database is verified while it is extracted.
+//
+// The databases are extracted into a temporary directory next to tape
+// and only moved into place once all of them were verified, so a failed
+// extraction leaves nothing behind. Unpack refuses to overwrite an existing cassette.
+func Unpack(ctx context.Context, bundle io.Reader, tape string) ([]BundleFile, error) {
+	if _, err := os.Stat(filepath.Join(tape, "k7.db")); err == nil {
+		return nil, fmt.Errorf("unable to unpack bundle, %v already contains a cassette", tape)
+	}
+	parent := filepath.Dir(tape)
+	err := os.MkdirAll(parent, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create directory %v to unpack bundle, cause %w", parent, err)
+	}
+	tmpdir, err := os.MkdirTemp(parent, "."+filepath.Base(tape)+".unpack-")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create temporary directory to unpack bundle, cause %w", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	err = os.Chmod(tmpdir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create temporary directory to unpack bundle, cause %w", err)
+	}
+	files, err := extractBundle(ctx, tar.NewReader(bundle), tmpdir)
+	if err != nil {
+		return nil, err
+	}
+	err = moveUnpacked(tmpdir, tape, files)
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+func extractBundle(ctx context.Context, tr *tar.Reader, dir string) ([]BundleFile, error) {
+	index, _, err := readBundleIndex(tr)
+	if err != nil {
+		return nil, err
+	}
+	pending := map[string]BundleFile{}
+	for _, f := range index.Files {
+		if f.Name != "k7.db" && f.Name != "datak7.db" {
+			return nil, InvalidBundle{Reason: fmt.Sprintf("unexpected file %v", f.Name)}
+		}
+		pending[f.Name] = f
+	}
+	if _, ok := pending["k7.db"]; !ok {
+		return nil, InvalidBundle{Reason: "k7.db is missing"}
+	}
+	for len(pending) > 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil, InvalidBundle{Reason: fmt.Sprintf("%v file(s) listed in %v are missing", len(pending), bundleIndexFile)}
+		} else if err != nil {
+			return nil, fmt.Errorf("unable to read bundle, cause %w", err)
+		}
+		expected, ok := pending[hdr.Name]
+		if !ok {
+			return nil, InvalidBundle{Reason: fmt.Sprintf("unexpected file %v", hdr.Name)}
+		}
+		delete(pending, hdr.Name)
+		err = extractFromBundle(tr, expected, filepath.Join(dir, expected.Name))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return index.Files, nil
+}
+
+// moveUnpacked moves the databases extracted to tmpdir into tape
+func moveUnpacked(tmpdir, tape string, files []BundleFile) error {
+	// rename is atomic, when tape does not exist (or is empty)
+	// the whole cassette appears in a single step
+	renameErr := os.Rename(tmpdir, tape)
+	if renameErr == nil {
+		return nil
+	}
+	if st, err := os.Stat(tape); err != nil || !st.IsDir() {
+		return fmt.Errorf("unable to move unpacked bundle to %v, cause %w", tape, renameErr)
+	}
+	// tape already has other files, so the databases are moved one by one,
+	// k7.db goes last since a directory with k7.db is a complete cassette
+	var moved []string
+	for _, name := range []string{"datak7.db", "k7.db"} {
+		if !hasBundleFile(files, name) {
+			continue
+		}
+		target := filepath.Join(tape, name)
+		var err error
+		if _, statErr := os.Lstat(target); statErr == nil {
+			err = fmt.Errorf("unable to unpack bundle, %v already exists", target)
+		} else if err = os.Rename(filepath.Join(tmpdir, name), target); err != nil {
+			err = fmt.Errorf("unable to move unpacked bundle to %v, cause %w", tape, err)
+		}
+		if err != nil {
+			for _, m := range moved {
+				os.Remove(m)
+			}
+			return err
+		}
+		moved = append(moved, target)
+	}
+	return nil
+}
+
+func hasBundleFile(files []BundleFile, name string) bool {
+	for _, f := range files {
+		if f.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyUnpacked checks if the databases in tape still match the checksums of the bundle
+func verifyUnpacked(tape string, files []BundleFile) error {
+	for _, expected := range files {
+		actual, err := checksumFile(expected.Name, filepath.Join(tape, expected.Name))
+		if err != nil {
+			return err
+		}
+		if actual != expected {
+			return InvalidBundle{Reason: fmt.Sprintf("checksum of %v does not match", expected.Name)}
+		}
+	}
+	return nil
+}
+
+// BundleCacheDir returns the directory where bundles are unpacked by LoadControlCassette,
+// it can be changed with the BOOMBOX_CACHE_DIR environment variable.
+func BundleCacheDir() (string, error) {
+	if dir := os.Getenv("BOOMBOX_CACHE_DIR"); dir != "" {
+		return filepath.Join(dir, "bundles"), nil
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("unable to find cache directory for bundles, cause %w", err)
+	}
+	return filepath.Join(dir, "boombox", "bundles"), nil
+}
+
+// isBundle returns true if tape points to a file instead of a directory
+func isBundle(tape string) bool {
+	st, err := os.Stat(tape)
+	return err == nil && st.Mode().IsRegular()
+}
+
+// openBundle unpacks the bundle into the cache directory and returns the path
+// of the extracted cassette, bundles with the same index share the same directory.
+func openBundle(ctx context.Context, bundle string) (string, error) {
+	f, err := os.Open(bundle)
+	if err != nil {
+		return "", fmt.Errorf("unable to open bundle %v, cause %w", bundle, err)
+	}
+	defer f.Close()
+	index, rawIndex, err := readBundleIndex(tar.NewReader(f))
+	if err != nil {
+		return "", err
+	}
+	cacheDir, err := BundleCacheDir()
+	if err != nil {
+		return "", err
+	}
+	key := sha256.Sum256(rawIndex)
+	target := filepath.Join(cacheDir, hex.EncodeToString(key[:]))
+	if _, err := os.Stat(filepath.Join(target, "k7.db")); err == nil {
+		if verifyUnpacked(target, index.Files) == nil {
+			return target, nil
+		}
+		// the cached copy was changed after it was unpacked, replace it with a fresh one
+		err = os.RemoveAll(target)
+		if err != nil {
+			return "", fmt.Errorf("unable to remove stale cache directory %v, cause %w", target, err)
+		}
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return "", fmt.Errorf("unable to read bundle %v, cause %w", bundle, err)
+	}
+	_, err = Unpack(ctx, f, target)
+	if err != nil {
+		if verifyUnpacked(target, index.Files) == nil {
+			// another process unpacked the same bundle first
+			return target, nil
+		}
+		return "", err
+	}
+	return target, nil
+}
+
+func readBundleIndex(tr *tar.Reader) (bundleIndex, []byte, error) {
+	hdr, err := tr.Next()
+	if err != nil {
+		return bundleIndex{}, nil, InvalidBundle{Reason: fmt.Sprintf("unable to read %v, %v", bundleIndexFile, err)}
+	}
+	if hdr.Name != bundleIndexFile {
+		return bundleIndex{}, nil, InvalidBundle{Reason: fmt.Sprintf("first entry should be %v got %v", bundleIndexFile, hdr.Name)}
+	}
+	if hdr.Size > maxBundleIndex {
+		return bundleIndex{}, nil, InvalidBundle{Reason: fmt.Sprintf("%v is too large", bundleIndexFile)}
+	}
+	content, err := io.ReadAll(tr)
+	if err != nil {
+		return bundleIndex{}, nil, fmt.Errorf("unable to read bundle index, cause %w", err)
+	}
+	var index bundleIndex
+	err = json.Unmarshal(content, &index)
+	if err != nil {
+		return bundleIndex{}, nil, InvalidBundle{Reason: fmt.Sprintf("unable to decode %v, %v", bundleIndexFile, err)}
+	}
+	if index.Format != bundleFormat {
+		return bundleIndex{}, nil, InvalidBundle{Reason: fmt.Sprintf("unsupported format %q", index.Format)}
+	}
+	return index, content, nil
+}
+
+func checksumFile(name string, file string) (BundleFile, error) {
+	fd, err := os.Open(file)
+	if err != nil {
+		return BundleFile{}, fmt.Errorf("unable to open snapshot of %v, cause %w", name, err)
+	}
+	defer fd.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, fd)
+	if err != nil {
+		return BundleFile{}, fmt.Errorf("unable to compute checksum of %v, cause %w", name, err)
+	}
+	return BundleFile{Name: name, Size: size, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+func copyToBundle(tw *tar.Writer, f BundleFile, file string, modTime time.Time) error {
+	fd, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("unable to open snapshot of %v, cause %w", f.Name, err)
+	}
+	defer fd.Close()
+	err = tw.WriteHeader(&tar.Header{Name: f.Name, Mode: 0644, Size: f.Size, ModTime: modTime})
+	if err != nil {
+		return fmt.Errorf("unable to add %v to bundle, cause %w", f.Name, err)
+	}
+	_, err = io.Copy(tw, fd)
+	if err != nil {
+		return fmt.Errorf("unable to add %v to bundle, cause %w", f.Name, err)
+	}
+	return nil
+}
+
+func extractFromBundle(r io.Reader, expected BundleFile, target string) error {
+	fd, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to extract %v, cause %w", expected.Name, err)
+	}
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(fd, h), r)
+	if closeErr := fd.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("unable to extract %v, cause %w", expected.Name, err)
+	}
+	if size != expected.Size || hex.EncodeToString(h.Sum(nil)) != expected.SHA256 {
+		return InvalidBundle{Reason: fmt.Sprintf("checksum of %v does not match", expected.Name)}
+	}
+	return nil
+}
@@ -15,7 +15,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
-	"unicode/utf8"
+	"sync"
 
 	"github.com/cespare/xxhash/v2"
 	_ "github.com/mattn/go-sqlite3"
@@ -36,15 +36,29 @@ type (
 		dataPath    string
 
 		writeable bool
+
+		policyMu sync.Mutex
+		policy   *compiledPolicy
 	}
 
 	Code struct {
 		Methods []string
 		Route   string
 		Code    string
+		// Asset is the path of the codebase asset which contains Code
+		Asset   string
+		Options RouteOptions
 	}
 
 	Row []interface{}
+
+	// dbtx is implemented by both *sql.DB and *sql.Tx, it allows
+	// helper methods to participate in a transaction when one is needed
+	dbtx interface {
+		ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+		QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+		QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	}
 )
 
 var (
@@ -66,18 +80,29 @@ func openCassetteDatabase(ctx context.Context, tape string, dbname string, readw
 	} else {
 		connstr = fmt.Sprintf("file:%v?_writable_schema=false&mode=ro", tape)
 	}
-	conn, err := sql.Open("sqlite3", connstr)
-	if err != nil {
-		return nil, tape, fmt.Errorf("unable to open %v, cause %v", tape, err)
-	}
-	err = conn.PingContext(ctx)
+	conn := sql.OpenDB(&sqliteConnector{dsn: connstr})
+	err := conn.PingContext(ctx)
 	if err != nil {
+		conn.Close()
 		return nil, tape, fmt.Errorf("unable to ping cassette %v, cause %v", tape, err)
 	}
 	return conn, tape, nil
 }
 
+// LoadControlCassette opens the cassette stored at tape, which is either a directory
+// or a single-file bundle (see Pack). Bundles are unpacked to BundleCacheDir
+// and can only be opened in read-only mode.
 func LoadControlCassette(ctx context.Context, tape string, readwrite bool, enableData bool) (*Control, error) {
+	if isBundle(tape) {
+		if readwrite {
+			return nil, fmt.Errorf("unable to open bundle %v for writing, unpack it first, cause %w", tape, ReadonlyCassette{})
+		}
+		unpacked, err := openBundle(ctx, tape)
+		if err != nil {
+			return nil, err
+		}
+		tape = unpacked
+	}
 	conn, controlPath, err := openCassetteDatabase(ctx, tape, "k7.db", readwrite)
 	if err != nil {
 		return nil, err
@@ -85,7 +110,8 @@ func LoadControlCassette(ctx context.Context, tape string, readwrite bool, enabl
 	c := &Control{db: conn, writeable: readwrite, controlPath: controlPath}
 	err = c.init(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("unable to init cassette %v, cause %v", tape, err)
+		c.Close()
+		return nil, fmt.Errorf("unable to init cassette %v, cause %w", tape, err)
 	}
 	if enableData {
 		dataconn, dataPath, err := openCassetteDatabase(ctx, tape, "datak7.db", readwrite)
@@ -98,7 +124,12 @@ func LoadControlCassette(ctx context.Context, tape string, readwrite bool, enabl
 		err = c.initData(ctx)
 		if err != nil {
 			c.Close()
-			return nil, err
+			return nil, fmt.Errorf("unable to init dataset of cassette %v, cause %w", tape, err)
+		}
+		err = c.checkFTS(ctx)
+		if err != nil {
+			c.Close()
+			return nil, fmt.Errorf("unable to load dataset of cassette %v, cause %w", tape, err)
 		}
 	}
 	return c, nil
@@ -108,41 +139,112 @@ func (c *Control) Queryable() bool { return !c.writeable }
 
 func (c *Control) ListRoutes(ctx context.Context) ([]Code, error) {
 	var out []Code
-	rows, err := c.db.QueryContext(ctx, `select r.route, a.content, r.methods
+	rows, err := c.db.QueryContext(ctx, `select r.route, a.path, a.content_hash, r.methods, r.options
 	from routes r
 	inner join codebase c on r.asset_id = c.asset_id
 	inner join assets a on c.asset_id = a.asset_id`)
 	if err != nil {
 		return nil, fmt.Errorf("unable to get routes from cassette, cause %w", err)
 	}
+	var hashes []string
 	for rows.Next() {
 		var c Code
-		var methodStr string
-		err = rows.Scan(&c.Route, &c.Code, &methodStr)
+		var methodStr, contentHash, options string
+		err = rows.Scan(&c.Route, &c.Asset, &contentHash, &methodStr, &options)
 		if err != nil {
+			rows.Close()
 			return nil, fmt.Errorf("unable to get routes from cassette, cause %w", err)
 		}
+		c.Options, err = decodeRouteOptions(options)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("invalid options for route %v, cause %w", c.Route, err)
+		}
 		methodStr = strings.ToUpper(methodStr)
 		c.Methods = strings.Split(methodStr, "|")
 		out = append(out, c)
+		hashes = append(hashes, contentHash)
+	}
+	rows.Close()
+	for i := range out {
+		var code strings.Builder
+		err = c.copyBlob(ctx, c.db, &code, hashes[i])
+		if err != nil {
+			return nil, fmt.Errorf("unable to load code for route %v, cause %w", out[i].Route, err)
+		}
+		out[i].Code = code.String()
 	}
 	return out, nil
 }
 
+// MapRoute configures route to be handled by the given codebase asset,
+// using the default options
 func (c *Control) MapRoute(ctx context.Context, methods []string, route string, asset string) error {
-	// TODO: perform proper method validation here
+	return c.MapRouteWithOptions(ctx, methods, route, asset, RouteOptions{})
+}
+
+// MapRouteWithOptions is like MapRoute but the route is served using opts,
+// mapping an existing route replaces its methods, asset and options.
+//
+// Routes which conflict with other handlers of the cassette (see RouteHandlers)
+// are not saved and RouteConflicts is returned instead.
+func (c *Control) MapRouteWithOptions(ctx context.Context, methods []string, route string, asset string, opts RouteOptions) error {
+	if !c.writeable {
+		return ReadonlyCassette{}
+	}
+	if err := ValidateRoute(methods, route); err != nil {
+		return err
+	}
 	asset, _ = c.normalizeAssetPath(asset)
 	id, _, err := c.lookupCodebase(ctx, asset)
 	if err != nil {
 		return err
 	}
-	_, err = c.db.ExecContext(ctx, `insert into routes (route, methods, asset_id) values (?, ?, ?) on conflict (route) do update set methods = EXCLUDED.methods and asset_id = EXCLUDED.asset_id`, route, strings.ToUpper(strings.Join(methods, "|")), id)
+	encodedOpts, err := opts.encode()
+	if err != nil {
+		return err
+	}
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("unable to configure route %v using asset %v, cause %w", route, asset, err)
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx, `insert into routes (route, methods, asset_id, options) values (?, ?, ?, ?)
+	on conflict (route) do update set methods = EXCLUDED.methods, asset_id = EXCLUDED.asset_id, options = EXCLUDED.options`,
+		route, strings.ToUpper(strings.Join(methods, "|")), id, encodedOpts)
+	if err != nil {
+		return fmt.Errorf("unable to configure route %v using asset %v, cause %w", route, asset, err)
+	}
+	// the route is only saved if it can be served along with the other handlers of the cassette
+	conflicts, err := c.routeConflicts(ctx, tx, route)
+	if err != nil {
+		return err
+	}
+	if len(conflicts) > 0 {
+		return RouteConflicts{Conflicts: conflicts}
+	}
+	err = tx.Commit()
 	if err != nil {
 		return fmt.Errorf("unable to configure route %v using asset %v, cause %w", route, asset, err)
 	}
 	return nil
 }
 
+// UnmapRoute removes the route, the codebase asset which handled it is kept
+func (c *Control) UnmapRoute(ctx context.Context, route string) error {
+	if !c.writeable {
+		return ReadonlyCassette{}
+	}
+	res, err := c.db.ExecContext(ctx, `delete from routes where route = ?`, route)
+	if err != nil {
+		return fmt.Errorf("unable to remove route %v, cause %w", route, err)
+	}
+	if removed, _ := res.RowsAffected(); removed == 0 {
+		return RouteNotFound{Route: route}
+	}
+	return nil
+}
+
 func (c *Control) ListAssets(ctx context.Context) ([]string, error) {
 	var out []string
 	rows, err := c.db.QueryContext(ctx, `select path from assets order by path asc`)
@@ -161,42 +263,112 @@ func (c *Control) ListAssets(ctx context.Context) ([]string, error) {
 	return out, nil
 }
 
+// CopyAsset writes the content of the asset to out, content is streamed
+// in chunks directly from the cassette, so large assets are never
+// fully loaded into memory
 func (c *Control) CopyAsset(ctx context.Context, out io.Writer, assetPath string) (int64, string, error) {
-	assetPath, pathHash := c.normalizeAssetPath(assetPath)
-	var content string
-	var aid int64
-	var mt string
-	err := c.db.QueryRowContext(ctx, `select asset_id, mime_type, content from assets where path_hash64 = ? and path = ?`, pathHash, assetPath).Scan(&aid, &mt, &content)
-	if errors.Is(err, sql.ErrNoRows) {
-		return 0, "", AssetNotFound{Path: assetPath}
-	} else if err != nil {
-		return 0, "", fmt.Errorf("unable to load %v from cassete, cause %w", assetPath, err)
+	asset, err := c.StatAsset(ctx, assetPath)
+	if err != nil {
+		return 0, "", err
 	}
-	_, err = io.WriteString(out, content)
+	err = c.copyBlob(ctx, c.db, out, asset.ContentHash)
 	if err != nil {
-		return 0, "", fmt.Errorf("unable to copy %v from cassete to destination, cause %w", assetPath, err)
+		return 0, "", fmt.Errorf("unable to copy %v from cassete to destination, cause %w", asset.Path, err)
 	}
-	return aid, mt, nil
+	return asset.ID, asset.MimeType, nil
 }
 
 func (c *Control) StoreAsset(ctx context.Context, assetPath string, mimetype string, content string) (int64, error) {
+	return c.StoreAssetFrom(ctx, assetPath, mimetype, strings.NewReader(content))
+}
+
+// StoreAssetFrom reads content until EOF and stores it under the given path,
+// content is processed in chunks, which allows large binary assets to be
+// imported without loading them entirely into memory.
+func (c *Control) StoreAssetFrom(ctx context.Context, assetPath string, mimetype string, content io.Reader) (int64, error) {
 	assetPath, pathHash := c.normalizeAssetPath(assetPath)
-	seq, err := c.nextSeq(ctx, "raw_assets")
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("unable to start transaction to store asset, cause %w", err)
+	}
+	defer tx.Rollback()
+	seq, err := c.nextSeq(ctx, tx, "raw_assets")
 	if err != nil {
 		return 0, err
 	}
-	switch mimetype {
-	case "text/html", "text/json", "application/json", "application/x-lua", "text/x-lua":
-		if !utf8.ValidString(content) {
-			return 0, InvalidTextContent{Path: assetPath, MimeType: mimetype}
-		}
+	blob, err := storeBlob(ctx, tx, content)
+	if err != nil {
+		return 0, err
+	}
+	if IsTextMimeType(mimetype) && !blob.utf8 {
+		return 0, InvalidTextContent{Path: assetPath, MimeType: mimetype}
+	}
+	var id int64
+	err = tx.QueryRowContext(ctx, `insert into assets(asset_id, path, path_hash64, mime_type, content_hash) values (?, ?, ?, ?, ?) on conflict (path) do update set mime_type = EXCLUDED.mime_type, content_hash = EXCLUDED.content_hash returning asset_id`,
+		seq, assetPath, pathHash, mimetype, blob.hash).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("unable to store asset to cassette, cause %w", err)
+	}
+	err = c.dropVariants(ctx, tx, id)
+	if err != nil {
+		return 0, err
+	}
+	_, err = recordRevision(ctx, tx, id, mimetype, blob.hash)
+	if err != nil {
+		return 0, err
 	}
-	_, err = c.db.ExecContext(ctx, `insert into assets(asset_id, path, path_hash64, mime_type, content) values (?, ?, ?, ?, ?) on conflict (path) do update set mime_type = EXCLUDED.mime_type, content = EXCLUDED.content`,
-		seq, assetPath, pathHash, mimetype, content)
+	err = tx.Commit()
 	if err != nil {
 		return 0, fmt.Errorf("unable to store asset to cassette, cause %w", err)
 	}
-	return seq, nil
+	return id, nil
+}
+
+// DeleteAsset removes the asset with all its revisions and variants,
+// if the asset is part of the codebase, it is removed from the codebase
+// and all routes handled by it are removed as well.
+func (c *Control) DeleteAsset(ctx context.Context, assetPath string) error {
+	if !c.writeable {
+		return ReadonlyCassette{}
+	}
+	assetPath, pathHash := c.normalizeAssetPath(assetPath)
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("unable to start transaction to remove %v, cause %w", assetPath, err)
+	}
+	defer tx.Rollback()
+	id, err := c.lookupAssetID(ctx, tx, assetPath, pathHash)
+	if err != nil {
+		return err
+	}
+	err = c.removeAsset(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("unable to remove %v, cause %w", assetPath, err)
+	}
+	return nil
+}
+
+// ListCodebase returns the path of all assets enabled as codebase, ordered by path
+func (c *Control) ListCodebase(ctx context.Context) ([]string, error) {
+	rows, err := c.db.QueryContext(ctx, `select a.path from codebase c inner join assets a on c.asset_id = a.asset_id order by a.path asc`)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list codebase, cause %w", err)
+	}
+	defer rows.Close()
+	var out []string
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return nil, fmt.Errorf("unable to scan codebase asset, cause %w", err)
+		}
+		out = append(out, name)
+	}
+	return out, rows.Err()
 }
 
 func (c *Control) ToggleCodebase(ctx context.Context, assetPath string, enable bool) error {
@@ -326,6 +498,11 @@ func (c *Control) ImportCSVDataset(ctx context.Context, table string, csvStream
 	for {
 		row, err := reader.Read()
 		if errors.Is(err, io.EOF) {
+			// fts indexes read their content from the table, so they must be rebuilt
+			err = c.rebuildFTS(ctx, table)
+			if err != nil {
+				return "", 0, err
+			}
 			return string(createTable.Bytes()), totalRows, nil
 		}
 		err = insertRow(row)
@@ -336,26 +513,31 @@ func (c *Control) ImportCSVDataset(ctx context.Context, table string, csvStream
 }
 
 func (c *Control) Query(ctx context.Context, out io.Writer, maxSize int, query string, args ...interface{}) error {
-	const OneMegabyte = 1_000_000
-	if c.writeable {
-		// TODO: querying a writable cassette is SOOOO wrong that I am considering a panic instead!
-		// afterall, a Queryable Cassette should run alone on its own process...
-		return CannotQuery{}
-	}
-	if maxSize > OneMegabyte || maxSize < 0 {
-		maxSize = OneMegabyte
-	}
-	out = &limitedWriter{dest: out, maxBytes: maxSize}
+	return c.queryJSON(ctx, out, maxSize, false, query, args)
+}
 
-	rows, err := c.db.QueryContext(ctx, query, args...)
-	if err != nil {
-		return QueryError{Query: query, cause: err, Params: args}
+// QueryWithMetadata works like Query but also includes the metadata of each column,
+// in the same order as the columns field.
+func (c *Control) QueryWithMetadata(ctx context.Context, out io.Writer, maxSize int, query string, args ...interface{}) error {
+	return c.queryJSON(ctx, out, maxSize, true, query, args)
+}
+
+func (c *Control) queryJSON(ctx context.Context, out io.Writer, maxSize int, withMetadata bool, query string, args []interface{}) error {
+	var metadata []ColumnMetadata
+	if withMetadata && !c.writeable {
+		// metadata is computed before the query starts, so the
+		// connection with the attached dataset is free to inspect its tables
+		var err error
+		metadata, err = c.columnMetadata(ctx, query, args)
+		if err != nil {
+			return err
+		}
 	}
-	defer rows.Close()
-	columns, err := rows.Columns()
+	out, rows, columns, err := c.startQuery(ctx, out, maxSize, query, args)
 	if err != nil {
-		return QueryError{Query: query, cause: err, Params: args}
+		return err
 	}
+	defer rows.Close()
 	_, err = io.WriteString(out, `{"columns":`)
 	if err != nil {
 		return err
@@ -366,6 +548,16 @@ func (c *Control) Query(ctx context.Context, out io.Writer, maxSize int, query s
 	if err != nil {
 		return err
 	}
+	if withMetadata {
+		_, err = io.WriteString(out, `,"metadata":`)
+		if err != nil {
+			return err
+		}
+		err = enc.Encode(metadata)
+		if err != nil {
+			return err
+		}
+	}
 	_, err = io.WriteString(out, `,"rows": [`)
 	if err != nil {
 		return err
@@ -394,13 +586,82 @@ func (c *Control) Query(ctx context.Context, out io.Writer, maxSize int, query s
 			return err
 		}
 	}
+	if err = rows.Err(); err != nil {
+		return QueryError{Query: query, cause: err, Params: args}
+	}
 	_, err = io.WriteString(out, "]}")
 	return err
 }
 
-func (c *Control) nextSeq(ctx context.Context, seq string) (int64, error) {
+// QueryCSV works like Query but writes the result as CSV, starting with a header row.
+// NULL values are written as empty fields, comma is the field separator
+// (use '\t' for TSV output).
+func (c *Control) QueryCSV(ctx context.Context, out io.Writer, maxSize int, comma rune, query string, args ...interface{}) error {
+	out, rows, columns, err := c.startQuery(ctx, out, maxSize, query, args)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	w := csv.NewWriter(out)
+	w.Comma = comma
+	err = w.Write(columns)
+	if err != nil {
+		return err
+	}
+	r := make(Row, len(columns))
+	scanTarget := make([]interface{}, len(r))
+	for i := range scanTarget {
+		scanTarget[i] = &r[i]
+	}
+	record := make([]string, len(columns))
+	for rows.Next() {
+		err = rows.Scan(scanTarget...)
+		if err != nil {
+			return QueryError{Query: query, cause: err, Params: args}
+		}
+		for i, v := range r {
+			record[i] = csvField(v)
+		}
+		err = w.Write(record)
+		if err != nil {
+			return err
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return QueryError{Query: query, cause: err, Params: args}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// startQuery runs query and returns out wrapped by a limitedWriter of maxSize bytes
+func (c *Control) startQuery(ctx context.Context, out io.Writer, maxSize int, query string, args []interface{}) (io.Writer, *queryRows, []string, error) {
+	const OneMegabyte = 1_000_000
+	if c.writeable {
+		// TODO: querying a writable cassette is SOOOO wrong that I am considering a panic instead!
+		// afterall, a Queryable Cassette should run alone on its own process...
+		return nil, nil, nil, CannotQuery{}
+	}
+	if maxSize > OneMegabyte || maxSize < 0 {
+		maxSize = OneMegabyte
+	}
+	out = &limitedWriter{dest: out, maxBytes: maxSize}
+
+	rows, err := c.queryRows(ctx, query, args)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	columns, err := rows.Columns()
+	if err != nil {
+		rows.Close()
+		return nil, nil, nil, QueryError{Query: query, cause: err, Params: args}
+	}
+	return out, rows, columns, nil
+}
+
+func (c *Control) nextSeq(ctx context.Context, tx dbtx, seq string) (int64, error) {
 	var val int64
-	err := c.db.QueryRowContext(ctx, `insert into counters (name, val) values (?, 1) on conflict do update set val = val + 1 returning val`, seq).Scan(&val)
+	err := tx.QueryRowContext(ctx, `insert into counters (name, val) values (?, 1) on conflict do update set val = val + 1 returning val`, seq).Scan(&val)
 	if err != nil {
 		return 0, fmt.Errorf("unable to increment sequence %v, cause %w", seq, err)
 	}
@@ -441,42 +702,15 @@ func (c *Control) normalizeAssetPath(assetPath string) (string, int64) {
 }
 
 func (c *Control) init(ctx context.Context) error {
-	for _, cmd := range []string{
-		`create table if not exists counters(
-			name text not null primary key,
-			val integer not null
-		)`,
-		`create table if not exists assets(
-			asset_id integer not null primary key,
-			path text not null unique,
-			path_hash64 integer not null,
-			mime_type string not null,
-			content blob not null
-		)`,
-		`create index if not exists idx_assets_path_hash64
-			on assets(path_hash64)
-		`,
-		`create table if not exists codebase(
-			asset_id integer not null primary key,
-			foreign key (asset_id) references assets(asset_id)
-		)`,
-		`create table if not exists routes(
-			route text not null primary key,
-			methods text not null,
-			asset_id integer,
-			foreign key(asset_id) references codebase(asset_id)
-		)`,
-	} {
-		_, err := c.db.ExecContext(ctx, cmd)
-		if err != nil {
-			return err
-		}
-	}
-	return nil
+	return prepareSchema(ctx, c.db, "k7.db", controlMigrations, c.writeable)
 }
 
 func (c *Control) initData(ctx context.Context) error {
-	_, err := c.db.ExecContext(ctx, `attach database ? as 'dataset'`, c.dataPath)
+	err := prepareSchema(ctx, c.datadb, "datak7.db", dataMigrations, c.writeable)
+	if err != nil {
+		return err
+	}
+	_, err = c.db.ExecContext(ctx, `attach database ? as 'dataset'`, c.dataPath)
 	return err
 }
 
@@ -498,7 +732,7 @@ func (lw *limitedWriter) Write(buf []byte) (int, error) {
 	}
 	n, err := lw.dest.Write(buf)
 	lw.totalBytes += n
-	return 0, err
+	return n, err
 }
 
 func (lw limitedWriter) overshoot(n int) int {
@@ -2,15 +2,25 @@ package cassette
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"reflect"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/apache/arrow/go/v7/arrow/array"
+	"github.com/apache/arrow/go/v7/arrow/ipc"
 	"github.com/stretchr/testify/require"
 )
 
@@ -118,6 +128,58 @@ func TestQueryCassette(t *testing.T) {
 	if !errors.Is(err, WriteOverflow{Total: 11, Max: 11, Next: 21}) {
 		t.Fatalf("Error should be WriteOverflow, got: %#v", err)
 	}
+
+	buf.Reset()
+	err = c.QueryCSV(ctx, &buf, -1, ',', `select path, null as missing, 'say "hi", bob' as quoted, 1.5 as num from assets order by path`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedCSV := "path,missing,quoted,num\nindex.html,,\"say \"\"hi\"\", bob\",1.5\ninfo.html,,\"say \"\"hi\"\", bob\",1.5\n"
+	if buf.String() != expectedCSV {
+		t.Fatalf("Expecting CSV %q got %q", expectedCSV, buf.String())
+	}
+	buf.Reset()
+	err = c.QueryCSV(ctx, &buf, -1, '\t', `select path, 'a'||char(9)||'b' as tabbed from assets order by path limit 1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expectedTSV := "path\ttabbed\nindex.html\t\"a\tb\"\n"; buf.String() != expectedTSV {
+		t.Fatalf("Expecting TSV %q got %q", expectedTSV, buf.String())
+	}
+	err = c.QueryCSV(ctx, io.Discard, 11, ',', "select path, mime_type from assets")
+	if !errors.As(err, &WriteOverflow{}) {
+		t.Fatalf("Error should be WriteOverflow, got: %#v", err)
+	}
+
+	buf.Reset()
+	status, err := c.QueryNDJSON(ctx, &buf, 0, "select path, null as missing from assets order by path")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedNDJSON := `{"path":"index.html","missing":null}
+{"path":"info.html","missing":null}
+{"$status":"completed","rows":2}
+`
+	if buf.String() != expectedNDJSON {
+		t.Fatalf("Expecting NDJSON %q got %q", expectedNDJSON, buf.String())
+	}
+	buf.Reset()
+	status, err = c.QueryNDJSON(ctx, &buf, 1, "select path from assets order by path")
+	if err != nil {
+		t.Fatal(err)
+	} else if expected := (QueryStatus{Status: QueryTruncated, Rows: 1, Reason: "row limit reached"}); status != expected {
+		t.Fatalf("Expecting status %#v got %#v", expected, status)
+	} else if !strings.HasSuffix(buf.String(), `{"$status":"truncated","rows":1,"reason":"row limit reached"}`+"\n") {
+		t.Fatalf("Stream should end with the status line, got %q", buf.String())
+	}
+	shortCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	status, err = c.QueryNDJSON(shortCtx, io.Discard, 0, "with recursive n(x) as (select 1 union all select x + 1 from n) select x from n")
+	if err != nil {
+		t.Fatal(err)
+	} else if status.Status != QueryTruncated || status.Reason != "time limit reached" || status.Rows == 0 {
+		t.Fatalf("Query should be truncated by the time limit, got %#v", status)
+	}
 	c.Close()
 }
 
@@ -147,7 +209,7 @@ func TestCodebaseCassette(t *testing.T) {
 	routes, err := c.ListRoutes(ctx)
 	if err != nil {
 		t.Fatal(err)
-	} else if !reflect.DeepEqual(routes, []Code{{Route: "/index", Code: indexLuaCode, Methods: []string{"GET", "POST"}}}) {
+	} else if !reflect.DeepEqual(routes, []Code{{Route: "/index", Code: indexLuaCode, Methods: []string{"GET", "POST"}, Asset: "codebase/index.lua"}}) {
 		t.Fatalf("Unexpected routes found: %#v", routes)
 	}
 	err = c.ToggleCodebase(ctx, "codebase/index.lua", false)
@@ -216,18 +278,1602 @@ func TestControlCassette(t *testing.T) {
 	}
 }
 
-func tempTape(t interface {
-	Fatal(...interface{})
-	Log(...interface{})
-}, name string) (abspath string, cleanup func()) {
-	dir, err := ioutil.TempDir("", "boombox-tests")
+func TestAssetRevisions(t *testing.T) {
+	tape, cleanup := tempTape(t, "test")
+	defer cleanup()
+
+	ctx := context.Background()
+	c, err := LoadControlCassette(ctx, tape, true, true)
 	if err != nil {
 		t.Fatal(err)
 	}
-	return filepath.Join(dir, name), func() {
-		err := os.RemoveAll(dir)
+	defer c.Close()
+	firstID, err := c.StoreAsset(ctx, "index.html", "text/html", `<h1>first</h1>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondID, err := c.StoreAsset(ctx, "index.html", "text/html", `<h1>broken</h1>`)
+	if err != nil {
+		t.Fatal(err)
+	} else if firstID != secondID {
+		t.Fatalf("Storing a new revision should keep the asset id %v, got %v", firstID, secondID)
+	}
+	revisions, err := c.ListRevisions(ctx, "index.html")
+	if err != nil {
+		t.Fatal(err)
+	} else if len(revisions) != 2 {
+		t.Fatalf("Should have 2 revisions got %#v", revisions)
+	} else if revisions[0].Revision != 1 || revisions[1].Revision != 2 {
+		t.Fatalf("Unexpected revision numbers: %#v", revisions)
+	}
+
+	newRevision, err := c.RollbackAsset(ctx, "index.html", 1)
+	if err != nil {
+		t.Fatal(err)
+	} else if newRevision != 3 {
+		t.Fatalf("Rollback should record revision %v got %v", 3, newRevision)
+	}
+	var out bytes.Buffer
+	_, _, err = c.CopyAsset(ctx, &out, "index.html")
+	if err != nil {
+		t.Fatal(err)
+	} else if out.String() != "<h1>first</h1>" {
+		t.Fatalf("Rollback should restore the first revision, got %v", out.String())
+	}
+
+	_, err = c.RollbackAsset(ctx, "index.html", 10)
+	if !errors.Is(err, RevisionNotFound{Path: "index.html", Revision: 10}) {
+		t.Fatalf("Rollback to a missing revision should fail with RevisionNotFound, got %#v", err)
+	}
+}
+
+func TestContentAddressedAssets(t *testing.T) {
+	tape, cleanup := tempTape(t, "test")
+	defer cleanup()
+
+	ctx := context.Background()
+	c, err := LoadControlCassette(ctx, tape, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for _, p := range []string{"vendor/lib.js", "other/vendor/lib.js"} {
+		_, err = c.StoreAsset(ctx, p, "application/javascript", `console.log("shared")`)
 		if err != nil {
-			t.Log("unable to cleanup temp dir", dir)
+			t.Fatal(err)
+		}
+	}
+	first, err := c.StatAsset(ctx, "vendor/lib.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := c.StatAsset(ctx, "other/vendor/lib.js")
+	if err != nil {
+		t.Fatal(err)
+	} else if first.ContentHash != second.ContentHash {
+		t.Fatalf("Identical content should have the same hash, got %v and %v", first.ContentHash, second.ContentHash)
+	} else if first.Size != int64(len(`console.log("shared")`)) {
+		t.Fatalf("Unexpected size %v", first.Size)
+	}
+	var blobs int
+	err = c.db.QueryRowContext(ctx, `select count(*) from blobs`).Scan(&blobs)
+	if err != nil {
+		t.Fatal(err)
+	} else if blobs != 1 {
+		t.Fatalf("Identical content should be stored once, got %v blobs", blobs)
+	}
+	var out bytes.Buffer
+	_, _, err = c.CopyAsset(ctx, &out, "other/vendor/lib.js")
+	if err != nil {
+		t.Fatal(err)
+	} else if out.String() != `console.log("shared")` {
+		t.Fatalf("Unexpected content: %v", out.String())
+	}
+}
+
+func TestBinaryAssets(t *testing.T) {
+	tape, cleanup := tempTape(t, "test")
+	defer cleanup()
+
+	ctx := context.Background()
+	c, err := LoadControlCassette(ctx, tape, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	binary := make([]byte, blobChunkSize*3+10)
+	for i := range binary {
+		binary[i] = byte(i % 251)
+	}
+	_, err = c.StoreAssetFrom(ctx, "image.png", "image/png", bytes.NewBuffer(binary))
+	if err != nil {
+		t.Fatal(err)
+	}
+	asset, err := c.StatAsset(ctx, "image.png")
+	if err != nil {
+		t.Fatal(err)
+	} else if asset.UTF8 {
+		t.Fatal("Binary content should not be flagged as utf-8")
+	} else if asset.Size != int64(len(binary)) {
+		t.Fatalf("Asset size should be %v got %v", len(binary), asset.Size)
+	}
+	var out bytes.Buffer
+	_, _, err = c.CopyAsset(ctx, &out, "image.png")
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(out.Bytes(), binary) {
+		t.Fatal("Binary content was corrupted")
+	}
+
+	// put a multi-byte rune right on the boundary of two chunks
+	text := bytes.Repeat([]byte("a"), blobChunkSize-1)
+	text = append(text, []byte("ção")...)
+	_, err = c.StoreAssetFrom(ctx, "index.html", "text/html", bytes.NewBuffer(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.StoreAssetFrom(ctx, "broken.html", "text/html", bytes.NewBuffer(binary))
+	if !errors.Is(err, InvalidTextContent{Path: "broken.html", MimeType: "text/html"}) {
+		t.Fatalf("Storing invalid utf-8 as text should fail, got %#v", err)
+	}
+}
+
+func TestCompressedVariants(t *testing.T) {
+	tape, cleanup := tempTape(t, "test")
+	defer cleanup()
+
+	ctx := context.Background()
+	c, err := LoadControlCassette(ctx, tape, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	content := strings.Repeat("<p>boombox</p>", 1000)
+	_, err = c.StoreAsset(ctx, "index.html", "text/html", content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.StoreAsset(ctx, "tiny.html", "text/html", "<p></p>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	variants, err := c.CompressAsset(ctx, "index.html", EncodingGzip, EncodingBrotli)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(variants) != 2 {
+		t.Fatalf("Should have stored 2 variants, got %#v", variants)
+	}
+	var out bytes.Buffer
+	err = c.CopyAssetVariant(ctx, &out, "index.html", EncodingGzip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz, err := gzip.NewReader(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	} else if string(decoded) != content {
+		t.Fatal("Decompressed variant does not match the original content")
+	}
+
+	variants, err = c.CompressAsset(ctx, "tiny.html", EncodingGzip)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(variants) != 0 {
+		t.Fatalf("Variants larger than the original content should be discarded, got %#v", variants)
+	}
+
+	_, err = c.CompressAsset(ctx, "index.html", "zip")
+	if !errors.Is(err, UnsupportedEncoding{Encoding: "zip"}) {
+		t.Fatalf("Unknown encodings should be rejected, got %#v", err)
+	}
+
+	_, err = c.StoreAsset(ctx, "index.html", "text/html", "<p>changed</p>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	variants, err = c.ListVariants(ctx, "index.html")
+	if err != nil {
+		t.Fatal(err)
+	} else if len(variants) != 0 {
+		t.Fatalf("Changing the content should drop stale variants, got %#v", variants)
+	}
+}
+
+func TestSchemaMigrations(t *testing.T) {
+	tape, cleanup := tempTape(t, "test")
+	defer cleanup()
+
+	ctx := context.Background()
+	c, err := LoadControlCassette(ctx, tape, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	initial := controlMigrations
+	defer func() { controlMigrations = initial }()
+	nextVersion := initial[len(initial)-1].version + 1
+	controlMigrations = append(append([]migration(nil), initial...), migration{
+		version: nextVersion,
+		name:    "test migration",
+		stmts:   []string{`create table test_migration(id integer not null primary key)`},
+	})
+
+	var mismatch SchemaVersionMismatch
+	_, err = LoadControlCassette(ctx, tape, false, true)
+	if !errors.As(err, &mismatch) || !mismatch.TooOld() {
+		t.Fatalf("Loading an outdated cassette should fail with SchemaVersionMismatch, got %#v", err)
+	}
+	applied, err := Migrate(ctx, tape)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(applied, []AppliedMigration{{Database: "k7.db", Version: nextVersion, Name: "test migration"}}) {
+		t.Fatalf("Unexpected migrations applied: %#v", applied)
+	}
+	c, err = LoadControlCassette(ctx, tape, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	controlMigrations = initial
+	_, err = LoadControlCassette(ctx, tape, false, true)
+	if !errors.As(err, &mismatch) || !mismatch.TooNew() {
+		t.Fatalf("Loading a cassette from the future should fail with SchemaVersionMismatch, got %#v", err)
+	}
+}
+
+func TestMigrateBaselineCassette(t *testing.T) {
+	tape, cleanup := tempTape(t, "test")
+	defer cleanup()
+
+	ctx := context.Background()
+	_, err := Migrate(ctx, filepath.Join(tape, "missing"))
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Migrating a missing cassette should fail with os.ErrNotExist, got %#v", err)
+	}
+
+	// cassettes created before schema versioning kept the content inline
+	db, _, err := openCassetteDatabase(ctx, tape, "k7.db", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var c Control
+	for _, stmt := range []string{
+		`create table counters(name text not null primary key, val integer not null)`,
+		`create table assets(
+			asset_id integer not null primary key,
+			path text not null unique,
+			path_hash64 integer not null,
+			mime_type string not null,
+			content blob not null
+		)`,
+		`create index idx_assets_path_hash64 on assets(path_hash64)`,
+		`create table codebase(asset_id integer not null primary key, foreign key (asset_id) references assets(asset_id))`,
+		`create table routes(route text not null primary key, methods text not null, asset_id integer, foreign key(asset_id) references codebase(asset_id))`,
+		`insert into codebase(asset_id) values (2)`,
+		`insert into routes(route, methods, asset_id) values ('/', 'GET', 2)`,
+	} {
+		if _, err = db.ExecContext(ctx, stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, a := range [][3]string{
+		{"index.html", "text/html", "<h1>it works</h1>"},
+		{"codebase/index.lua", "application/x-lua", "print('hello')"},
+	} {
+		p, hash := c.normalizeAssetPath(a[0])
+		_, err = db.ExecContext(ctx, `insert into assets(asset_id, path, path_hash64, mime_type, content) values (?, ?, ?, ?, ?)`, i+1, p, hash, a[1], []byte(a[2]))
+		if err != nil {
+			t.Fatal(err)
 		}
 	}
+	db.Close()
+
+	_, err = LoadControlCassette(ctx, tape, false, false)
+	var mismatch SchemaVersionMismatch
+	if !errors.As(err, &mismatch) || !mismatch.TooOld() {
+		t.Fatalf("Loading a baseline cassette should fail with SchemaVersionMismatch, got %#v", err)
+	}
+	applied, err := Migrate(ctx, tape)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(applied) == 0 || applied[0].Version != 1 {
+		t.Fatalf("Unexpected migrations applied: %#v", applied)
+	}
+
+	ctl, err := LoadControlCassette(ctx, tape, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctl.Close()
+	var buf bytes.Buffer
+	_, mt, err := ctl.CopyAsset(ctx, &buf, "index.html")
+	require.NoError(t, err)
+	require.Equal(t, "text/html", mt)
+	require.Equal(t, "<h1>it works</h1>", buf.String())
+	routes, err := ctl.ListRoutes(ctx)
+	require.NoError(t, err)
+	require.Len(t, routes, 1)
+	require.Equal(t, "print('hello')", routes[0].Code)
+	for _, asset := range []string{"index.html", "codebase/index.lua"} {
+		revisions, err := ctl.ListRevisions(ctx, asset)
+		require.NoError(t, err)
+		require.Len(t, revisions, 1, "migrated assets should have their first revision")
+		require.Equal(t, int64(1), revisions[0].Revision)
+	}
+	problems, err := ctl.Fsck(ctx, false)
+	require.NoError(t, err)
+	require.Empty(t, problems)
+}
+
+func TestSignCassette(t *testing.T) {
+	tape, cleanup := tempTape(t, "test")
+	defer cleanup()
+
+	ctx := context.Background()
+	c, err := LoadControlCassette(ctx, tape, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { c.Close() }()
+	_, err = c.StoreAsset(ctx, "index.html", "text/html", `<h1>it works</h1>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = c.ImportCSVDataset(ctx, "people", bytes.NewBufferString(`"name","age"
+"bob",30`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Verify(ctx)
+	if !errors.Is(err, UnsignedCassette{}) {
+		t.Fatalf("Verifying an unsigned cassette should fail with UnsignedCassette, got %#v", err)
+	}
+
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Sign(ctx, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	c, err = LoadControlCassette(ctx, tape, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := c.Verify(ctx, pub)
+	if err != nil {
+		t.Fatal(err)
+	} else if !sig.PublicKey.Equal(pub) {
+		t.Fatalf("Signature should come from %x got %x", pub, sig.PublicKey)
+	}
+	_, err = c.Verify(ctx, otherPub)
+	if !errors.Is(err, UntrustedSignature{}) {
+		t.Fatalf("Verifying with another key should fail with UntrustedSignature, got %#v", err)
+	}
+	c.Close()
+
+	c, err = LoadControlCassette(ctx, tape, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = c.ImportCSVDataset(ctx, "people", bytes.NewBufferString(`"name","age"
+"mallory",31`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Verify(ctx, pub)
+	if !errors.Is(err, InvalidSignature{}) {
+		t.Fatalf("Changing the dataset should invalidate the signature, got %#v", err)
+	}
+
+	_, err = c.StoreAsset(ctx, "app.js", "text/javascript", strings.Repeat("console.log('it works');\n", 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if variants, err := c.CompressAsset(ctx, "app.js", "gzip"); err != nil || len(variants) != 1 {
+		t.Fatalf("Expecting a gzip variant got %v (%v)", variants, err)
+	}
+	_, err = c.Sign(ctx, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	evil, err := storeBlob(ctx, c.db, strings.NewReader("<script>evil()</script>"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.db.ExecContext(ctx, `update asset_variants set content_hash = ?`, evil.hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Verify(ctx, pub)
+	if !errors.Is(err, InvalidSignature{}) {
+		t.Fatalf("Changing a variant should invalidate the signature, got %#v", err)
+	}
+
+	_, err = c.Sign(ctx, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.db.ExecContext(ctx, `update blob_chunks set data = cast(replace(cast(data as text), 'works', 'wOrks') as blob)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Verify(ctx, pub)
+	if !errors.As(err, &CorruptBlob{}) {
+		t.Fatalf("Changing the content of a blob should fail with CorruptBlob, got %#v", err)
+	}
+}
+
+func TestKeyEncoding(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privPEM, pubPEM, err := EncodeKeyPair(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decodedPriv, err := ParsePrivateKey(privPEM)
+	if err != nil {
+		t.Fatal(err)
+	} else if !decodedPriv.Equal(priv) {
+		t.Fatal("Private key changed after encoding")
+	}
+	decodedPub, err := ParsePublicKey(pubPEM)
+	if err != nil {
+		t.Fatal(err)
+	} else if !decodedPub.Equal(priv.Public()) {
+		t.Fatal("Public key changed after encoding")
+	}
+}
+
+func tempTape(t interface {
+	Fatal(...interface{})
+	Log(...interface{})
+}, name string) (abspath string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "boombox-tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, name), func() {
+		err := os.RemoveAll(dir)
+		if err != nil {
+			t.Log("unable to cleanup temp dir", dir)
+		}
+	}
+}
+
+func TestBundle(t *testing.T) {
+	tape, cleanup := tempTape(t, "test")
+	defer cleanup()
+	t.Setenv("BOOMBOX_CACHE_DIR", filepath.Join(filepath.Dir(tape), "cache"))
+
+	ctx := context.Background()
+	c, err := LoadControlCassette(ctx, tape, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.StoreAsset(ctx, "index.html", "text/html", "<h1>it works</h1>"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.StoreManifest(ctx, Manifest{Name: "bundled"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = c.ImportCSVDataset(ctx, "people", strings.NewReader("name,age\nbob,22\n")); err != nil {
+		t.Fatal(err)
+	}
+	var bundle bytes.Buffer
+	files, err := c.Pack(ctx, &bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if len(files) != 2 || files[0].Name != "k7.db" || files[1].Name != "datak7.db" {
+		t.Fatalf("Bundle should contain both databases, got %v", files)
+	}
+	bundleFile := tape + BundleExtension
+	if err = ioutil.WriteFile(bundleFile, bundle.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = LoadControlCassette(ctx, bundleFile, true, true); !errors.Is(err, ReadonlyCassette{}) {
+		t.Fatalf("Bundles should not be writable, got %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		// the second load uses the cached copy
+		bundled, err := LoadControlCassette(ctx, bundleFile, false, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if _, _, err = bundled.CopyAsset(ctx, &buf, "index.html"); err != nil {
+			t.Fatal(err)
+		} else if buf.String() != "<h1>it works</h1>" {
+			t.Fatalf("Unexpected content %q", buf.String())
+		}
+		buf.Reset()
+		if err = bundled.Query(ctx, &buf, -1, "select name, age from dataset.people"); err != nil {
+			t.Fatal(err)
+		}
+		require.JSONEq(t, `{"columns":["name","age"],"rows":[["bob",22]]}`, buf.String())
+		if m, err := bundled.Manifest(ctx); err != nil || m.Name != "bundled" {
+			t.Fatalf("Unexpected manifest %v / %v", m, err)
+		}
+		bundled.Close()
+	}
+
+	cacheDir, err := BundleCacheDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cached, err := filepath.Glob(filepath.Join(cacheDir, "*", "datak7.db"))
+	if err != nil || len(cached) != 1 {
+		t.Fatalf("Bundle should be unpacked once in the cache, got %v / %v", cached, err)
+	}
+	if err = ioutil.WriteFile(cached[0], []byte("tampered"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	bundled, err := LoadControlCassette(ctx, bundleFile, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err = bundled.Query(ctx, &buf, -1, "select name, age from dataset.people"); err != nil {
+		t.Fatal(err)
+	}
+	require.JSONEq(t, `{"columns":["name","age"],"rows":[["bob",22]]}`, buf.String())
+	bundled.Close()
+
+	unpacked := filepath.Join(filepath.Dir(tape), "unpacked")
+	if _, err = Unpack(ctx, bytes.NewReader(bundle.Bytes()), unpacked); err != nil {
+		t.Fatal(err)
+	}
+	c, err = LoadControlCassette(ctx, unpacked, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.StoreAsset(ctx, "other.html", "text/html", "<h1>other</h1>"); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if _, err = Unpack(ctx, bytes.NewReader(bundle.Bytes()), unpacked); err == nil {
+		t.Fatal("Unpack should not overwrite an existing cassette")
+	}
+
+	corrupted := append([]byte(nil), bundle.Bytes()...)
+	// tar header + bundle.json + tar header, then the content of k7.db
+	corrupted[3*512+100] ^= 0xff
+	var invalid InvalidBundle
+	if _, err = Unpack(ctx, bytes.NewReader(corrupted), filepath.Join(filepath.Dir(tape), "corrupted")); !errors.As(err, &invalid) {
+		t.Fatalf("Corrupted bundles should be detected, got %v", err)
+	}
+	entries, err := os.ReadDir(filepath.Dir(tape))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if strings.Contains(e.Name(), "corrupted") {
+			t.Errorf("Failed unpack should not leave %v behind", e.Name())
+		}
+	}
+
+	existing := filepath.Join(filepath.Dir(tape), "existing")
+	if err = os.MkdirAll(existing, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(existing, "notes.txt"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Unpack(ctx, bytes.NewReader(corrupted), existing); !errors.As(err, &invalid) {
+		t.Fatalf("Corrupted bundles should be detected, got %v", err)
+	}
+	if entries, err = os.ReadDir(existing); err != nil || len(entries) != 1 {
+		t.Fatalf("Failed unpack should not change %v, got %v / %v", existing, entries, err)
+	}
+	if _, err = Unpack(ctx, bytes.NewReader(bundle.Bytes()), existing); err != nil {
+		t.Fatal(err)
+	}
+	if err = verifyUnpacked(existing, files); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFsck(t *testing.T) {
+	tape, cleanup := tempTape(t, "test")
+	defer cleanup()
+
+	ctx := context.Background()
+	c, err := LoadControlCassette(ctx, tape, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for _, a := range []struct{ path, mt, content string }{
+		{"codebase/index.lua", "text/x-lua", "return 1"},
+		{"codebase/removed.lua", "text/x-lua", "return 2"},
+		{"index.html", "text/html", "<h1>it works</h1>"},
+		{"broken.html", "application/octet-stream", "\xff\xfe"},
+		{"dataset/gone.json", "application/json", `{"importedFromFile":"gone.csv"}`},
+		{"dataset/people.json", "application/json", `{"importedFromFile":"people.csv"}`},
+	} {
+		if _, err := c.StoreAsset(ctx, a.path, a.mt, a.content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, table := range []string{"people", "gone"} {
+		if _, _, err = c.ImportCSVDataset(ctx, table, strings.NewReader("name,age\nbob,22\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, a := range []string{"codebase/index.lua", "codebase/removed.lua"} {
+		if err = c.ToggleCodebase(ctx, a, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = c.MapRoute(ctx, []string{"GET"}, "/index", "codebase/index.lua"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.MapRoute(ctx, []string{"GET"}, "/removed", "codebase/removed.lua"); err != nil {
+		t.Fatal(err)
+	}
+	problems, err := c.Fsck(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(problems) != 0 {
+		t.Fatalf("Cassette should be consistent, got %v", problems)
+	}
+
+	// simulate a hand-edited cassette
+	for _, stmt := range []string{
+		`update assets set mime_type = 'text/plain' where path = 'codebase/removed.lua'`,
+		`update assets set path_hash64 = 42 where path = 'index.html'`,
+		`update assets set mime_type = 'text/html' where path = 'broken.html'`,
+		`update blob_chunks set data = cast('return 3' as blob) where content_hash = (select content_hash from assets where path = 'codebase/index.lua')`,
+	} {
+		if _, err = c.db.ExecContext(ctx, stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = c.datadb.ExecContext(ctx, `drop table gone`); err != nil {
+		t.Fatal(err)
+	}
+
+	summary := func(problems []Problem) []string {
+		var out []string
+		for _, p := range problems {
+			out = append(out, fmt.Sprintf("%v %v %v", p.Kind, p.Subject, p.Repaired))
+		}
+		return out
+	}
+	expected := []string{
+		"invalid-codebase codebase/removed.lua true",
+		"orphan-route /removed true",
+		"path-hash-mismatch index.html true",
+		"invalid-utf8 broken.html false",
+		fmt.Sprintf("blob-hash-mismatch blob %x false", sha256.Sum256([]byte("return 1"))),
+		"orphan-descriptor dataset/gone.json true",
+	}
+	problems, err = c.Fsck(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := summary(problems); !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("Expecting problems %v got %v", expected, actual)
+	}
+	problems, err = c.Fsck(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := summary(problems); !reflect.DeepEqual(actual, []string{expected[3], expected[4]}) {
+		t.Fatalf("Only the content of broken.html and codebase/index.lua cannot be repaired, got %v", actual)
+	}
+	if _, err = c.StatAsset(ctx, "index.html"); err != nil {
+		t.Fatalf("index.html should be reachable after the path hash is fixed, got %v", err)
+	}
+	if _, err = c.StatAsset(ctx, "dataset/gone.json"); !errors.As(err, &AssetNotFound{}) {
+		t.Fatalf("Orphan descriptor should be removed, got %v", err)
+	}
+}
+
+func TestDeletion(t *testing.T) {
+	tape, cleanup := tempTape(t, "test")
+	defer cleanup()
+
+	ctx := context.Background()
+	c, err := LoadControlCassette(ctx, tape, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range []struct{ path, mt, content string }{
+		{"codebase/index.lua", "text/x-lua", "return 1"},
+		{"codebase/other.lua", "text/x-lua", "return 2"},
+		{"style.css", "text/css", "body { color: red; } body { color: red; } body { color: red; }"},
+		{"style.css", "text/css", "body { color: blue; } body { color: blue; } body { color: blue; }"},
+		{"dataset/people.json", "application/json", `{"importedFromFile":"people.csv"}`},
+	} {
+		if _, err := c.StoreAsset(ctx, a.path, a.mt, a.content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = c.CompressAsset(ctx, "style.css", EncodingGzip); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = c.ImportCSVDataset(ctx, "people", strings.NewReader("name,age\nbob,22\n")); err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range []string{"codebase/index.lua", "codebase/other.lua"} {
+		if err = c.ToggleCodebase(ctx, a, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, r := range []struct{ route, asset string }{{"/index", "codebase/index.lua"}, {"/home", "codebase/index.lua"}, {"/other", "codebase/other.lua"}} {
+		if err = c.MapRoute(ctx, []string{"GET"}, r.route, r.asset); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = c.DeleteAsset(ctx, "codebase/index.lua"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.DeleteAsset(ctx, "style.css"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.DeleteAsset(ctx, "style.css"); !errors.Is(err, AssetNotFound{Path: "style.css"}) {
+		t.Fatalf("Deleting a missing asset should fail with AssetNotFound, got %v", err)
+	}
+	routes, err := c.ListRoutes(ctx)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(routes) != 1 || routes[0].Route != "/other" {
+		t.Fatalf("Routes handled by a deleted asset should be removed, got %v", routes)
+	}
+	if codebase, err := c.ListCodebase(ctx); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(codebase, []string{"codebase/other.lua"}) {
+		t.Fatalf("Deleted asset should be removed from the codebase, got %v", codebase)
+	}
+	var blobs int
+	if err = c.db.QueryRowContext(ctx, `select count(*) from blobs`).Scan(&blobs); err != nil {
+		t.Fatal(err)
+	} else if blobs != 2 {
+		t.Fatalf("Only the content of codebase/other.lua and dataset/people.json should be kept, got %v blobs", blobs)
+	}
+
+	if err = c.UnmapRoute(ctx, "/other"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.UnmapRoute(ctx, "/other"); !errors.Is(err, RouteNotFound{Route: "/other"}) {
+		t.Fatalf("Removing a missing route should fail with RouteNotFound, got %v", err)
+	}
+	if _, err = c.StatAsset(ctx, "codebase/other.lua"); err != nil {
+		t.Fatalf("Removing a route should keep its asset, got %v", err)
+	}
+
+	if err = c.DropDatasetTable(ctx, "people"); err != nil {
+		t.Fatal(err)
+	}
+	if tables, err := c.ListDatasetTables(ctx); err != nil {
+		t.Fatal(err)
+	} else if len(tables) != 0 {
+		t.Fatalf("Table should be dropped, got %v", tables)
+	}
+	if _, err = c.StatAsset(ctx, "dataset/people.json"); !errors.As(err, &AssetNotFound{}) {
+		t.Fatalf("Table descriptor should be removed, got %v", err)
+	}
+	if err = c.DropDatasetTable(ctx, "people"); !errors.Is(err, TableNotFound{Name: "people"}) {
+		t.Fatalf("Dropping a missing table should fail with TableNotFound, got %v", err)
+	}
+	c.Close()
+
+	c, err = LoadControlCassette(ctx, tape, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err = c.DeleteAsset(ctx, "codebase/other.lua"); !errors.Is(err, ReadonlyCassette{}) {
+		t.Fatalf("Read-only cassettes should not allow deletion, got %v", err)
+	}
+}
+
+func TestRouteOptions(t *testing.T) {
+	opts, err := ParseRouteOptions(map[string]interface{}{
+		"timeout":      "2s",
+		"max_body":     "64KiB",
+		"cache":        "max-age=60",
+		"content_type": "application/json",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := RouteOptions{Timeout: 2 * time.Second, MaxBody: 64 << 10, Cache: "max-age=60", ContentType: "application/json"}
+	if opts != expected {
+		t.Fatalf("Expecting %#v got %#v", expected, opts)
+	}
+	if opts, err = ParseRouteOptions(map[string]interface{}{"timeout": 1.5, "max_body": float64(100)}); err != nil {
+		t.Fatal(err)
+	} else if opts.Timeout != 1500*time.Millisecond || opts.MaxBody != 100 {
+		t.Fatalf("Numbers should be parsed as seconds and bytes, got %#v", opts)
+	}
+	for _, invalid := range []map[string]interface{}{
+		{"timeout": "-1s"},
+		{"timeout": true},
+		{"max_body": "10 parsecs"},
+		{"cache": "no-cache\r\nX-Injected: 1"},
+		{"retries": float64(3)},
+	} {
+		if _, err := ParseRouteOptions(invalid); !errors.As(err, &InvalidRouteOptions{}) {
+			t.Errorf("Options %v should be rejected with InvalidRouteOptions, got %v", invalid, err)
+		}
+	}
+
+	tape, cleanup := tempTape(t, "test")
+	defer cleanup()
+	ctx := context.Background()
+	c, err := LoadControlCassette(ctx, tape, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err = c.StoreAsset(ctx, "codebase/index.lua", "text/x-lua", "return 1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.ToggleCodebase(ctx, "codebase/index.lua", true); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.MapRouteWithOptions(ctx, []string{"GET"}, "/index", "codebase/index.lua", expected); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.MapRoute(ctx, []string{"GET"}, "/plain", "codebase/index.lua"); err != nil {
+		t.Fatal(err)
+	}
+	routes, err := c.ListRoutes(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 2 || routes[0].Options != expected || !routes[1].Options.IsZero() {
+		t.Fatalf("Route options should be persisted, got %#v", routes)
+	}
+	// mapping a route again replaces its options
+	if err = c.MapRoute(ctx, []string{"POST"}, "/index", "codebase/index.lua"); err != nil {
+		t.Fatal(err)
+	}
+	if routes, err = c.ListRoutes(ctx); err != nil {
+		t.Fatal(err)
+	} else if !routes[0].Options.IsZero() || !reflect.DeepEqual(routes[0].Methods, []string{"POST"}) {
+		t.Fatalf("Route should be replaced, got %#v", routes[0])
+	}
+}
+
+func TestRouteValidation(t *testing.T) {
+	for _, valid := range []string{"/", "/index", "/users/:id", "/users/:id/posts", "/files/*path", "/docs/"} {
+		if err := ValidateRoute([]string{"get", "POST"}, valid); err != nil {
+			t.Errorf("Route %v should be valid, got %v", valid, err)
+		}
+	}
+	for _, invalid := range []struct {
+		methods []string
+		route   string
+	}{
+		{[]string{"GET"}, "index"},
+		{[]string{"GET"}, "/a//b"},
+		{[]string{"GET"}, "/../b"},
+		{[]string{"GET"}, "/user_:id"},
+		{[]string{"GET"}, "/users/:"},
+		{[]string{"GET"}, "/files/*path/more"},
+		{[]string{"GET"}, "/search?q=1"},
+		{[]string{"GET"}, "/with space"},
+		{[]string{"FETCH"}, "/index"},
+		{nil, "/index"},
+	} {
+		if err := ValidateRoute(invalid.methods, invalid.route); !errors.As(err, &InvalidRoute{}) {
+			t.Errorf("Route %v %v should be rejected with InvalidRoute, got %v", invalid.methods, invalid.route, err)
+		}
+	}
+
+	handlers := []RouteHandler{
+		{Method: "GET", Path: "/index.html", Source: "asset index.html", Asset: "index.html"},
+		{Method: "GET", Path: "/", Source: "asset index.html", Asset: "index.html"},
+		{Method: "GET", Path: "/api/users/:id", Source: "route /users/:id", Route: "/users/:id"},
+		{Method: "GET", Path: "/api/users/:name/posts", Source: "route /users/:name/posts", Route: "/users/:name/posts"},
+		{Method: "GET", Path: "/api/users/me", Source: "route /users/me", Route: "/users/me"},
+		{Method: "POST", Path: "/api/users/me", Source: "route /users/me", Route: "/users/me"},
+		{Method: "GET", Path: "/api/users/", Source: "route /users/", Route: "/users/"},
+		{Method: "GET", Path: "/api/files/*path", Source: "route /files/*path", Route: "/files/*path"},
+		{Method: "GET", Path: "/api/files/", Source: "asset api/files/index.html", Asset: "api/files/index.html"},
+		{Method: "GET", Path: "/index.html", Source: "internal"},
+		{Method: "GET", Path: "/api/a:b", Source: "route /a:b", Route: "/a:b"},
+		// assets are served as they are, even if their names are not valid routes
+		{Method: "GET", Path: "/a:b", Source: "asset a:b", Asset: "a:b"},
+		{Method: "GET", Path: "/api/users/*all", Source: "asset api/users/*all", Asset: "api/users/*all"},
+		{Method: "GET", Path: "/my page.html", Source: "asset my page.html", Asset: "my page.html"},
+	}
+	var found []string
+	for _, c := range FindRouteConflicts(handlers) {
+		found = append(found, c.String())
+	}
+	expected := []string{
+		"GET /api/a:b (route /a:b): parameters must span a whole segment, got a:b",
+		"GET /index.html (internal) conflicts with /index.html (asset index.html): duplicate path",
+		"GET /api/users/:name/posts (route /users/:name/posts) conflicts with /api/users/:id (route /users/:id): parameter :name conflicts with parameter :id",
+		"GET /api/users/:name/posts (route /users/:name/posts) conflicts with /api/users/me (route /users/me): parameter :name conflicts with static segment \"me\"",
+		"GET /api/users/:id (route /users/:id) conflicts with /api/users/me (route /users/me): parameter :id conflicts with static segment \"me\"",
+		"GET /api/files/*path (route /files/*path) conflicts with /api/files/ (asset api/files/index.html): catch-all parameter conflicts with another path in the same segment",
+	}
+	sort.Strings(found)
+	sort.Strings(expected)
+	if !reflect.DeepEqual(found, expected) {
+		t.Fatalf("Expecting conflicts\n%v\ngot\n%v", strings.Join(expected, "\n"), strings.Join(found, "\n"))
+	}
+
+	tape, cleanup := tempTape(t, "test")
+	defer cleanup()
+	ctx := context.Background()
+	c, err := LoadControlCassette(ctx, tape, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err = c.StoreAsset(ctx, "codebase/index.lua", "text/x-lua", "return 1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.ToggleCodebase(ctx, "codebase/index.lua", true); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.MapRoute(ctx, []string{"BREW"}, "/coffee", "codebase/index.lua"); !errors.As(err, &InvalidRoute{}) {
+		t.Fatalf("Unknown methods should be rejected, got %v", err)
+	}
+	if err = c.MapRoute(ctx, []string{"GET"}, "/coffee/:pot/*rest/more", "codebase/index.lua"); !errors.As(err, &InvalidRoute{}) {
+		t.Fatalf("Invalid paths should be rejected, got %v", err)
+	}
+}
+
+func TestQueryArrow(t *testing.T) {
+	tape, cleanup := tempTape(t, "test")
+	defer cleanup()
+
+	ctx := context.Background()
+	c, err := LoadControlCassette(ctx, tape, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = c.ImportCSVDataset(ctx, "people", strings.NewReader("name,age,height\nbob,22,1.8\ncharlie,44,1.7\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	c, err = LoadControlCassette(ctx, tape, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var buf bytes.Buffer
+	status, err := c.QueryArrow(ctx, &buf, 0, "select name, age, nullif(height, 1.7) as height, age * 2 as double_age from people order by age")
+	if err != nil {
+		t.Fatal(err)
+	} else if expected := (QueryStatus{Status: QueryCompleted, Rows: 2}); status != expected {
+		t.Fatalf("Expecting status %#v got %#v", expected, status)
+	}
+	reader, err := ipc.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Release()
+	var types []string
+	for _, f := range reader.Schema().Fields() {
+		types = append(types, f.Name+":"+f.Type.Name())
+	}
+	if expected := []string{"name:utf8", "age:int64", "height:float64", "double_age:int64"}; !reflect.DeepEqual(types, expected) {
+		t.Fatalf("Expecting schema %v got %v", expected, types)
+	}
+	if !reader.Next() {
+		t.Fatalf("Stream should contain a record batch, got %v", reader.Err())
+	}
+	rec := reader.Record()
+	if rec.NumRows() != 2 {
+		t.Fatalf("Expecting 2 rows got %v", rec.NumRows())
+	}
+	if names := rec.Column(0).(*array.String); names.Value(0) != "bob" || names.Value(1) != "charlie" {
+		t.Errorf("Unexpected names %v", names)
+	}
+	if ages := rec.Column(1).(*array.Int64); ages.Value(0) != 22 || ages.Value(1) != 44 {
+		t.Errorf("Unexpected ages %v", ages)
+	}
+	if heights := rec.Column(2).(*array.Float64); heights.Value(0) != 1.8 || !heights.IsNull(1) {
+		t.Errorf("Unexpected heights %v", heights)
+	}
+	if reader.Next() {
+		t.Fatal("Stream should contain a single record batch")
+	}
+
+	buf.Reset()
+	status, err = c.QueryArrow(ctx, &buf, 1, "select name from people")
+	if err != nil {
+		t.Fatal(err)
+	} else if status.Status != QueryTruncated || status.Rows != 1 {
+		t.Fatalf("Query should be truncated by the row limit, got %#v", status)
+	}
+
+	// expressions take the type of the first row
+	buf.Reset()
+	status, err = c.QueryArrow(ctx, &buf, 0, "select case when age < 30 then age else name end as mixed from people order by age")
+	if !errors.As(err, &QueryError{}) {
+		t.Fatalf("Values which do not match the column type should fail with QueryError, got %v", err)
+	} else if status.Status != QueryFailed || status.Rows != 1 {
+		t.Fatalf("Query should fail after the first row, got %#v", status)
+	}
+	buf.Reset()
+	status, err = c.QueryArrow(ctx, &buf, 0, "select cast(case when age < 30 then age else name end as text) as mixed from people order by age")
+	if err != nil {
+		t.Fatal(err)
+	} else if status.Rows != 2 {
+		t.Fatalf("Expecting 2 rows got %#v", status)
+	}
+}
+
+func TestQueryMetadata(t *testing.T) {
+	tape, cleanup := tempTape(t, "test")
+	defer cleanup()
+
+	ctx := context.Background()
+	c, err := LoadControlCassette(ctx, tape, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = c.ImportCSVDataset(ctx, "people", strings.NewReader("name,age\nbob,22\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.StoreAsset(ctx, "dataset/people.json", "application/json", `{"importedFromFile":"people.csv","columns":{"name":"Full name","age":{"description":"Age in years"}}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	c, err = LoadControlCassette(ctx, tape, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var buf bytes.Buffer
+	err = c.QueryWithMetadata(ctx, &buf, -1, "select name, age as years, age * 2 as double_age, path from people, assets where path like 'dataset/%'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result struct {
+		Columns  []string
+		Metadata []ColumnMetadata
+	}
+	if err = json.Unmarshal(buf.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	nullable, notNull := true, false
+	expected := []ColumnMetadata{
+		{Name: "name", Type: "TEXT", Nullable: &nullable, Table: "people", Column: "name", Doc: "Full name"},
+		// renamed columns have no origin
+		{Name: "years", Type: "INTEGER"},
+		{Name: "double_age"},
+		{Name: "path", Type: "TEXT", Nullable: &notNull, Table: "assets", Column: "path"},
+	}
+	if !reflect.DeepEqual(result.Metadata, expected) {
+		actual, _ := json.Marshal(result.Metadata)
+		t.Fatalf("Unexpected metadata %v", string(actual))
+	}
+	if !reflect.DeepEqual(result.Columns, []string{"name", "years", "double_age", "path"}) {
+		t.Fatalf("Columns should be kept, got %v", result.Columns)
+	}
+
+	buf.Reset()
+	if err = c.QueryWithMetadata(ctx, &buf, -1, "select p.age from people p order by name"); err != nil {
+		t.Fatal(err)
+	}
+	if err = json.Unmarshal(buf.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	sorted := ColumnMetadata{Name: "age", Type: "INTEGER", Nullable: &nullable, Table: "people", Column: "age", Doc: "Age in years"}
+	if len(result.Metadata) != 1 || !reflect.DeepEqual(result.Metadata[0], sorted) {
+		t.Fatalf("Expecting %#v got %#v", sorted, result.Metadata)
+	}
+
+	// an alias which matches the name of another column must not be taken as that column
+	buf.Reset()
+	if err = c.QueryWithMetadata(ctx, &buf, -1, "select p.name as path, a.mime_type from people p, assets a"); err != nil {
+		t.Fatal(err)
+	}
+	result.Metadata = nil
+	if err = json.Unmarshal(buf.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	expected = []ColumnMetadata{
+		{Name: "path", Type: "TEXT"},
+		{Name: "mime_type", Type: "string", Nullable: &notNull, Table: "assets", Column: "mime_type"},
+	}
+	if !reflect.DeepEqual(result.Metadata, expected) {
+		actual, _ := json.Marshal(result.Metadata)
+		t.Fatalf("Unexpected metadata %v", string(actual))
+	}
+}
+
+func TestQueryPage(t *testing.T) {
+	tape, cleanup := tempTape(t, "test")
+	defer cleanup()
+
+	ctx := context.Background()
+	c, err := LoadControlCassette(ctx, tape, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = c.ImportCSVDataset(ctx, "people", strings.NewReader("name,age\nbob,22\nana,22\ncharlie,44\ndave,44\neve,66\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	c, err = LoadControlCassette(ctx, tape, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var names []string
+	page := Page{OrderBy: []string{"age", "-name"}, Limit: 2}
+	for i := 0; i < 5; i++ {
+		var buf bytes.Buffer
+		next, err := c.QueryPage(ctx, &buf, -1, page, "select name, age from dataset.people;")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var result struct{ Rows [][]interface{} }
+		if err = json.Unmarshal(buf.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range result.Rows {
+			names = append(names, r[0].(string))
+		}
+		if next == "" {
+			break
+		}
+		page.Cursor = next
+	}
+	if expected := []string{"bob", "ana", "dave", "charlie", "eve"}; !reflect.DeepEqual(names, expected) {
+		t.Fatalf("Expecting %v got %v", expected, names)
+	}
+	if _, err = c.QueryPage(ctx, io.Discard, -1, Page{OrderBy: []string{"age; drop table people"}}, "select * from dataset.people"); !errors.As(err, &InvalidPage{}) {
+		t.Fatalf("Invalid sort keys should be rejected, got %v", err)
+	}
+	page = Page{OrderBy: []string{"age"}, Limit: 1}
+	next, err := c.QueryPage(ctx, io.Discard, -1, page, "select name, age from dataset.people where age > ?", 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page.Cursor = next
+	if _, err = c.QueryPage(ctx, io.Discard, -1, page, "select name, age from dataset.people where age > ?", 30); !errors.As(err, &InvalidPage{}) {
+		t.Fatalf("Cursors should not be reused with different arguments, got %v", err)
+	}
+}
+
+func TestQueryPolicy(t *testing.T) {
+	tape, cleanup := tempTape(t, "test")
+	defer cleanup()
+
+	ctx := context.Background()
+	c, err := LoadControlCassette(ctx, tape, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = c.ImportCSVDataset(ctx, "people", strings.NewReader("name,age\nbob,22\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// canned queries are checked by the policy while the cassette is writable
+	shout := CannedQuery{Name: "shout", SQL: "select upper(name) from people"}
+	if err = c.StoreQuery(ctx, shout); err != nil {
+		t.Fatalf("upper should be allowed by the default policy, got %v", err)
+	}
+	if err = c.RemoveQuery(ctx, shout.Name); err != nil {
+		t.Fatal(err)
+	}
+	err = c.StoreManifest(ctx, Manifest{Name: "test", Query: &QueryPolicy{Pragmas: []string{"user_version"}, DenyFunctions: []string{"upper"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.StoreQuery(ctx, shout); !errors.As(err, &InvalidQuery{}) {
+		t.Fatalf("Storing the manifest should replace the policy in use, got %v", err)
+	}
+	err = c.StoreManifest(ctx, Manifest{Name: "test", Query: &QueryPolicy{Pragmas: []string{"user_version; drop"}}})
+	if !errors.As(err, &InvalidManifest{}) {
+		t.Fatalf("Invalid pragma names should be rejected, got %v", err)
+	}
+	c.Close()
+	c, err = LoadControlCassette(ctx, tape, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for _, allowed := range []string{
+		"select name, age from people",
+		"with recursive n(i) as (select 1 union all select i + 1 from n where i < 3) select i from n",
+		"pragma dataset.table_info(people)",
+		"pragma user_version",
+	} {
+		var buf bytes.Buffer
+		if err := c.Query(ctx, &buf, -1, allowed); err != nil {
+			t.Errorf("Query %q should be allowed, got %v", allowed, err)
+		}
+	}
+	for _, denied := range []string{
+		"attach database ':memory:' as other",
+		"detach database dataset",
+		"pragma journal_mode",
+		"select load_extension('evil')",
+		"select upper(name) from people",
+		"create temp table copy as select * from people",
+		"insert into people(name, age) values ('eve', 1)",
+		"select 1; attach database ':memory:' as other",
+	} {
+		var buf bytes.Buffer
+		err := c.Query(ctx, &buf, -1, denied)
+		if !errors.As(err, &QueryNotAllowed{}) {
+			t.Errorf("Query %q should not be allowed, got %v", denied, err)
+		}
+	}
+	if _, err := c.QueryNDJSON(ctx, io.Discard, 0, "select randomblob(10)"); !errors.As(err, &QueryNotAllowed{}) {
+		t.Errorf("NDJSON queries should use the same policy, got %v", err)
+	}
+
+	// connections closed by the pool take their authorizer with them,
+	// new connections must be guarded (and see the dataset) as well
+	c.db.SetMaxIdleConns(0)
+	for i := 0; i < 3; i++ {
+		if err := c.Query(ctx, io.Discard, -1, "select name from people"); err != nil {
+			t.Fatalf("Query should work on a new connection, got %v", err)
+		}
+		if err := c.Query(ctx, io.Discard, -1, "pragma journal_mode"); !errors.As(err, &QueryNotAllowed{}) {
+			t.Fatalf("New connections should use the query policy, got %v", err)
+		}
+	}
+
+	err = c.SetQueryPolicy(QueryPolicy{TempTables: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	err = c.Query(ctx, &buf, -1, "create temp table if not exists copy as select * from people")
+	if err != nil {
+		t.Fatalf("Temporary tables should be allowed, got %v", err)
+	}
+	buf.Reset()
+	err = c.Query(ctx, &buf, -1, "select upper(name) from people")
+	if err != nil {
+		t.Fatalf("The policy set by SetQueryPolicy replaces the manifest, got %v", err)
+	}
+}
+
+func TestQueryBudget(t *testing.T) {
+	tape, cleanup := tempTape(t, "test")
+	defer cleanup()
+
+	ctx := context.Background()
+	c, err := LoadControlCassette(ctx, tape, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = c.ImportCSVDataset(ctx, "people", strings.NewReader("name,age\nbob,22\ncharlie,44\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	c, err = LoadControlCassette(ctx, tape, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	const endless = "with recursive n(i) as (select 1 union all select i + 1 from n) select count(*) from n"
+
+	var buf bytes.Buffer
+	budgetCtx, cost := WithQueryBudget(ctx, QueryBudget{})
+	err = c.Query(budgetCtx, &buf, -1, "with recursive n(i) as (select 1 union all select i + 1 from n where i < 10000) select count(*) from n")
+	if err != nil {
+		t.Fatal(err)
+	} else if cost.Instructions() == 0 {
+		t.Fatal("Instructions should be counted even without a budget")
+	}
+
+	var exceeded QueryBudgetExceeded
+	budgetCtx, cost = WithQueryBudget(ctx, QueryBudget{Instructions: 100_000})
+	err = c.Query(budgetCtx, &buf, -1, endless)
+	if !errors.As(err, &exceeded) || exceeded.Resource != "instructions" {
+		t.Fatalf("Query should exceed its instructions budget, got %v", err)
+	} else if cost.Instructions() <= 100_000 {
+		t.Fatalf("Cost should include the instructions used by the interrupted query, got %v", cost.Instructions())
+	}
+
+	budgetCtx, _ = WithQueryBudget(ctx, QueryBudget{Duration: 50 * time.Millisecond})
+	start := time.Now()
+	_, err = c.QueryNDJSON(budgetCtx, io.Discard, 0, endless)
+	if !errors.As(err, &exceeded) || exceeded.Resource != "duration" {
+		t.Fatalf("Query should exceed its duration budget, got %v", err)
+	} else if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Query should have been interrupted after 50ms, took %v", elapsed)
+	}
+
+	// the budget of the cassette applies when it is lower than the one of the caller
+	err = c.SetQueryPolicy(QueryPolicy{MaxInstructions: 10_000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	budgetCtx, _ = WithQueryBudget(ctx, QueryBudget{Instructions: 1_000_000})
+	err = c.QueryCSV(budgetCtx, &buf, -1, ',', endless)
+	if !errors.As(err, &exceeded) || exceeded.Budget.Instructions != 10_000 {
+		t.Fatalf("Query should use the budget of the cassette, got %v", err)
+	}
+	buf.Reset()
+	err = c.Query(ctx, &buf, -1, "select count(*) from people")
+	if err != nil {
+		t.Fatalf("Queries within the budget should not be interrupted, got %v", err)
+	}
+
+	// the EXPLAIN used to find the columns of a query is subject to the same rules
+	_, err = c.queryColumns(ctx, "select 1; select name from people where ("+endless+") > 0", nil)
+	if !errors.As(err, &exceeded) {
+		t.Fatalf("Metadata of a query should use the budget of the cassette, got %v", err)
+	}
+	_, err = c.queryColumns(ctx, "select 1; attach database ':memory:' as other", nil)
+	if !errors.As(err, &QueryNotAllowed{}) {
+		t.Fatalf("Metadata of a query should use the query policy, got %v", err)
+	}
+}
+
+func TestCannedQueries(t *testing.T) {
+	tape, cleanup := tempTape(t, "test")
+	defer cleanup()
+
+	ctx := context.Background()
+	c, err := LoadControlCassette(ctx, tape, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = c.ImportCSVDataset(ctx, "people", strings.NewReader("name,age\nbob,22\nalice,30\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := CannedQuery{
+		Name: "older-than",
+		SQL:  "select name from people where age > :age and name like :pattern order by name",
+		Params: []QueryParam{
+			{Name: "pattern", Type: "text", Default: "%"},
+			{Name: "age", Type: "int", Required: true},
+		},
+	}
+	err = c.StoreQuery(ctx, query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, invalid := range []CannedQuery{
+		{Name: "bad name", SQL: "select 1"},
+		{Name: "empty", SQL: " "},
+		{Name: "reserved", SQL: "select :format", Params: []QueryParam{{Name: "format", Type: "text"}}},
+		{Name: "type", SQL: "select :a", Params: []QueryParam{{Name: "a", Type: "blob"}}},
+		{Name: "default", SQL: "select :a", Params: []QueryParam{{Name: "a", Type: "int", Default: "one"}}},
+		{Name: "twice", SQL: "select :a", Params: []QueryParam{{Name: "a", Type: "int"}, {Name: "a", Type: "text"}}},
+		{Name: "undeclared", SQL: "select :a, @b", Params: []QueryParam{{Name: "a", Type: "int"}}},
+		{Name: "unused", SQL: "select ':a' -- :a", Params: []QueryParam{{Name: "a", Type: "int"}}},
+		{Name: "positional", SQL: "select ?"},
+		{Name: "syntax", SQL: "selec 1"},
+		{Name: "missing-table", SQL: "select * from missing"},
+		{Name: "policy", SQL: "select 1; attach database ':memory:' as other"},
+		{Name: "write", SQL: "delete from people"},
+	} {
+		if err := c.StoreQuery(ctx, invalid); !errors.As(err, &InvalidQuery{}) {
+			t.Errorf("Query %v should be rejected, got %v", invalid.Name, err)
+		}
+	}
+	if _, err := c.LookupQuery(ctx, "write"); !errors.As(err, &QueryNotFound{}) {
+		t.Fatalf("Rejected queries should not be stored, got %v", err)
+	}
+	err = c.StoreQuery(ctx, CannedQuery{Name: "literal", SQL: "select ':a' as \"$b\", 1 as [@c] from people -- :d"})
+	if err != nil {
+		t.Fatalf("Placeholders inside literals and comments should be ignored, got %v", err)
+	}
+	c.Close()
+	c, err = LoadControlCassette(ctx, tape, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	stored, err := c.LookupQuery(ctx, "older-than")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Params[0].Name != "age" {
+		t.Fatalf("Parameters should be sorted by name, got %#v", stored.Params)
+	}
+	if _, err := c.LookupQuery(ctx, "missing"); !errors.As(err, &QueryNotFound{}) {
+		t.Fatalf("Unknown queries should return QueryNotFound, got %v", err)
+	}
+	if _, err := stored.Bind(map[string]string{}); !errors.As(err, &InvalidQueryParams{}) {
+		t.Fatalf("Required parameters should be checked, got %v", err)
+	}
+	if _, err := stored.Bind(map[string]string{"age": "twenty"}); !errors.As(err, &InvalidQueryParams{}) {
+		t.Fatalf("Parameter types should be checked, got %v", err)
+	}
+	args, err := stored.Bind(map[string]string{"age": "25", "other": "ignored"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	err = c.Query(ctx, &buf, -1, stored.SQL, args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.JSONEq(t, `{"columns":["name"],"rows":[["alice"]]}`, buf.String(), "Only alice is older than 25")
+}
+
+func TestFTS(t *testing.T) {
+	tape, cleanup := tempTape(t, "test")
+	defer cleanup()
+
+	ctx := context.Background()
+	c, err := LoadControlCassette(ctx, tape, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notes := "region,notes\nnorth,strong wind during the storm\nsouth,calm day\nwest,wind and rain\n"
+	_, _, err = c.ImportCSVDataset(ctx, "weather", strings.NewReader(notes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.AddFTS(ctx, "weather", []string{"notes", "region"})
+	if errors.As(err, &FTSNotSupported{}) {
+		t.Skip("SQLite was built without FTS5, use the sqlite_fts5 build tag")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.AddFTS(ctx, "weather", []string{"missing"}); !errors.As(err, &InvalidFTSIndex{}) {
+		t.Fatalf("Unknown columns should be rejected, got %v", err)
+	}
+	if err := c.AddFTS(ctx, "missing", []string{"notes"}); !errors.As(err, &TableNotFound{}) {
+		t.Fatalf("Unknown tables should be rejected, got %v", err)
+	}
+	// importing the same content again must keep the index in sync
+	_, _, err = c.ImportCSVDataset(ctx, "weather", strings.NewReader("region,notes\neast,wind from the sea\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tables, err := c.ListDatasetTables(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tables) != 1 || tables[0].Name != "weather" {
+		t.Fatalf("Full-text indexes should not be listed as dataset tables, got %v", tables)
+	}
+	indexes, err := c.ListFTS(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(indexes, []FTSIndex{{Table: "weather", Columns: []string{"notes", "region"}}}) {
+		t.Fatalf("Unexpected indexes %#v", indexes)
+	}
+	c.Close()
+	c, err = LoadControlCassette(ctx, tape, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, _, err := c.SearchQuery(ctx, "people", Search{Text: "wind"}); !errors.As(err, &FTSIndexNotFound{}) {
+		t.Fatalf("Tables without an index cannot be searched, got %v", err)
+	}
+	if _, _, err := c.SearchQuery(ctx, "weather", Search{Text: "  "}); !errors.As(err, &InvalidSearch{}) {
+		t.Fatalf("Empty searches should be rejected, got %v", err)
+	}
+	query, args, err := c.SearchQuery(ctx, "weather", Search{Text: "wind", Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	err = c.Query(ctx, &buf, -1, query, args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result struct {
+		Columns []string
+		Rows    [][]interface{}
+	}
+	if err := json.Unmarshal(buf.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(result.Columns, []string{"rowid", "rank", "snippet", "region", "notes"}) {
+		t.Fatalf("Unexpected columns %v", result.Columns)
+	}
+	if len(result.Rows) != 2 {
+		t.Fatalf("Search should respect the limit, got %v", result.Rows)
+	}
+	for _, row := range result.Rows {
+		if !strings.Contains(row[2].(string), "<mark>wind</mark>") {
+			t.Errorf("Snippet should highlight the term, got %v", row[2])
+		}
+	}
+	if result.Rows[0][1].(float64) > result.Rows[1][1].(float64) {
+		t.Errorf("Results should be ordered by rank, got %v", result.Rows)
+	}
+
+	// terms are quoted unless raw is used
+	for _, s := range []struct {
+		search   Search
+		expected int
+	}{
+		{Search{Text: "wind OR calm"}, 0},
+		{Search{Text: "wind OR calm", Raw: true}, 4},
+		{Search{Text: `wind"`}, 3},
+	} {
+		query, args, err := c.SearchQuery(ctx, "weather", s.search)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf.Reset()
+		if err := c.Query(ctx, &buf, -1, query, args...); err != nil {
+			t.Fatalf("Search %#v failed with %v", s.search, err)
+		}
+		if err := json.Unmarshal(buf.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+		if len(result.Rows) != s.expected {
+			t.Errorf("Search %#v should return %v rows got %v", s.search, s.expected, len(result.Rows))
+		}
+	}
+}
+
+func TestLoadFTSNotSupported(t *testing.T) {
+	tape, cleanup := tempTape(t, "test")
+	defer cleanup()
+
+	ctx := context.Background()
+	c, err := LoadControlCassette(ctx, tape, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	supported, err := ftsSupported(ctx, c.datadb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the index is only declared, so the cassette can be loaded by builds with FTS5
+	_, err = c.datadb.ExecContext(ctx, `insert into fts_indexes(name, source, columns) values ('weather_fts', 'weather', '["notes"]')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	for _, readwrite := range []bool{true, false} {
+		c, err = LoadControlCassette(ctx, tape, readwrite, true)
+		switch {
+		case supported && err != nil:
+			t.Fatalf("Cassette should be loaded by builds with FTS5, got %v", err)
+		case !supported && !errors.As(err, &FTSNotSupported{}):
+			t.Fatalf("Cassettes with full-text indexes should not be loaded without FTS5, got %v", err)
+		}
+		if err == nil {
+			c.Close()
+		}
+	}
+	c, err = LoadControlCassette(ctx, tape, false, false)
+	if err != nil {
+		t.Fatalf("Cassettes should be loaded without their dataset, got %v", err)
+	}
+	c.Close()
 }
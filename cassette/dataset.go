@@ -0,0 +1,237 @@
+package cassette
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type (
+	// DatasetTable is a table imported into the data cassette
+	DatasetTable struct {
+		Name string
+		// SQL contains the create statement of the table
+		SQL string
+	}
+
+	datasetDescriptor struct {
+		path  string
+		table string
+		// columns contains the documentation of each column
+		columns map[string]string
+	}
+)
+
+// ListDatasetTables returns the tables imported into the dataset, ordered by name,
+// tables used internally by boombox are not included.
+func (c *Control) ListDatasetTables(ctx context.Context) ([]DatasetTable, error) {
+	if c.datadb == nil {
+		return nil, DatasetNotAllowed{}
+	}
+	return c.datasetTables(ctx)
+}
+
+func (c *Control) datasetTables(ctx context.Context) ([]DatasetTable, error) {
+	// fts indexes and their shadow tables are derived from the dataset tables
+	rows, err := c.datadb.QueryContext(ctx, `select name, sql from sqlite_master m
+	where type = 'table' and name not like 'sqlite_%' and name not in ('schema_version', 'fts_indexes')
+	and not exists (select 1 from fts_indexes f where m.name in (f.name, f.name || '_data', f.name || '_idx',
+		f.name || '_content', f.name || '_docsize', f.name || '_config'))
+	order by name asc`)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list dataset tables, cause %w", err)
+	}
+	defer rows.Close()
+	var out []DatasetTable
+	for rows.Next() {
+		var t DatasetTable
+		err = rows.Scan(&t.Name, &t.SQL)
+		if err != nil {
+			return nil, fmt.Errorf("unable to scan dataset table, cause %w", err)
+		}
+		out = append(out, t)
+	}
+	return out, rows.Err()
+}
+
+// DropDatasetTable removes the table from the dataset along with
+// the descriptors created when the table was imported
+func (c *Control) DropDatasetTable(ctx context.Context, table string) error {
+	if !c.writeable {
+		return ReadonlyCassette{}
+	}
+	if c.datadb == nil {
+		return DatasetNotAllowed{}
+	}
+	if err := validDatasetTable(table); err != nil {
+		return err
+	}
+	tables, err := c.datasetTables(ctx)
+	if err != nil {
+		return err
+	}
+	var found bool
+	for _, t := range tables {
+		found = found || t.Name == table
+	}
+	if !found {
+		return TableNotFound{Name: table}
+	}
+	err = c.dropFTS(ctx, table)
+	if err != nil {
+		return err
+	}
+	_, err = c.datadb.ExecContext(ctx, fmt.Sprintf(`drop table %v`, table))
+	if err != nil {
+		return fmt.Errorf("unable to drop table %v, cause %w", table, err)
+	}
+	descriptors, err := c.datasetDescriptors(ctx)
+	if err != nil {
+		return err
+	}
+	for _, d := range descriptors {
+		if d.table != table {
+			continue
+		}
+		err = c.DeleteAsset(ctx, d.path)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// datasetDescriptors returns the JSON assets stored by the importer
+// to describe each table, other JSON files under dataset/ are ignored.
+func (c *Control) datasetDescriptors(ctx context.Context) ([]datasetDescriptor, error) {
+	assets, err := c.ListAssets(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var out []datasetDescriptor
+	for _, a := range assets {
+		if !strings.HasPrefix(a, "dataset/") || path.Ext(a) != ".json" {
+			continue
+		}
+		var buf bytes.Buffer
+		_, _, err = c.CopyAsset(ctx, &buf, a)
+		if err != nil {
+			return nil, err
+		}
+		var descriptor map[string]interface{}
+		if json.Unmarshal(buf.Bytes(), &descriptor) != nil || descriptor["importedFromFile"] == nil {
+			continue
+		}
+		d := datasetDescriptor{path: a, table: strings.TrimSuffix(path.Base(a), ".json"), columns: map[string]string{}}
+		// columns = { name = 'doc' } or columns = { name = { description = 'doc' } }
+		columns, _ := descriptor["columns"].(map[string]interface{})
+		for name, v := range columns {
+			switch v := v.(type) {
+			case string:
+				d.columns[name] = v
+			case map[string]interface{}:
+				d.columns[name], _ = v["description"].(string)
+			}
+		}
+		out = append(out, d)
+	}
+	return out, nil
+}
+
+// CountDatasetRows returns the number of rows in the given dataset table
+func (c *Control) CountDatasetRows(ctx context.Context, table string) (int64, error) {
+	if c.datadb == nil {
+		return 0, DatasetNotAllowed{}
+	}
+	if err := validDatasetTable(table); err != nil {
+		return 0, err
+	}
+	var total int64
+	err := c.datadb.QueryRowContext(ctx, fmt.Sprintf(`select count(*) from %v`, table)).Scan(&total)
+	if err != nil {
+		return 0, fmt.Errorf("unable to count rows of %v, cause %w", table, err)
+	}
+	return total, nil
+}
+
+// ExportCSVDataset writes the content of table to out using the CSV format,
+// the first row contains the name of the columns and NULL values are written as empty fields.
+//
+// Output generated by this method can be imported back with ImportCSVDataset
+func (c *Control) ExportCSVDataset(ctx context.Context, table string, out io.Writer) (int64, error) {
+	if c.datadb == nil {
+		return 0, DatasetNotAllowed{}
+	}
+	if err := validDatasetTable(table); err != nil {
+		return 0, err
+	}
+	rows, err := c.datadb.QueryContext(ctx, fmt.Sprintf(`select * from %v order by rowid asc`, table))
+	if err != nil {
+		return 0, fmt.Errorf("unable to export %v, cause %w", table, err)
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, fmt.Errorf("unable to export %v, cause %w", table, err)
+	}
+	w := csv.NewWriter(out)
+	err = w.Write(columns)
+	if err != nil {
+		return 0, fmt.Errorf("unable to export %v, cause %w", table, err)
+	}
+	r := make(Row, len(columns))
+	scanTarget := make([]interface{}, len(r))
+	for i := range scanTarget {
+		scanTarget[i] = &r[i]
+	}
+	record := make([]string, len(columns))
+	var total int64
+	for rows.Next() {
+		err = rows.Scan(scanTarget...)
+		if err != nil {
+			return total, fmt.Errorf("unable to export %v, cause %w", table, err)
+		}
+		for i, v := range r {
+			record[i] = csvField(v)
+		}
+		err = w.Write(record)
+		if err != nil {
+			return total, fmt.Errorf("unable to export %v, cause %w", table, err)
+		}
+		total++
+	}
+	if err = rows.Err(); err != nil {
+		return total, fmt.Errorf("unable to export %v, cause %w", table, err)
+	}
+	w.Flush()
+	return total, w.Error()
+}
+
+// csvField converts a value scanned from sqlite into its textual representation,
+// real values always contain a decimal point to keep their type when imported again
+func csvField(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case []byte:
+		return string(v)
+	case string:
+		return v
+	case float64:
+		str := strconv.FormatFloat(v, 'f', -1, 64)
+		if !strings.ContainsAny(str, ".eEIN") {
+			str += ".0"
+		}
+		return str
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	}
+	return fmt.Sprint(v)
+}
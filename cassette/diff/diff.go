@@ -0,0 +1,621 @@
+package diff
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/andrebq/boombox/cassette"
+)
+
+const (
+	Added   = "added"
+	Removed = "removed"
+	Changed = "changed"
+
+	// maxTextDiffSize is the largest asset which is compared line by line,
+	// changes to bigger assets are reported without the text diff
+	maxTextDiffSize = 1_000_000
+)
+
+type (
+	// Report lists the differences between two cassettes,
+	// each list is ordered by path/route/table/query name.
+	Report struct {
+		// Manifest is nil when the manifest did not change
+		Manifest *ManifestChange  `json:"manifest,omitempty"`
+		Assets   []AssetChange    `json:"assets"`
+		Routes   []RouteChange    `json:"routes"`
+		Codebase []CodebaseChange `json:"codebase"`
+		Tables   []TableChange    `json:"tables"`
+		FTS      []FTSChange      `json:"fts"`
+		Queries  []QueryChange    `json:"queries"`
+	}
+
+	// ManifestChange describes a change of the manifest,
+	// Old or New is nil when the cassette does not have a manifest
+	ManifestChange struct {
+		Change string             `json:"change"`
+		Old    *cassette.Manifest `json:"old,omitempty"`
+		New    *cassette.Manifest `json:"new,omitempty"`
+	}
+
+	AssetChange struct {
+		Path        string `json:"path"`
+		Change      string `json:"change"`
+		OldMimeType string `json:"oldMimeType,omitempty"`
+		NewMimeType string `json:"newMimeType,omitempty"`
+		OldHash     string `json:"oldHash,omitempty"`
+		NewHash     string `json:"newHash,omitempty"`
+		OldSize     int64  `json:"oldSize"`
+		NewSize     int64  `json:"newSize"`
+		// TextDiff is a unified diff of the content,
+		// only available when both versions are valid utf-8
+		TextDiff string `json:"textDiff,omitempty"`
+	}
+
+	RouteChange struct {
+		Route      string   `json:"route"`
+		Change     string   `json:"change"`
+		OldMethods []string `json:"oldMethods,omitempty"`
+		NewMethods []string `json:"newMethods,omitempty"`
+		OldAsset   string   `json:"oldAsset,omitempty"`
+		NewAsset   string   `json:"newAsset,omitempty"`
+
+		OldOptions cassette.RouteOptions `json:"oldOptions"`
+		NewOptions cassette.RouteOptions `json:"newOptions"`
+	}
+
+	QueryChange struct {
+		Name   string `json:"name"`
+		Change string `json:"change"`
+		OldSQL string `json:"oldSQL,omitempty"`
+		NewSQL string `json:"newSQL,omitempty"`
+		// ParamsChanged is true when parameters or the description changed
+		ParamsChanged bool `json:"paramsChanged"`
+	}
+
+	// FTSChange describes a full-text index added, removed or
+	// changed to cover other columns of its table
+	FTSChange struct {
+		Table      string   `json:"table"`
+		Change     string   `json:"change"`
+		OldColumns []string `json:"oldColumns,omitempty"`
+		NewColumns []string `json:"newColumns,omitempty"`
+	}
+
+	CodebaseChange struct {
+		Path    string `json:"path"`
+		Enabled bool   `json:"enabled"`
+	}
+
+	TableChange struct {
+		Table         string `json:"table"`
+		Change        string `json:"change"`
+		SchemaChanged bool   `json:"schemaChanged"`
+		OldSchema     string `json:"oldSchema,omitempty"`
+		NewSchema     string `json:"newSchema,omitempty"`
+		OldRows       int64  `json:"oldRows"`
+		NewRows       int64  `json:"newRows"`
+	}
+)
+
+// Empty returns true if both cassettes are equivalent
+func (r Report) Empty() bool {
+	return r.Manifest == nil && len(r.Assets) == 0 && len(r.Routes) == 0 && len(r.Codebase) == 0 &&
+		len(r.Tables) == 0 && len(r.FTS) == 0 && len(r.Queries) == 0
+}
+
+// RowDelta returns how many rows were added (or removed if negative) to the table
+func (t TableChange) RowDelta() int64 {
+	return t.NewRows - t.OldRows
+}
+
+// Compare computes the structural differences required to turn old into updated,
+// both cassettes must be loaded with access to their datasets.
+func Compare(ctx context.Context, old, updated *cassette.Control) (Report, error) {
+	var r Report
+	var err error
+	if r.Manifest, err = compareManifest(ctx, old, updated); err != nil {
+		return Report{}, err
+	}
+	if r.Assets, err = compareAssets(ctx, old, updated); err != nil {
+		return Report{}, err
+	}
+	if r.Routes, err = compareRoutes(ctx, old, updated); err != nil {
+		return Report{}, err
+	}
+	if r.Codebase, err = compareCodebase(ctx, old, updated); err != nil {
+		return Report{}, err
+	}
+	if r.Tables, err = compareTables(ctx, old, updated); err != nil {
+		return Report{}, err
+	}
+	if r.FTS, err = compareFTS(ctx, old, updated); err != nil {
+		return Report{}, err
+	}
+	if r.Queries, err = compareQueries(ctx, old, updated); err != nil {
+		return Report{}, err
+	}
+	return r, nil
+}
+
+func compareManifest(ctx context.Context, old, updated *cassette.Control) (*ManifestChange, error) {
+	o, err := loadManifest(ctx, old)
+	if err != nil {
+		return nil, err
+	}
+	n, err := loadManifest(ctx, updated)
+	if err != nil {
+		return nil, err
+	}
+	change := &ManifestChange{Old: o, New: n}
+	switch {
+	case o == nil && n == nil:
+		return nil, nil
+	case o == nil:
+		change.Change = Added
+	case n == nil:
+		change.Change = Removed
+	case !reflect.DeepEqual(o, n):
+		change.Change = Changed
+	default:
+		return nil, nil
+	}
+	return change, nil
+}
+
+// loadManifest returns nil if the cassette does not have a manifest
+func loadManifest(ctx context.Context, c *cassette.Control) (*cassette.Manifest, error) {
+	m, err := c.Manifest(ctx)
+	if errors.Is(err, cassette.ManifestNotFound{}) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func compareAssets(ctx context.Context, old, updated *cassette.Control) ([]AssetChange, error) {
+	oldAssets, err := statAssets(ctx, old)
+	if err != nil {
+		return nil, err
+	}
+	newAssets, err := statAssets(ctx, updated)
+	if err != nil {
+		return nil, err
+	}
+	out := []AssetChange{}
+	for _, p := range mergeKeys(oldAssets, newAssets) {
+		o, inOld := oldAssets[p]
+		n, inNew := newAssets[p]
+		change := AssetChange{
+			Path:        p,
+			OldMimeType: o.MimeType,
+			NewMimeType: n.MimeType,
+			OldHash:     o.ContentHash,
+			NewHash:     n.ContentHash,
+			OldSize:     o.Size,
+			NewSize:     n.Size,
+		}
+		switch {
+		case !inOld:
+			change.Change = Added
+		case !inNew:
+			change.Change = Removed
+		case o.ContentHash != n.ContentHash || o.MimeType != n.MimeType:
+			change.Change = Changed
+			if o.ContentHash != n.ContentHash && o.UTF8 && n.UTF8 && o.Size <= maxTextDiffSize && n.Size <= maxTextDiffSize {
+				change.TextDiff, err = textDiff(ctx, old, updated, p)
+				if err != nil {
+					return nil, err
+				}
+			}
+		default:
+			continue
+		}
+		out = append(out, change)
+	}
+	return out, nil
+}
+
+func textDiff(ctx context.Context, old, updated *cassette.Control, assetPath string) (string, error) {
+	var oldContent, newContent bytes.Buffer
+	if _, _, err := old.CopyAsset(ctx, &oldContent, assetPath); err != nil {
+		return "", err
+	}
+	if _, _, err := updated.CopyAsset(ctx, &newContent, assetPath); err != nil {
+		return "", err
+	}
+	diff, _ := unifiedDiff("a/"+assetPath, "b/"+assetPath, oldContent.String(), newContent.String())
+	return diff, nil
+}
+
+func statAssets(ctx context.Context, c *cassette.Control) (map[string]cassette.Asset, error) {
+	paths, err := c.ListAssets(ctx)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]cassette.Asset, len(paths))
+	for _, p := range paths {
+		out[p], err = c.StatAsset(ctx, p)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+func compareRoutes(ctx context.Context, old, updated *cassette.Control) ([]RouteChange, error) {
+	oldRoutes, err := indexRoutes(ctx, old)
+	if err != nil {
+		return nil, err
+	}
+	newRoutes, err := indexRoutes(ctx, updated)
+	if err != nil {
+		return nil, err
+	}
+	out := []RouteChange{}
+	for _, route := range mergeKeys(oldRoutes, newRoutes) {
+		o, inOld := oldRoutes[route]
+		n, inNew := newRoutes[route]
+		change := RouteChange{
+			Route:      route,
+			OldMethods: o.Methods,
+			NewMethods: n.Methods,
+			OldAsset:   o.Asset,
+			NewAsset:   n.Asset,
+			OldOptions: o.Options,
+			NewOptions: n.Options,
+		}
+		switch {
+		case !inOld:
+			change.Change = Added
+		case !inNew:
+			change.Change = Removed
+		case o.Asset != n.Asset || strings.Join(o.Methods, "|") != strings.Join(n.Methods, "|") || o.Options != n.Options:
+			change.Change = Changed
+		default:
+			continue
+		}
+		out = append(out, change)
+	}
+	return out, nil
+}
+
+func indexRoutes(ctx context.Context, c *cassette.Control) (map[string]cassette.Code, error) {
+	routes, err := c.ListRoutes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]cassette.Code, len(routes))
+	for _, r := range routes {
+		out[r.Route] = r
+	}
+	return out, nil
+}
+
+func compareQueries(ctx context.Context, old, updated *cassette.Control) ([]QueryChange, error) {
+	oldQueries, err := indexQueries(ctx, old)
+	if err != nil {
+		return nil, err
+	}
+	newQueries, err := indexQueries(ctx, updated)
+	if err != nil {
+		return nil, err
+	}
+	out := []QueryChange{}
+	for _, name := range mergeKeys(oldQueries, newQueries) {
+		o, inOld := oldQueries[name]
+		n, inNew := newQueries[name]
+		change := QueryChange{
+			Name:          name,
+			OldSQL:        o.SQL,
+			NewSQL:        n.SQL,
+			ParamsChanged: inOld && inNew && (o.Description != n.Description || !reflect.DeepEqual(o.Params, n.Params)),
+		}
+		switch {
+		case !inOld:
+			change.Change = Added
+		case !inNew:
+			change.Change = Removed
+		case o.SQL != n.SQL || change.ParamsChanged:
+			change.Change = Changed
+		default:
+			continue
+		}
+		out = append(out, change)
+	}
+	return out, nil
+}
+
+func indexQueries(ctx context.Context, c *cassette.Control) (map[string]cassette.CannedQuery, error) {
+	queries, err := c.ListQueries(ctx)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]cassette.CannedQuery, len(queries))
+	for _, q := range queries {
+		out[q.Name] = q
+	}
+	return out, nil
+}
+
+func compareFTS(ctx context.Context, old, updated *cassette.Control) ([]FTSChange, error) {
+	oldIndexes, err := indexFTS(ctx, old)
+	if err != nil {
+		return nil, err
+	}
+	newIndexes, err := indexFTS(ctx, updated)
+	if err != nil {
+		return nil, err
+	}
+	out := []FTSChange{}
+	for _, table := range mergeKeys(oldIndexes, newIndexes) {
+		o, inOld := oldIndexes[table]
+		n, inNew := newIndexes[table]
+		change := FTSChange{Table: table, OldColumns: o.Columns, NewColumns: n.Columns}
+		switch {
+		case !inOld:
+			change.Change = Added
+		case !inNew:
+			change.Change = Removed
+		case !reflect.DeepEqual(o.Columns, n.Columns):
+			change.Change = Changed
+		default:
+			continue
+		}
+		out = append(out, change)
+	}
+	return out, nil
+}
+
+func indexFTS(ctx context.Context, c *cassette.Control) (map[string]cassette.FTSIndex, error) {
+	indexes, err := c.ListFTS(ctx)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]cassette.FTSIndex, len(indexes))
+	for _, idx := range indexes {
+		out[idx.Table] = idx
+	}
+	return out, nil
+}
+
+func compareCodebase(ctx context.Context, old, updated *cassette.Control) ([]CodebaseChange, error) {
+	oldCodebase, err := indexCodebase(ctx, old)
+	if err != nil {
+		return nil, err
+	}
+	newCodebase, err := indexCodebase(ctx, updated)
+	if err != nil {
+		return nil, err
+	}
+	out := []CodebaseChange{}
+	for _, p := range mergeKeys(oldCodebase, newCodebase) {
+		if oldCodebase[p] != newCodebase[p] {
+			out = append(out, CodebaseChange{Path: p, Enabled: newCodebase[p]})
+		}
+	}
+	return out, nil
+}
+
+func indexCodebase(ctx context.Context, c *cassette.Control) (map[string]bool, error) {
+	paths, err := c.ListCodebase(ctx)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]bool, len(paths))
+	for _, p := range paths {
+		out[p] = true
+	}
+	return out, nil
+}
+
+func compareTables(ctx context.Context, old, updated *cassette.Control) ([]TableChange, error) {
+	oldTables, err := indexTables(ctx, old)
+	if err != nil {
+		return nil, err
+	}
+	newTables, err := indexTables(ctx, updated)
+	if err != nil {
+		return nil, err
+	}
+	out := []TableChange{}
+	for _, name := range mergeKeys(oldTables, newTables) {
+		o, inOld := oldTables[name]
+		n, inNew := newTables[name]
+		change := TableChange{
+			Table:     name,
+			OldSchema: o.SQL,
+			NewSchema: n.SQL,
+		}
+		if inOld {
+			if change.OldRows, err = old.CountDatasetRows(ctx, name); err != nil {
+				return nil, err
+			}
+		}
+		if inNew {
+			if change.NewRows, err = updated.CountDatasetRows(ctx, name); err != nil {
+				return nil, err
+			}
+		}
+		switch {
+		case !inOld:
+			change.Change = Added
+		case !inNew:
+			change.Change = Removed
+		case o.SQL != n.SQL || change.OldRows != change.NewRows:
+			change.Change = Changed
+			change.SchemaChanged = o.SQL != n.SQL
+		default:
+			continue
+		}
+		out = append(out, change)
+	}
+	return out, nil
+}
+
+func indexTables(ctx context.Context, c *cassette.Control) (map[string]cassette.DatasetTable, error) {
+	tables, err := c.ListDatasetTables(ctx)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]cassette.DatasetTable, len(tables))
+	for _, t := range tables {
+		out[t.Name] = t
+	}
+	return out, nil
+}
+
+// WriteText writes a human readable version of the report to out
+func (r Report) WriteText(out io.Writer) error {
+	var buf bytes.Buffer
+	if r.Empty() {
+		buf.WriteString("no differences\n")
+	}
+	if r.Manifest != nil {
+		buf.WriteString("manifest:\n")
+		switch r.Manifest.Change {
+		case Added:
+			fmt.Fprintf(&buf, "  + %v\n", manifestText(r.Manifest.New))
+		case Removed:
+			fmt.Fprintf(&buf, "  - %v\n", manifestText(r.Manifest.Old))
+		default:
+			fmt.Fprintf(&buf, "  ~ %v\n    - %v\n    + %v\n", r.Manifest.New.Name, manifestText(r.Manifest.Old), manifestText(r.Manifest.New))
+		}
+	}
+	if len(r.Assets) > 0 {
+		buf.WriteString("assets:\n")
+		for _, a := range r.Assets {
+			switch a.Change {
+			case Added:
+				fmt.Fprintf(&buf, "  + %v (%v, %v bytes)\n", a.Path, a.NewMimeType, a.NewSize)
+			case Removed:
+				fmt.Fprintf(&buf, "  - %v (%v, %v bytes)\n", a.Path, a.OldMimeType, a.OldSize)
+			default:
+				fmt.Fprintf(&buf, "  ~ %v", a.Path)
+				if a.OldMimeType != a.NewMimeType {
+					fmt.Fprintf(&buf, " (mime-type %v -> %v)", a.OldMimeType, a.NewMimeType)
+				}
+				if a.OldHash != a.NewHash {
+					fmt.Fprintf(&buf, " (%v -> %v bytes)", a.OldSize, a.NewSize)
+				}
+				buf.WriteString("\n")
+				for _, line := range splitLines(a.TextDiff) {
+					buf.WriteString("    " + line)
+				}
+			}
+		}
+	}
+	if len(r.Routes) > 0 {
+		buf.WriteString("routes:\n")
+		for _, rc := range r.Routes {
+			switch rc.Change {
+			case Added:
+				fmt.Fprintf(&buf, "  + %v %v -> %v\n", rc.Route, strings.Join(rc.NewMethods, "|"), rc.NewAsset)
+			case Removed:
+				fmt.Fprintf(&buf, "  - %v %v -> %v\n", rc.Route, strings.Join(rc.OldMethods, "|"), rc.OldAsset)
+			default:
+				fmt.Fprintf(&buf, "  ~ %v %v -> %v (was %v -> %v)\n", rc.Route,
+					strings.Join(rc.NewMethods, "|"), rc.NewAsset,
+					strings.Join(rc.OldMethods, "|"), rc.OldAsset)
+				if rc.OldOptions != rc.NewOptions {
+					fmt.Fprintf(&buf, "    options %+v -> %+v\n", rc.OldOptions, rc.NewOptions)
+				}
+			}
+		}
+	}
+	if len(r.Codebase) > 0 {
+		buf.WriteString("codebase:\n")
+		for _, cc := range r.Codebase {
+			if cc.Enabled {
+				fmt.Fprintf(&buf, "  + %v (enabled)\n", cc.Path)
+			} else {
+				fmt.Fprintf(&buf, "  - %v (disabled)\n", cc.Path)
+			}
+		}
+	}
+	if len(r.Tables) > 0 {
+		buf.WriteString("dataset:\n")
+		for _, t := range r.Tables {
+			switch t.Change {
+			case Added:
+				fmt.Fprintf(&buf, "  + %v (%v rows)\n", t.Table, t.NewRows)
+			case Removed:
+				fmt.Fprintf(&buf, "  - %v (%v rows)\n", t.Table, t.OldRows)
+			default:
+				fmt.Fprintf(&buf, "  ~ %v (%v -> %v rows, %+d)\n", t.Table, t.OldRows, t.NewRows, t.RowDelta())
+				if t.SchemaChanged {
+					fmt.Fprintf(&buf, "    - %v\n    + %v\n", t.OldSchema, t.NewSchema)
+				}
+			}
+		}
+	}
+	if len(r.FTS) > 0 {
+		buf.WriteString("full-text indexes:\n")
+		for _, f := range r.FTS {
+			switch f.Change {
+			case Added:
+				fmt.Fprintf(&buf, "  + %v (%v)\n", f.Table, strings.Join(f.NewColumns, ", "))
+			case Removed:
+				fmt.Fprintf(&buf, "  - %v (%v)\n", f.Table, strings.Join(f.OldColumns, ", "))
+			default:
+				fmt.Fprintf(&buf, "  ~ %v (%v -> %v)\n", f.Table, strings.Join(f.OldColumns, ", "), strings.Join(f.NewColumns, ", "))
+			}
+		}
+	}
+	if len(r.Queries) > 0 {
+		buf.WriteString("queries:\n")
+		for _, q := range r.Queries {
+			switch q.Change {
+			case Added:
+				fmt.Fprintf(&buf, "  + %v\n", q.Name)
+			case Removed:
+				fmt.Fprintf(&buf, "  - %v\n", q.Name)
+			default:
+				fmt.Fprintf(&buf, "  ~ %v\n", q.Name)
+				if q.OldSQL != q.NewSQL {
+					fmt.Fprintf(&buf, "    - %v\n    + %v\n", q.OldSQL, q.NewSQL)
+				}
+				if q.ParamsChanged {
+					buf.WriteString("    parameters changed\n")
+				}
+			}
+		}
+	}
+	_, err := buf.WriteTo(out)
+	return err
+}
+
+// manifestText encodes the manifest as a single line of json
+func manifestText(m *cassette.Manifest) string {
+	buf, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Sprintf("%+v", *m)
+	}
+	return string(buf)
+}
+
+// mergeKeys returns the sorted union of the keys of both maps,
+// which must use strings as keys
+func mergeKeys(a, b interface{}) []string {
+	seen := map[string]bool{}
+	var keys []string
+	for _, m := range []interface{}{a, b} {
+		for _, k := range reflect.ValueOf(m).MapKeys() {
+			if !seen[k.String()] {
+				seen[k.String()] = true
+				keys = append(keys, k.String())
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
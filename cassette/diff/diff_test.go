@@ -0,0 +1,221 @@
+package diff
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/andrebq/boombox/cassette"
+)
+
+func TestCompare(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "boombox-tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	old := loadCassette(ctx, t, filepath.Join(dir, "old"))
+	defer old.Close()
+	updated := loadCassette(ctx, t, filepath.Join(dir, "new"))
+	defer updated.Close()
+
+	storeAsset(ctx, t, old, "index.html", "text/html", "<h1>\nhello\n</h1>\n")
+	storeAsset(ctx, t, updated, "index.html", "text/html", "<h1>\nhello world\n</h1>\n")
+	storeAsset(ctx, t, old, "removed.css", "text/css", "body {}")
+	storeAsset(ctx, t, updated, "added.js", "application/javascript", "alert(1)")
+	for _, c := range []*cassette.Control{old, updated} {
+		storeAsset(ctx, t, c, "codebase/index.lua", "text/x-lua", "return 1")
+		storeAsset(ctx, t, c, "codebase/other.lua", "text/x-lua", "return 2")
+		if err := c.ToggleCodebase(ctx, "codebase/index.lua", true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := updated.ToggleCodebase(ctx, "codebase/other.lua", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := old.MapRoute(ctx, []string{"GET"}, "/index", "codebase/index.lua"); err != nil {
+		t.Fatal(err)
+	}
+	if err := updated.MapRoute(ctx, []string{"GET", "POST"}, "/index", "codebase/index.lua"); err != nil {
+		t.Fatal(err)
+	}
+	if err := updated.MapRoute(ctx, []string{"GET"}, "/other", "codebase/other.lua"); err != nil {
+		t.Fatal(err)
+	}
+	importCSV(ctx, t, old, "people", "name,age\nbob,22\n")
+	importCSV(ctx, t, updated, "people", "name,age\nbob,22\ncharlie,44\n")
+	importCSV(ctx, t, old, "dropped", "id\n1\n")
+	importCSV(ctx, t, updated, "created", "id\n1\n")
+	if err := old.StoreManifest(ctx, cassette.Manifest{Name: "test", Version: "1.0.0"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := updated.StoreManifest(ctx, cassette.Manifest{Name: "test", Version: "1.1.0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Compare(ctx, old, updated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Manifest == nil || report.Manifest.Change != Changed || report.Manifest.New.Version != "1.1.0" {
+		t.Errorf("Expecting the manifest to change got %#v", report.Manifest)
+	}
+	var assets []string
+	for _, a := range report.Assets {
+		assets = append(assets, a.Change+" "+a.Path)
+	}
+	if expected := []string{"added added.js", "changed index.html", "removed removed.css"}; !reflect.DeepEqual(assets, expected) {
+		t.Errorf("Expecting asset changes %v got %v", expected, assets)
+	}
+	if diff := report.Assets[1].TextDiff; !strings.Contains(diff, "-hello\n+hello world\n") {
+		t.Errorf("Unexpected text diff: %v", diff)
+	}
+	expectedRoutes := []RouteChange{
+		{Route: "/index", Change: Changed, OldMethods: []string{"GET"}, NewMethods: []string{"GET", "POST"}, OldAsset: "codebase/index.lua", NewAsset: "codebase/index.lua"},
+		{Route: "/other", Change: Added, NewMethods: []string{"GET"}, NewAsset: "codebase/other.lua"},
+	}
+	if !reflect.DeepEqual(report.Routes, expectedRoutes) {
+		t.Errorf("Expecting route changes %#v got %#v", expectedRoutes, report.Routes)
+	}
+	if expected := []CodebaseChange{{Path: "codebase/other.lua", Enabled: true}}; !reflect.DeepEqual(report.Codebase, expected) {
+		t.Errorf("Expecting codebase changes %v got %v", expected, report.Codebase)
+	}
+	var tables []string
+	for _, tc := range report.Tables {
+		tables = append(tables, tc.Change+" "+tc.Table)
+	}
+	if expected := []string{"added created", "removed dropped", "changed people"}; !reflect.DeepEqual(tables, expected) {
+		t.Errorf("Expecting table changes %v got %v", expected, tables)
+	}
+	if delta := report.Tables[2].RowDelta(); delta != 1 || report.Tables[2].SchemaChanged {
+		t.Errorf("people should have one more row and the same schema got %#v", report.Tables[2])
+	}
+
+	var text strings.Builder
+	if err := report.WriteText(&text); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{`    + {"name":"test","version":"1.1.0"}`, "  + added.js", "  ~ /index GET|POST -> codebase/index.lua (was GET -> codebase/index.lua)", "  ~ people (1 -> 2 rows, +1)"} {
+		if !strings.Contains(text.String(), line) {
+			t.Errorf("Text output should contain %q got\n%v", line, text.String())
+		}
+	}
+
+	same, err := Compare(ctx, old, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !same.Empty() {
+		t.Errorf("Cassette should not differ from itself, got %#v", same)
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	old := "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\nk\n"
+	updated := "a\nB\nc\nd\ne\nf\ng\nh\ni\nj\nk\nl"
+	expected := `--- old
++++ new
+@@ -1,5 +1,5 @@
+ a
+-b
++B
+ c
+ d
+ e
+@@ -9,3 +9,4 @@
+ i
+ j
+ k
++l
+\ No newline at end of file
+`
+	actual, ok := unifiedDiff("old", "new", old, updated)
+	if !ok {
+		t.Fatal("Diff should be computed")
+	}
+	if actual != expected {
+		t.Fatalf("Expecting diff\n%v\ngot\n%v", expected, actual)
+	}
+}
+
+func TestCompareFTS(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "boombox-tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	old := loadCassette(ctx, t, filepath.Join(dir, "old"))
+	defer old.Close()
+	updated := loadCassette(ctx, t, filepath.Join(dir, "new"))
+	defer updated.Close()
+	for _, c := range []*cassette.Control{old, updated} {
+		importCSV(ctx, t, c, "notes", "region,notes\nnorth,strong wind\n")
+		importCSV(ctx, t, c, "cities", "name\nlisbon\n")
+	}
+	err = old.AddFTS(ctx, "notes", []string{"notes"})
+	if errors.As(err, &cassette.FTSNotSupported{}) {
+		t.Skip("SQLite was built without FTS5, use the sqlite_fts5 build tag")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	for _, idx := range []struct {
+		c       *cassette.Control
+		table   string
+		columns []string
+	}{
+		{updated, "notes", []string{"notes", "region"}},
+		{updated, "cities", []string{"name"}},
+	} {
+		if err := idx.c.AddFTS(ctx, idx.table, idx.columns); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := Compare(ctx, old, updated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []FTSChange{
+		{Table: "cities", Change: Added, NewColumns: []string{"name"}},
+		{Table: "notes", Change: Changed, OldColumns: []string{"notes"}, NewColumns: []string{"notes", "region"}},
+	}
+	if !reflect.DeepEqual(report.FTS, expected) {
+		t.Errorf("Expecting full-text index changes %#v got %#v", expected, report.FTS)
+	}
+	var text strings.Builder
+	if err := report.WriteText(&text); err != nil {
+		t.Fatal(err)
+	}
+	if line := "  ~ notes (notes -> notes, region)"; !strings.Contains(text.String(), line) {
+		t.Errorf("Text output should contain %q got\n%v", line, text.String())
+	}
+}
+
+func loadCassette(ctx context.Context, t *testing.T, tape string) *cassette.Control {
+	c, err := cassette.LoadControlCassette(ctx, tape, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func storeAsset(ctx context.Context, t *testing.T, c *cassette.Control, path, mimetype, content string) {
+	if _, err := c.StoreAsset(ctx, path, mimetype, content); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func importCSV(ctx context.Context, t *testing.T, c *cassette.Control, table, content string) {
+	if _, _, err := c.ImportCSVDataset(ctx, table, strings.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,182 @@
+package diff
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// contextLines is the amount of unchanged lines printed around each change
+	contextLines = 3
+
+	// maxDiffCells limits the size of the table used to compute the
+	// longest common subsequence between two files
+	maxDiffCells = 4_000_000
+)
+
+type (
+	lineOp struct {
+		kind byte
+		text string
+	}
+)
+
+// unifiedDiff computes a unified diff between old and updated,
+// ok is false when the inputs are too large to be compared line by line.
+func unifiedDiff(oldName, newName, old, updated string) (diff string, ok bool) {
+	if old == updated {
+		return "", true
+	}
+	a, b := splitLines(old), splitLines(updated)
+	// lines shared by the start and end of both files do not need to be
+	// part of the table, which keeps small edits on large files cheap
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	middleA, middleB := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	if (len(middleA)+1)*(len(middleB)+1) > maxDiffCells {
+		return "", false
+	}
+	ops := make([]lineOp, 0, len(a)+len(b))
+	for _, l := range a[:prefix] {
+		ops = append(ops, lineOp{' ', l})
+	}
+	ops = append(ops, editScript(middleA, middleB)...)
+	for _, l := range a[len(a)-suffix:] {
+		ops = append(ops, lineOp{' ', l})
+	}
+	return formatUnified(oldName, newName, ops), true
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// editScript returns the operations required to transform a into b,
+// based on the longest common subsequence of both
+func editScript(a, b []string) []lineOp {
+	n, m := len(a), len(b)
+	lcs := make([][]int32, n+1)
+	for i := range lcs {
+		lcs[i] = make([]int32, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	var ops []lineOp
+	i, j := 0, 0
+	for i < n && j < m {
+		switch {
+		case a[i] == b[j]:
+			ops = append(ops, lineOp{' ', a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			ops = append(ops, lineOp{'-', a[i]})
+			i++
+		default:
+			ops = append(ops, lineOp{'+', b[j]})
+			j++
+		}
+	}
+	for ; i < n; i++ {
+		ops = append(ops, lineOp{'-', a[i]})
+	}
+	for ; j < m; j++ {
+		ops = append(ops, lineOp{'+', b[j]})
+	}
+	return ops
+}
+
+func formatUnified(oldName, newName string, ops []lineOp) string {
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "--- %v\n+++ %v\n", oldName, newName)
+	for start := 0; start < len(ops); {
+		// find the next change
+		for start < len(ops) && ops[start].kind == ' ' {
+			start++
+		}
+		if start == len(ops) {
+			break
+		}
+		// extend the hunk while changes are close enough to share context
+		end := start
+		for unchanged := 0; end < len(ops) && unchanged <= 2*contextLines; end++ {
+			if ops[end].kind == ' ' {
+				unchanged++
+			} else {
+				unchanged = 0
+			}
+		}
+		for end > start && ops[end-1].kind == ' ' {
+			end--
+		}
+		hunkStart := start - contextLines
+		if hunkStart < 0 {
+			hunkStart = 0
+		}
+		hunkEnd := end + contextLines
+		if hunkEnd > len(ops) {
+			hunkEnd = len(ops)
+		}
+		oldLine, newLine := 1, 1
+		for _, op := range ops[:hunkStart] {
+			if op.kind != '+' {
+				oldLine++
+			}
+			if op.kind != '-' {
+				newLine++
+			}
+		}
+		oldCount, newCount := 0, 0
+		for _, op := range ops[hunkStart:hunkEnd] {
+			if op.kind != '+' {
+				oldCount++
+			}
+			if op.kind != '-' {
+				newCount++
+			}
+		}
+		fmt.Fprintf(&buf, "@@ -%v +%v @@\n", hunkRange(oldLine, oldCount), hunkRange(newLine, newCount))
+		for _, op := range ops[hunkStart:hunkEnd] {
+			buf.WriteByte(op.kind)
+			buf.WriteString(op.text)
+			if !strings.HasSuffix(op.text, "\n") {
+				buf.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		start = hunkEnd
+	}
+	return buf.String()
+}
+
+func hunkRange(line, count int) string {
+	if count == 0 {
+		// empty ranges point to the line before the change
+		return fmt.Sprintf("%v,0", line-1)
+	}
+	if count == 1 {
+		return fmt.Sprint(line)
+	}
+	return fmt.Sprintf("%v,%v", line, count)
+}
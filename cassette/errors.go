@@ -1,6 +1,9 @@
 package cassette
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 type (
 	InvalidTextContent struct {
@@ -19,6 +22,20 @@ type (
 		Path string
 	}
 
+	VariantNotFound struct {
+		Path     string
+		Encoding string
+	}
+
+	UnsupportedEncoding struct {
+		Encoding string
+	}
+
+	RevisionNotFound struct {
+		Path     string
+		Revision int64
+	}
+
 	CannotQuery struct{}
 
 	QueryError struct {
@@ -27,12 +44,85 @@ type (
 		cause  error
 	}
 
+	// QueryNotAllowed is returned when a query uses a statement
+	// which is rejected by the query policy of the cassette
+	QueryNotAllowed struct {
+		Query  string
+		Reason string
+	}
+
+	// QueryBudgetExceeded is returned when a query is interrupted
+	// because it used more resources than its budget allows
+	QueryBudgetExceeded struct {
+		Query string
+		// Resource is either instructions or duration
+		Resource     string
+		Budget       QueryBudget
+		Instructions int64
+	}
+
+	QueryNotFound struct {
+		Name string
+	}
+
+	// InvalidQuery is returned when a canned query cannot be stored
+	InvalidQuery struct {
+		Name   string
+		Reason string
+	}
+
+	// InvalidQueryParams is returned when the values given to a canned query do not match its parameters
+	InvalidQueryParams struct {
+		Query  string
+		Reason string
+	}
+
+	// FTSNotSupported is returned when SQLite was compiled without FTS5
+	FTSNotSupported struct{}
+
+	FTSIndexNotFound struct {
+		Table string
+	}
+
+	InvalidFTSIndex struct {
+		Table  string
+		Reason string
+	}
+
+	InvalidSearch struct {
+		Table  string
+		Reason string
+	}
+
 	WriteOverflow struct {
 		Total int
 		Max   int
 		Next  int
 	}
 
+	SchemaVersionMismatch struct {
+		Database string
+		Found    int
+		Expected int
+	}
+
+	ManifestNotFound struct{}
+
+	InvalidManifest struct {
+		Reason string
+	}
+
+	UnsignedCassette   struct{}
+	UntrustedSignature struct{}
+	InvalidSignature   struct{}
+
+	// CorruptBlob is returned when the content stored for a blob
+	// does not match its hash
+	CorruptBlob struct {
+		ContentHash string
+		Actual      string
+	}
+
 	ReadonlyCassette  struct{}
 	DatasetNotAllowed struct{}
 
@@ -43,6 +133,36 @@ type (
 	InvalidColumnName struct {
 		Name string
 	}
+
+	InvalidBundle struct {
+		Reason string
+	}
+
+	RouteNotFound struct {
+		Route string
+	}
+
+	TableNotFound struct {
+		Name string
+	}
+
+	InvalidRoute struct {
+		Route  string
+		Reason string
+	}
+
+	RouteConflicts struct {
+		Conflicts []RouteConflict
+	}
+
+	InvalidPage struct {
+		Reason string
+	}
+
+	InvalidRouteOptions struct {
+		Option string
+		Reason string
+	}
 )
 
 func (i InvalidTextContent) Error() string {
@@ -64,6 +184,18 @@ func (a AssetNotFound) Error() string {
 	return fmt.Sprintf("asset %v not found", a.Path)
 }
 
+func (v VariantNotFound) Error() string {
+	return fmt.Sprintf("asset %v does not have a %v variant", v.Path, v.Encoding)
+}
+
+func (u UnsupportedEncoding) Error() string {
+	return fmt.Sprintf("encoding %v is not supported", u.Encoding)
+}
+
+func (r RevisionNotFound) Error() string {
+	return fmt.Sprintf("revision %v of asset %v not found", r.Revision, r.Path)
+}
+
 func (c CannotQuery) Error() string { return "cassette is writable, therefore cannot be queried" }
 
 func (q QueryError) Error() string {
@@ -74,10 +206,79 @@ func (q QueryError) Unwrap() error {
 	return q.cause
 }
 
+func (q QueryNotAllowed) Error() string {
+	return fmt.Sprintf("query not allowed: %v", q.Reason)
+}
+
+func (q QueryBudgetExceeded) Error() string {
+	if q.Resource == "duration" {
+		return fmt.Sprintf("query budget exceeded: query ran for more than %v", q.Budget.Duration)
+	}
+	return fmt.Sprintf("query budget exceeded: query used more than %v instructions", q.Budget.Instructions)
+}
+
+func (q QueryNotFound) Error() string {
+	return fmt.Sprintf("query %v not found", q.Name)
+}
+
+func (i InvalidQuery) Error() string {
+	return fmt.Sprintf("invalid query %v: %v", i.Name, i.Reason)
+}
+
+func (i InvalidQueryParams) Error() string {
+	return fmt.Sprintf("invalid parameters for query %v: %v", i.Query, i.Reason)
+}
+
+func (FTSNotSupported) Error() string {
+	return "full-text search is not supported, boombox must be built with the sqlite_fts5 tag"
+}
+
+func (f FTSIndexNotFound) Error() string {
+	return fmt.Sprintf("table %v does not have a full-text index", f.Table)
+}
+
+func (i InvalidFTSIndex) Error() string {
+	return fmt.Sprintf("invalid full-text index for table %v: %v", i.Table, i.Reason)
+}
+
+func (i InvalidSearch) Error() string {
+	return fmt.Sprintf("invalid search on table %v: %v", i.Table, i.Reason)
+}
+
 func (o WriteOverflow) Error() string {
 	return fmt.Sprintf("output buffer overflow, max: %v, total: %v, next: %v", o.Max, o.Total, o.Next)
 }
 
+func (s SchemaVersionMismatch) Error() string {
+	if s.TooNew() {
+		return fmt.Sprintf("%v uses schema version %v which is newer than the supported version %v", s.Database, s.Found, s.Expected)
+	}
+	return fmt.Sprintf("%v uses schema version %v but version %v is required, run boombox cassette migrate", s.Database, s.Found, s.Expected)
+}
+
+func (s SchemaVersionMismatch) TooOld() bool { return s.Found < s.Expected }
+func (s SchemaVersionMismatch) TooNew() bool { return s.Found > s.Expected }
+
+func (m ManifestNotFound) Error() string { return "cassette does not have a manifest" }
+
+func (i InvalidManifest) Error() string {
+	return fmt.Sprintf("invalid manifest, %v", i.Reason)
+}
+
+func (u UnsignedCassette) Error() string { return "cassette is not signed" }
+
+func (u UntrustedSignature) Error() string {
+	return "cassette is not signed by any of the trusted keys"
+}
+
+func (i InvalidSignature) Error() string {
+	return "cassette signature does not match its content, it might have been tampered with"
+}
+
+func (c CorruptBlob) Error() string {
+	return fmt.Sprintf("content of blob %v does not match its hash, got %v", c.ContentHash, c.Actual)
+}
+
 func (r ReadonlyCassette) Error() string {
 	return "cassette is opened in read-only mode"
 }
@@ -92,3 +293,37 @@ func (r InvalidColumnName) Error() string {
 func (d DatasetNotAllowed) Error() string {
 	return fmt.Sprintf("cassette is not configured as a data cassette")
 }
+
+func (i InvalidBundle) Error() string {
+	return fmt.Sprintf("invalid cassette bundle, %v", i.Reason)
+}
+
+func (r RouteNotFound) Error() string {
+	return fmt.Sprintf("route %v not found", r.Route)
+}
+
+func (t TableNotFound) Error() string {
+	return fmt.Sprintf("table %v not found in the dataset", t.Name)
+}
+
+func (i InvalidRouteOptions) Error() string {
+	return fmt.Sprintf("invalid route option %v, %v", i.Option, i.Reason)
+}
+
+func (i InvalidRoute) Error() string {
+	return fmt.Sprintf("invalid route %v, %v", i.Route, i.Reason)
+}
+
+func (r RouteConflicts) Error() string {
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "found %v route conflict(s):", len(r.Conflicts))
+	for _, c := range r.Conflicts {
+		buf.WriteString("\n\t")
+		buf.WriteString(c.String())
+	}
+	return buf.String()
+}
+
+func (i InvalidPage) Error() string {
+	return fmt.Sprintf("invalid page, %v", i.Reason)
+}
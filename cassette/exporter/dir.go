@@ -0,0 +1,469 @@
+package exporter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/andrebq/boombox/cassette"
+)
+
+type (
+	// ErrUnsafePath is returned when an asset path would be written
+	// outside of the target directory
+	ErrUnsafePath struct {
+		Asset string
+	}
+
+	datasetTable struct {
+		name       string
+		csvFile    string
+		descriptor map[string]interface{}
+		// fts contains the columns of the full-text index, if any
+		fts []string
+	}
+)
+
+const (
+	manifestFile = "cassette.lua"
+	routesFile   = "codebase/routes.lua"
+	queriesFile  = "dataset/queries.lua"
+	datasetDir   = "dataset"
+	datasetFile  = "dataset.lua"
+)
+
+var (
+	reLuaIdentifier = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+func (e ErrUnsafePath) Error() string {
+	return fmt.Sprintf("asset %v cannot be exported as it points outside of the target directory", e.Asset)
+}
+
+// Directory writes the content of source to base, using the same layout
+// expected by importer.Directory.
+//
+// Files which are not stored as assets (cassette.lua, routes.lua, dataset.lua, queries.lua and the CSV files)
+// are generated from the manifest, routes, dataset tables and queries, therefore importing
+// the exported directory produces an equivalent cassette, but those files
+// might not match the ones originally imported.
+func Directory(ctx context.Context, source *cassette.Control, base string) error {
+	err := os.MkdirAll(base, 0755)
+	if err != nil {
+		return fmt.Errorf("unable to create export directory %v, cause %w", base, err)
+	}
+	manifest, err := source.Manifest(ctx)
+	if err == nil {
+		err = writeFile(base, manifestFile, func(w io.Writer) error {
+			return writeManifest(w, manifest)
+		})
+	} else if errors.As(err, &cassette.ManifestNotFound{}) {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+
+	dirs, tables, err := scanDatasets(ctx, source)
+	if err != nil {
+		return err
+	}
+	assets, err := source.ListAssets(ctx)
+	if err != nil {
+		return err
+	}
+	generated := generatedDatasetAssets(dirs, tables)
+	for _, a := range assets {
+		if generated[a] {
+			continue
+		}
+		err = writeFile(base, a, func(w io.Writer) error {
+			_, _, err := source.CopyAsset(ctx, w, a)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	routes, err := source.ListRoutes(ctx)
+	if err != nil {
+		return err
+	}
+	if len(routes) > 0 {
+		err = writeFile(base, routesFile, func(w io.Writer) error {
+			return writeRoutes(w, routes)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for dir, dt := range tables {
+		for _, t := range dt {
+			err = writeFile(base, path.Join(dir, t.csvFile), func(w io.Writer) error {
+				_, err := source.ExportCSVDataset(ctx, t.name, w)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+		}
+		err = writeFile(base, path.Join(dir, datasetFile), func(w io.Writer) error {
+			return writeDataset(w, dt)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	queries, err := source.ListQueries(ctx)
+	if err != nil {
+		return err
+	}
+	if len(queries) > 0 {
+		err = writeFile(base, queriesFile, func(w io.Writer) error {
+			return writeQueries(w, queries)
+		})
+	}
+	return err
+}
+
+// scanDatasets groups dataset tables by the directory which contains their descriptor,
+// tables without a descriptor are placed in the default dataset directory.
+func scanDatasets(ctx context.Context, source *cassette.Control) (map[string]bool, map[string][]datasetTable, error) {
+	assets, err := source.ListAssets(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	dirs := map[string]bool{}
+	for _, a := range assets {
+		if strings.HasPrefix(a, datasetDir+"/") && path.Base(a) == datasetFile {
+			dirs[path.Dir(a)] = true
+		}
+	}
+	list, err := source.ListDatasetTables(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	indexes, err := source.ListFTS(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	fts := map[string][]string{}
+	for _, idx := range indexes {
+		fts[idx.Table] = idx.Columns
+	}
+	tables := map[string][]datasetTable{}
+	usedFiles := map[string]bool{}
+	for _, dt := range list {
+		t := datasetTable{name: dt.Name, fts: fts[dt.Name]}
+		dir := datasetDir
+		for d := range dirs {
+			descriptor, err := loadDescriptor(ctx, source, path.Join(d, dt.Name+".json"))
+			if err != nil {
+				return nil, nil, err
+			}
+			if descriptor != nil {
+				dir, t.descriptor = d, descriptor
+				break
+			}
+		}
+		if src, ok := t.descriptor["importedFromFile"].(string); ok && path.Ext(src) == ".csv" && !strings.Contains(src, "..") {
+			t.csvFile = src
+		}
+		if t.csvFile == "" || usedFiles[path.Join(dir, t.csvFile)] {
+			t.csvFile = dt.Name + ".csv"
+		}
+		usedFiles[path.Join(dir, t.csvFile)] = true
+		tables[dir] = append(tables[dir], t)
+		dirs[dir] = true
+	}
+	return dirs, tables, nil
+}
+
+func loadDescriptor(ctx context.Context, source *cassette.Control, assetPath string) (map[string]interface{}, error) {
+	var buf bytes.Buffer
+	_, _, err := source.CopyAsset(ctx, &buf, assetPath)
+	if errors.As(err, &cassette.AssetNotFound{}) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var descriptor map[string]interface{}
+	err = json.Unmarshal(buf.Bytes(), &descriptor)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode dataset descriptor %v, cause %w", assetPath, err)
+	}
+	return descriptor, nil
+}
+
+// generatedDatasetAssets returns the assets which are created by importer.Directory
+// when it processes a dataset.lua file: the file itself and the descriptor of each table,
+// any other asset under a dataset directory is exported as is.
+func generatedDatasetAssets(dirs map[string]bool, tables map[string][]datasetTable) map[string]bool {
+	generated := map[string]bool{}
+	for dir := range dirs {
+		generated[path.Join(dir, datasetFile)] = true
+	}
+	for dir, dt := range tables {
+		for _, t := range dt {
+			if t.descriptor != nil {
+				generated[path.Join(dir, t.name+".json")] = true
+			}
+		}
+	}
+	return generated
+}
+
+func writeFile(base string, assetPath string, fn func(io.Writer) error) error {
+	if assetPath == ".." || strings.HasPrefix(assetPath, "../") || path.IsAbs(assetPath) {
+		return ErrUnsafePath{Asset: assetPath}
+	}
+	target := filepath.Join(base, filepath.FromSlash(assetPath))
+	err := os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return fmt.Errorf("unable to export %v, cause %w", assetPath, err)
+	}
+	fd, err := os.Create(target)
+	if err != nil {
+		return fmt.Errorf("unable to export %v, cause %w", assetPath, err)
+	}
+	err = fn(fd)
+	if closeErr := fd.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("unable to export %v, cause %w", assetPath, err)
+	}
+	return nil
+}
+
+func writeManifest(w io.Writer, m cassette.Manifest) error {
+	fields := map[string]interface{}{"name": m.Name}
+	for k, v := range map[string]string{
+		"title":       m.Title,
+		"description": m.Description,
+		"license":     m.License,
+		"version":     m.Version,
+	} {
+		if v != "" {
+			fields[k] = v
+		}
+	}
+	if len(m.Authors) > 0 {
+		fields["authors"] = stringList(m.Authors)
+	}
+	if q := m.Query; q != nil {
+		policy := map[string]interface{}{}
+		if len(q.Pragmas) > 0 {
+			policy["pragmas"] = stringList(q.Pragmas)
+		}
+		if len(q.DenyFunctions) > 0 {
+			policy["deny_functions"] = stringList(q.DenyFunctions)
+		}
+		if q.TempTables {
+			policy["temp_tables"] = true
+		}
+		if q.MaxInstructions > 0 {
+			policy["max_instructions"] = float64(q.MaxInstructions)
+		}
+		if q.MaxDuration > 0 {
+			policy["max_duration"] = q.MaxDuration.String()
+		}
+		fields["query"] = policy
+	}
+	_, err := fmt.Fprintf(w, "manifest(%v)\n", luaValue(fields, ""))
+	return err
+}
+
+func stringList(values []string) []interface{} {
+	out := make([]interface{}, len(values))
+	for i, v := range values {
+		out[i] = v
+	}
+	return out
+}
+
+func writeRoutes(w io.Writer, routes []cassette.Code) error {
+	for _, r := range routes {
+		_, err := fmt.Fprintf(w, "add_route(%v, %v, %v", luaString(r.Route), luaString(strings.Join(r.Methods, "|")), luaString(r.Asset))
+		if err == nil && !r.Options.IsZero() {
+			_, err = fmt.Fprintf(w, ", %v", luaValue(routeOptions(r.Options), ""))
+		}
+		if err == nil {
+			_, err = io.WriteString(w, ")\n")
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// routeOptions converts the options back to the table accepted by add_route
+func routeOptions(opts cassette.RouteOptions) map[string]interface{} {
+	out := map[string]interface{}{}
+	if opts.Timeout > 0 {
+		out["timeout"] = opts.Timeout.String()
+	}
+	if opts.MaxBody > 0 {
+		out["max_body"] = float64(opts.MaxBody)
+	}
+	if opts.Cache != "" {
+		out["cache"] = opts.Cache
+	}
+	if opts.ContentType != "" {
+		out["content_type"] = opts.ContentType
+	}
+	return out
+}
+
+func writeQueries(w io.Writer, queries []cassette.CannedQuery) error {
+	for i, q := range queries {
+		if i > 0 {
+			if _, err := io.WriteString(w, "\n"); err != nil {
+				return err
+			}
+		}
+		params := map[string]interface{}{}
+		for _, p := range q.Params {
+			if !p.Required && p.Default == "" && p.Description == "" {
+				params[p.Name] = p.Type
+				continue
+			}
+			spec := map[string]interface{}{"type": p.Type}
+			if p.Required {
+				spec["required"] = true
+			}
+			if p.Default != "" {
+				spec["default"] = p.Default
+			}
+			if p.Description != "" {
+				spec["description"] = p.Description
+			}
+			params[p.Name] = spec
+		}
+		_, err := fmt.Fprintf(w, "add_query(%v, %v, %v", luaString(q.Name), luaString(q.SQL), luaValue(params, ""))
+		if err == nil && q.Description != "" {
+			_, err = fmt.Fprintf(w, ", %v", luaValue(map[string]interface{}{"description": q.Description}, ""))
+		}
+		if err == nil {
+			_, err = io.WriteString(w, ")\n")
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeDataset(w io.Writer, tables []datasetTable) error {
+	for i, t := range tables {
+		if i > 0 {
+			if _, err := io.WriteString(w, "\n"); err != nil {
+				return err
+			}
+		}
+		descriptor := map[string]interface{}{}
+		for k, v := range t.descriptor {
+			// both fields are computed by the importer
+			if k == "ddl" || k == "importedFromFile" {
+				continue
+			}
+			descriptor[k] = v
+		}
+		_, err := fmt.Fprintf(w, "add_datasource(%v, %v)\n\nload_csv(%v, %v)\n",
+			luaString(t.csvFile), luaValue(descriptor, ""), luaString(t.csvFile), luaString(t.name))
+		if err == nil && len(t.fts) > 0 {
+			_, err = fmt.Fprintf(w, "\nadd_fts(%v, %v)\n", luaString(t.name), luaValue(stringList(t.fts), ""))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// luaValue returns the Lua literal of a JSON-like value,
+// tables are written one field per line using indent as the base indentation
+func luaValue(v interface{}, indent string) string {
+	switch v := v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case string:
+		return luaString(v)
+	case []interface{}:
+		if len(v) == 0 {
+			return "{}"
+		}
+		items := make([]string, len(v))
+		for i, item := range v {
+			items[i] = luaValue(item, indent)
+		}
+		return "{" + strings.Join(items, ", ") + "}"
+	case map[string]interface{}:
+		if len(v) == 0 {
+			return "{}"
+		}
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var buf strings.Builder
+		buf.WriteString("{\n")
+		for i, k := range keys {
+			buf.WriteString(indent + "  ")
+			if reLuaIdentifier.MatchString(k) {
+				buf.WriteString(k)
+			} else {
+				buf.WriteString("[" + luaString(k) + "]")
+			}
+			buf.WriteString(" = ")
+			buf.WriteString(luaValue(v[k], indent+"  "))
+			if i < len(keys)-1 {
+				buf.WriteString(",")
+			}
+			buf.WriteString("\n")
+		}
+		buf.WriteString(indent + "}")
+		return buf.String()
+	}
+	return luaString(fmt.Sprint(v))
+}
+
+// luaString quotes s as a Lua string literal, escaping control characters
+func luaString(s string) string {
+	var buf strings.Builder
+	buf.WriteByte('\'')
+	for i := 0; i < len(s); i++ {
+		switch ch := s[i]; {
+		case ch == '\\' || ch == '\'':
+			buf.WriteByte('\\')
+			buf.WriteByte(ch)
+		case ch == '\n':
+			buf.WriteString(`\n`)
+		case ch < 0x20 || ch == 0x7f:
+			fmt.Fprintf(&buf, `\%03d`, ch)
+		default:
+			buf.WriteByte(ch)
+		}
+	}
+	buf.WriteByte('\'')
+	return buf.String()
+}
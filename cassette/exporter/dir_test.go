@@ -0,0 +1,126 @@
+package exporter
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/andrebq/boombox/cassette"
+	"github.com/andrebq/boombox/cassette/importer"
+)
+
+func TestExportDirectory(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "boombox-tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	original := loadCassette(ctx, t, filepath.Join(dir, "original"))
+	defer original.Close()
+	err = importer.Directory(ctx, original, filepath.Join("..", "importer", "testdata", "fixtures", "test-cassette"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only the descriptors of dataset tables are generated by the importer
+	_, err = original.StoreAsset(ctx, "dataset/schema.json", "application/json", `{"type":"object"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// full-text indexes are only exported when SQLite supports them
+	err = original.AddFTS(ctx, "wind", []string{"utc_timestamp"})
+	if err != nil && !errors.As(err, &cassette.FTSNotSupported{}) {
+		t.Fatal(err)
+	}
+	exportDir := filepath.Join(dir, "exported")
+	err = Directory(ctx, original, exportDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"cassette.lua", "codebase/routes.lua", "dataset/dataset.lua", "dataset/germany-wind-energy.csv", "dataset/schema.json"} {
+		if _, err := os.Stat(filepath.Join(exportDir, filepath.FromSlash(f))); err != nil {
+			t.Fatalf("File %v should have been exported, got %v", f, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(exportDir, "dataset", "wind.json")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Descriptor of table wind should not be exported, got %v", err)
+	}
+	// the importer only reads the files listed by dataset.lua,
+	// so other assets under dataset directories do not survive a round-trip
+	err = original.DeleteAsset(ctx, "dataset/schema.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reimported := loadCassette(ctx, t, filepath.Join(dir, "reimported"))
+	defer reimported.Close()
+	err = importer.Directory(ctx, reimported, exportDir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, check := range []struct {
+		name string
+		fn   func(*cassette.Control) (interface{}, error)
+	}{
+		{"assets", func(c *cassette.Control) (interface{}, error) { return c.ListAssets(ctx) }},
+		{"routes", func(c *cassette.Control) (interface{}, error) { return c.ListRoutes(ctx) }},
+		{"manifest", func(c *cassette.Control) (interface{}, error) { return c.Manifest(ctx) }},
+		{"tables", func(c *cassette.Control) (interface{}, error) { return c.ListDatasetTables(ctx) }},
+		{"queries", func(c *cassette.Control) (interface{}, error) { return c.ListQueries(ctx) }},
+		{"fts", func(c *cassette.Control) (interface{}, error) { return c.ListFTS(ctx) }},
+		{"wind", func(c *cassette.Control) (interface{}, error) {
+			var buf bytes.Buffer
+			_, err := c.ExportCSVDataset(ctx, "wind", &buf)
+			return buf.String(), err
+		}},
+		{"static", func(c *cassette.Control) (interface{}, error) {
+			var buf bytes.Buffer
+			_, _, err := c.CopyAsset(ctx, &buf, "index.html")
+			return buf.String(), err
+		}},
+	} {
+		expected, err := check.fn(original)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual, err := check.fn(reimported)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(expected, actual) {
+			t.Errorf("Exported %v should be %#v got %#v", check.name, expected, actual)
+		}
+	}
+}
+
+func TestLuaString(t *testing.T) {
+	for _, tc := range []struct {
+		input  string
+		output string
+	}{
+		{"abc", `'abc'`},
+		{"it's", `'it\'s'`},
+		{`a\b`, `'a\\b'`},
+		{"line\nbreak", `'line\nbreak'`},
+		{"tab\t", `'tab\009'`},
+	} {
+		if actual := luaString(tc.input); actual != tc.output {
+			t.Errorf("%q should be quoted as %v got %v", tc.input, tc.output, actual)
+		}
+	}
+}
+
+func loadCassette(ctx context.Context, t *testing.T, tape string) *cassette.Control {
+	c, err := cassette.LoadControlCassette(ctx, tape, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
@@ -0,0 +1,398 @@
+package cassette
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+const (
+	ProblemOrphanRoute      = "orphan-route"
+	ProblemInvalidCodebase  = "invalid-codebase"
+	ProblemPathHash         = "path-hash-mismatch"
+	ProblemInvalidUTF8      = "invalid-utf8"
+	ProblemUTF8Flag         = "utf8-flag-mismatch"
+	ProblemBlobHash         = "blob-hash-mismatch"
+	ProblemOrphanDescriptor = "orphan-descriptor"
+	ProblemIntegrity        = "integrity-check"
+	ProblemForeignKey       = "foreign-key-check"
+)
+
+type (
+	// Problem is an inconsistency found by Fsck
+	Problem struct {
+		Kind     string
+		Database string
+		// Subject identifies what is broken (an asset path, a route, a table...)
+		Subject string
+		Detail  string
+		// Repaired is true if the problem was fixed by Fsck
+		Repaired bool
+	}
+
+	fsckCheck func(ctx context.Context, repair bool) ([]Problem, error)
+)
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%v: %v %v: %v", p.Database, p.Kind, p.Subject, p.Detail)
+}
+
+// Fsck checks the consistency of the cassette and returns all problems found,
+// when repair is true, problems which can be fixed safely are repaired.
+//
+// Problems reported by sqlite itself (integrity_check and foreign_key_check)
+// and blobs which do not match their hash are never repaired. Dataset checks are skipped if the cassette
+// was opened without its dataset.
+func (c *Control) Fsck(ctx context.Context, repair bool) ([]Problem, error) {
+	if repair && !c.writeable {
+		return nil, ReadonlyCassette{}
+	}
+	var problems []Problem
+	// codebase is checked before routes, so routes pointing to
+	// removed codebase entries are detected in the same run
+	for _, check := range []fsckCheck{
+		c.fsckCodebase,
+		c.fsckRoutes,
+		c.fsckPathHashes,
+		c.fsckUTF8,
+		c.fsckBlobs,
+		c.fsckDescriptors,
+		c.fsckSqlite,
+	} {
+		found, err := check(ctx, repair)
+		if err != nil {
+			return problems, err
+		}
+		problems = append(problems, found...)
+	}
+	return problems, nil
+}
+
+func (c *Control) fsckCodebase(ctx context.Context, repair bool) ([]Problem, error) {
+	rows, err := c.db.QueryContext(ctx, `select c.asset_id, a.path, a.mime_type from codebase c
+	left join assets a on c.asset_id = a.asset_id
+	order by c.asset_id asc`)
+	if err != nil {
+		return nil, fmt.Errorf("unable to check codebase, cause %w", err)
+	}
+	var problems []Problem
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		var assetPath, mt sql.NullString
+		err = rows.Scan(&id, &assetPath, &mt)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("unable to check codebase, cause %w", err)
+		}
+		p := Problem{Kind: ProblemInvalidCodebase, Database: "k7.db", Subject: assetPath.String}
+		switch {
+		case !assetPath.Valid:
+			p.Subject, p.Detail = fmt.Sprintf("asset %v", id), "asset does not exist"
+		case c.validCodebasePath(assetPath.String) != nil:
+			p.Detail = "codebase assets must be lua files stored under codebase/"
+		case mt.String != "text/x-lua" && mt.String != "application/x-lua":
+			p.Detail = fmt.Sprintf("mime-type %v is not a lua mime-type", mt.String)
+		default:
+			continue
+		}
+		problems = append(problems, p)
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("unable to check codebase, cause %w", err)
+	}
+	if repair {
+		for i, id := range ids {
+			_, err = c.db.ExecContext(ctx, `delete from codebase where asset_id = ?`, id)
+			if err != nil {
+				return problems, fmt.Errorf("unable to remove %v from codebase, cause %w", problems[i].Subject, err)
+			}
+			problems[i].Repaired = true
+		}
+	}
+	return problems, nil
+}
+
+func (c *Control) fsckRoutes(ctx context.Context, repair bool) ([]Problem, error) {
+	rows, err := c.db.QueryContext(ctx, `select r.route, r.asset_id from routes r
+	left join codebase c on r.asset_id = c.asset_id
+	where c.asset_id is null
+	order by r.route asc`)
+	if err != nil {
+		return nil, fmt.Errorf("unable to check routes, cause %w", err)
+	}
+	var problems []Problem
+	for rows.Next() {
+		var route string
+		var id sql.NullInt64
+		err = rows.Scan(&route, &id)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("unable to check routes, cause %w", err)
+		}
+		problems = append(problems, Problem{
+			Kind:     ProblemOrphanRoute,
+			Database: "k7.db",
+			Subject:  route,
+			Detail:   fmt.Sprintf("asset %v is not part of the codebase", id.Int64),
+		})
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("unable to check routes, cause %w", err)
+	}
+	if repair {
+		for i := range problems {
+			_, err = c.db.ExecContext(ctx, `delete from routes where route = ?`, problems[i].Subject)
+			if err != nil {
+				return problems, fmt.Errorf("unable to remove route %v, cause %w", problems[i].Subject, err)
+			}
+			problems[i].Repaired = true
+		}
+	}
+	return problems, nil
+}
+
+func (c *Control) fsckPathHashes(ctx context.Context, repair bool) ([]Problem, error) {
+	rows, err := c.db.QueryContext(ctx, `select asset_id, path, path_hash64 from assets order by path asc`)
+	if err != nil {
+		return nil, fmt.Errorf("unable to check path hashes, cause %w", err)
+	}
+	var problems []Problem
+	var ids []int64
+	var hashes []int64
+	for rows.Next() {
+		var id, stored int64
+		var assetPath string
+		err = rows.Scan(&id, &assetPath, &stored)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("unable to check path hashes, cause %w", err)
+		}
+		if expected := int64(xxhash.Sum64String(assetPath)); expected != stored {
+			problems = append(problems, Problem{
+				Kind:     ProblemPathHash,
+				Database: "k7.db",
+				Subject:  assetPath,
+				Detail:   fmt.Sprintf("path_hash64 is %v expected %v", stored, expected),
+			})
+			ids = append(ids, id)
+			hashes = append(hashes, expected)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("unable to check path hashes, cause %w", err)
+	}
+	if repair {
+		for i, id := range ids {
+			_, err = c.db.ExecContext(ctx, `update assets set path_hash64 = ? where asset_id = ?`, hashes[i], id)
+			if err != nil {
+				return problems, fmt.Errorf("unable to fix path hash of %v, cause %w", problems[i].Subject, err)
+			}
+			problems[i].Repaired = true
+		}
+	}
+	return problems, nil
+}
+
+func (c *Control) fsckUTF8(ctx context.Context, repair bool) ([]Problem, error) {
+	type textAsset struct {
+		path        string
+		mimetype    string
+		contentHash string
+		utf8        bool
+	}
+	rows, err := c.db.QueryContext(ctx, `select a.path, a.mime_type, a.content_hash, b.utf8 from assets a
+	inner join blobs b on a.content_hash = b.content_hash
+	order by a.path asc`)
+	if err != nil {
+		return nil, fmt.Errorf("unable to check utf-8 content, cause %w", err)
+	}
+	var assets []textAsset
+	for rows.Next() {
+		var a textAsset
+		err = rows.Scan(&a.path, &a.mimetype, &a.contentHash, &a.utf8)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("unable to check utf-8 content, cause %w", err)
+		}
+		if IsTextMimeType(a.mimetype) {
+			assets = append(assets, a)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("unable to check utf-8 content, cause %w", err)
+	}
+	var problems []Problem
+	for _, a := range assets {
+		var validator utf8Validator
+		err = c.copyBlob(ctx, c.db, &validator, a.contentHash)
+		if err != nil {
+			return problems, fmt.Errorf("unable to read content of %v, cause %w", a.path, err)
+		}
+		valid := validator.Valid()
+		if !valid {
+			problems = append(problems, Problem{
+				Kind:     ProblemInvalidUTF8,
+				Database: "k7.db",
+				Subject:  a.path,
+				Detail:   fmt.Sprintf("content is not valid utf-8 but mime-type is %v", a.mimetype),
+			})
+		}
+		if valid == a.utf8 {
+			continue
+		}
+		p := Problem{
+			Kind:     ProblemUTF8Flag,
+			Database: "k7.db",
+			Subject:  a.path,
+			Detail:   fmt.Sprintf("blob %v is flagged with utf8=%v", a.contentHash, a.utf8),
+		}
+		if repair {
+			_, err = c.db.ExecContext(ctx, `update blobs set utf8 = ? where content_hash = ?`, valid, a.contentHash)
+			if err != nil {
+				return problems, fmt.Errorf("unable to fix utf8 flag of %v, cause %w", a.path, err)
+			}
+			p.Repaired = true
+		}
+		problems = append(problems, p)
+	}
+	return problems, nil
+}
+
+func (c *Control) fsckBlobs(ctx context.Context, repair bool) ([]Problem, error) {
+	hashes, err := queryStrings(ctx, c.db, `select content_hash from blobs order by content_hash asc`)
+	if err != nil {
+		return nil, fmt.Errorf("unable to check blobs, cause %w", err)
+	}
+	var problems []Problem
+	for _, expected := range hashes {
+		actual, err := c.blobHash(ctx, c.db, expected)
+		if err != nil {
+			return problems, err
+		}
+		if actual == expected {
+			continue
+		}
+		problems = append(problems, Problem{
+			Kind:     ProblemBlobHash,
+			Database: "k7.db",
+			Subject:  fmt.Sprintf("blob %v", expected),
+			Detail:   fmt.Sprintf("content hashes to %v", actual),
+		})
+	}
+	return problems, nil
+}
+
+func (c *Control) fsckDescriptors(ctx context.Context, repair bool) ([]Problem, error) {
+	if c.datadb == nil {
+		return nil, nil
+	}
+	tables, err := c.datasetTables(ctx)
+	if err != nil {
+		return nil, err
+	}
+	existing := map[string]bool{}
+	for _, t := range tables {
+		existing[t.Name] = true
+	}
+	descriptors, err := c.datasetDescriptors(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var problems []Problem
+	for _, d := range descriptors {
+		if existing[d.table] {
+			continue
+		}
+		p := Problem{
+			Kind:     ProblemOrphanDescriptor,
+			Database: "k7.db",
+			Subject:  d.path,
+			Detail:   fmt.Sprintf("table %v does not exist in the dataset", d.table),
+		}
+		if repair {
+			err = c.DeleteAsset(ctx, d.path)
+			if err != nil {
+				return problems, err
+			}
+			p.Repaired = true
+		}
+		problems = append(problems, p)
+	}
+	return problems, nil
+}
+
+func (c *Control) fsckSqlite(ctx context.Context, repair bool) ([]Problem, error) {
+	type target struct {
+		name   string
+		db     dbtx
+		schema string
+	}
+	targets := []target{{"k7.db", c.db, "main."}}
+	if c.datadb != nil {
+		targets = append(targets, target{"datak7.db", c.datadb, ""})
+	}
+	var problems []Problem
+	for _, t := range targets {
+		messages, err := queryStrings(ctx, t.db, fmt.Sprintf(`pragma %vintegrity_check`, t.schema))
+		if err != nil {
+			return problems, fmt.Errorf("unable to run integrity_check on %v, cause %w", t.name, err)
+		}
+		for _, m := range messages {
+			if m == "ok" {
+				continue
+			}
+			problems = append(problems, Problem{Kind: ProblemIntegrity, Database: t.name, Subject: "database", Detail: m})
+		}
+		rows, err := t.db.QueryContext(ctx, fmt.Sprintf(`pragma %vforeign_key_check`, t.schema))
+		if err != nil {
+			return problems, fmt.Errorf("unable to run foreign_key_check on %v, cause %w", t.name, err)
+		}
+		for rows.Next() {
+			var table, parent string
+			var rowid sql.NullInt64
+			var fkid int64
+			err = rows.Scan(&table, &rowid, &parent, &fkid)
+			if err != nil {
+				rows.Close()
+				return problems, fmt.Errorf("unable to run foreign_key_check on %v, cause %w", t.name, err)
+			}
+			problems = append(problems, Problem{
+				Kind:     ProblemForeignKey,
+				Database: t.name,
+				Subject:  table,
+				Detail:   fmt.Sprintf("row %v references a missing entry in %v", rowid.Int64, parent),
+			})
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return problems, fmt.Errorf("unable to run foreign_key_check on %v, cause %w", t.name, err)
+		}
+	}
+	return problems, nil
+}
+
+func queryStrings(ctx context.Context, db dbtx, query string, args ...interface{}) ([]string, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []string
+	for rows.Next() {
+		var s string
+		err = rows.Scan(&s)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, s)
+	}
+	return out, rows.Err()
+}
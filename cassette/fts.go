@@ -0,0 +1,272 @@
+package cassette
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// ftsSuffix is appended to the name of a table to name its full-text index
+	ftsSuffix = "_fts"
+
+	DefaultSearchLimit = 20
+	MaxSearchLimit     = 1000
+
+	// snippetTokens is the maximum number of tokens returned by snippet,
+	// matches are highlighted with <mark>
+	snippetTokens = 16
+)
+
+type (
+	// FTSIndex is a full-text (FTS5) index over text columns of a dataset table,
+	// the index uses the table as its content, so text is not stored twice
+	FTSIndex struct {
+		Table   string   `json:"table"`
+		Columns []string `json:"columns"`
+	}
+
+	// Search is a full-text search over the index of a table
+	Search struct {
+		// Text contains the terms which must be present in the results,
+		// when Raw is true, Text uses the FTS5 query syntax instead
+		Text string
+		Raw  bool
+		// Limit is the maximum number of results, defaults to DefaultSearchLimit
+		Limit int
+	}
+)
+
+// ftsSupported returns true when the SQLite library was compiled with FTS5
+func ftsSupported(ctx context.Context, db dbtx) (bool, error) {
+	var supported bool
+	err := db.QueryRowContext(ctx, `select sqlite_compileoption_used('ENABLE_FTS5')`).Scan(&supported)
+	if err != nil {
+		return false, fmt.Errorf("unable to check support for fts5, cause %w", err)
+	}
+	return supported, nil
+}
+
+// checkFTS returns FTSNotSupported when the dataset has full-text indexes
+// which cannot be used by this build, so it fails when the cassette is loaded
+// instead of when it is searched.
+func (c *Control) checkFTS(ctx context.Context) error {
+	var indexes int
+	err := c.datadb.QueryRowContext(ctx, `select count(*) from fts_indexes`).Scan(&indexes)
+	if err != nil {
+		return fmt.Errorf("unable to list full-text indexes, cause %w", err)
+	}
+	if indexes == 0 {
+		return nil
+	}
+	supported, err := ftsSupported(ctx, c.datadb)
+	if err != nil {
+		return err
+	}
+	if !supported {
+		return FTSNotSupported{}
+	}
+	return nil
+}
+
+// AddFTS creates the full-text index of table over columns, replacing the
+// previous index of the table. The SQLite library must be compiled with FTS5
+// (build tag sqlite_fts5), otherwise FTSNotSupported is returned.
+func (c *Control) AddFTS(ctx context.Context, table string, columns []string) error {
+	if !c.writeable {
+		return ReadonlyCassette{}
+	}
+	if c.datadb == nil {
+		return DatasetNotAllowed{}
+	}
+	if err := validDatasetTable(table); err != nil {
+		return err
+	}
+	if len(columns) == 0 {
+		return InvalidFTSIndex{Table: table, Reason: "at least one column is required"}
+	}
+	supported, err := ftsSupported(ctx, c.datadb)
+	if err != nil {
+		return err
+	}
+	if !supported {
+		return FTSNotSupported{}
+	}
+	tableColumns := map[string]bool{}
+	rows, err := c.datadb.QueryContext(ctx, `select name from pragma_table_info(?)`, table)
+	if err != nil {
+		return fmt.Errorf("unable to inspect table %v, cause %w", table, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return fmt.Errorf("unable to inspect table %v, cause %w", table, err)
+		}
+		tableColumns[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("unable to inspect table %v, cause %w", table, err)
+	}
+	if len(tableColumns) == 0 {
+		return TableNotFound{Name: table}
+	}
+	for _, col := range columns {
+		if err := validDatasetColumn(col); err != nil {
+			return err
+		}
+		if !tableColumns[col] {
+			return InvalidFTSIndex{Table: table, Reason: fmt.Sprintf("column %v does not exist", col)}
+		}
+	}
+	index := table + ftsSuffix
+	tables, err := c.datasetTables(ctx)
+	if err != nil {
+		return err
+	}
+	for _, t := range tables {
+		if t.Name == index {
+			return InvalidFTSIndex{Table: table, Reason: fmt.Sprintf("table %v already exists", index)}
+		}
+	}
+	encodedColumns, err := json.Marshal(columns)
+	if err != nil {
+		return fmt.Errorf("unable to encode columns of index %v, cause %w", index, err)
+	}
+
+	tx, err := c.datadb.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("unable to create index %v, cause %w", index, err)
+	}
+	defer tx.Rollback()
+	for _, stmt := range []string{
+		fmt.Sprintf(`drop table if exists %v`, index),
+		fmt.Sprintf(`create virtual table %v using fts5(%v, content='%v', content_rowid='rowid')`, index, strings.Join(columns, ", "), table),
+		fmt.Sprintf(`insert into %v(%v) values('rebuild')`, index, index),
+	} {
+		_, err = tx.ExecContext(ctx, stmt)
+		if err != nil {
+			return fmt.Errorf("unable to create index %v, cause %w", index, err)
+		}
+	}
+	_, err = tx.ExecContext(ctx, `insert into fts_indexes(name, source, columns) values (?, ?, ?)
+	on conflict (name) do update set columns = EXCLUDED.columns`, index, table, string(encodedColumns))
+	if err != nil {
+		return fmt.Errorf("unable to register index %v, cause %w", index, err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("unable to create index %v, cause %w", index, err)
+	}
+	return nil
+}
+
+// ListFTS returns the full-text indexes of the dataset, ordered by table
+func (c *Control) ListFTS(ctx context.Context) ([]FTSIndex, error) {
+	if c.datadb == nil {
+		return nil, DatasetNotAllowed{}
+	}
+	rows, err := c.datadb.QueryContext(ctx, `select source, columns from fts_indexes order by source asc`)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list fts indexes, cause %w", err)
+	}
+	defer rows.Close()
+	out := []FTSIndex{}
+	for rows.Next() {
+		var idx FTSIndex
+		var columns string
+		err = rows.Scan(&idx.Table, &columns)
+		if err != nil {
+			return nil, fmt.Errorf("unable to scan fts index, cause %w", err)
+		}
+		err = json.Unmarshal([]byte(columns), &idx.Columns)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode columns of fts index %v, cause %w", idx.Table, err)
+		}
+		out = append(out, idx)
+	}
+	return out, rows.Err()
+}
+
+// SearchQuery returns the query which searches the index of table, ordered by rank.
+//
+// Each row contains the rowid, the rank (lower is better), a snippet of the best matching column
+// with the terms wrapped in <mark></mark> and the columns of the table.
+// The snippet is not escaped, so it must not be used as HTML directly.
+func (c *Control) SearchQuery(ctx context.Context, table string, s Search) (string, []interface{}, error) {
+	if c.datadb == nil {
+		return "", nil, DatasetNotAllowed{}
+	}
+	if err := validDatasetTable(table); err != nil {
+		return "", nil, err
+	}
+	var index string
+	err := c.datadb.QueryRowContext(ctx, `select name from fts_indexes where source = ?`, table).Scan(&index)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil, FTSIndexNotFound{Table: table}
+	} else if err != nil {
+		return "", nil, fmt.Errorf("unable to find index of %v, cause %w", table, err)
+	}
+	text := s.Text
+	if !s.Raw {
+		terms := strings.Fields(text)
+		for i, t := range terms {
+			terms[i] = `"` + strings.ReplaceAll(t, `"`, `""`) + `"`
+		}
+		text = strings.Join(terms, " ")
+	}
+	if strings.TrimSpace(text) == "" {
+		return "", nil, InvalidSearch{Table: table, Reason: "search text cannot be empty"}
+	}
+	limit := s.Limit
+	if limit <= 0 {
+		limit = DefaultSearchLimit
+	} else if limit > MaxSearchLimit {
+		limit = MaxSearchLimit
+	}
+	query := fmt.Sprintf(`select t.rowid as rowid, %[1]v.rank as rank, snippet(%[1]v, -1, '<mark>', '</mark>', '…', %[3]v) as snippet, t.*
+	from dataset.%[1]v inner join dataset.%[2]v t on t.rowid = %[1]v.rowid
+	where %[1]v match :text order by %[1]v.rank limit :limit`, index, table, snippetTokens)
+	return query, []interface{}{sql.Named("text", text), sql.Named("limit", limit)}, nil
+}
+
+// rebuildFTS updates the indexes of table after its content changed
+func (c *Control) rebuildFTS(ctx context.Context, table string) error {
+	rows, err := c.datadb.QueryContext(ctx, `select name from fts_indexes where source = ?`, table)
+	if err != nil {
+		return fmt.Errorf("unable to find indexes of %v, cause %w", table, err)
+	}
+	var indexes []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return fmt.Errorf("unable to find indexes of %v, cause %w", table, err)
+		}
+		indexes = append(indexes, name)
+	}
+	rows.Close()
+	for _, index := range indexes {
+		_, err = c.datadb.ExecContext(ctx, fmt.Sprintf(`insert into %v(%v) values('rebuild')`, index, index))
+		if err != nil {
+			return fmt.Errorf("unable to rebuild index %v, cause %w", index, err)
+		}
+	}
+	return nil
+}
+
+// dropFTS removes the indexes of table
+func (c *Control) dropFTS(ctx context.Context, table string) error {
+	_, err := c.datadb.ExecContext(ctx, fmt.Sprintf(`drop table if exists %v`, table+ftsSuffix))
+	if err != nil {
+		return fmt.Errorf("unable to drop index of %v, cause %w", table, err)
+	}
+	_, err = c.datadb.ExecContext(ctx, `delete from fts_indexes where source = ?`, table)
+	if err != nil {
+		return fmt.Errorf("unable to drop index of %v, cause %w", table, err)
+	}
+	return nil
+}
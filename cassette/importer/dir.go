@@ -3,12 +3,14 @@ package importer
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/fs"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -34,10 +36,41 @@ type (
 		methods []string
 		route   string
 		asset   string
+		options cassette.RouteOptions
+	}
+
+	auxManifest struct {
+		Name        string   `gluamapper:"name"`
+		Title       string   `gluamapper:"title"`
+		Description string   `gluamapper:"description"`
+		License     string   `gluamapper:"license"`
+		Authors     []string `gluamapper:"authors"`
+		Version     string   `gluamapper:"version"`
+		// Query is converted to the query policy of the cassette
+		Query *auxQueryPolicy `gluamapper:"query"`
+	}
+
+	auxQueryPolicy struct {
+		Pragmas       []string `gluamapper:"pragmas"`
+		DenyFunctions []string `gluamapper:"deny_functions"`
+		TempTables    bool     `gluamapper:"temp_tables"`
+		// MaxInstructions and MaxDuration set the budget of each query
+		MaxInstructions int64  `gluamapper:"max_instructions"`
+		MaxDuration     string `gluamapper:"max_duration"`
 	}
 )
 
+const (
+	// manifestFile is the name of the file, at the root of the import directory,
+	// which describes the cassette
+	manifestFile = "cassette.lua"
+)
+
 var (
+	// queriesFiles are the paths, relative to the import directory, of the files
+	// which declare canned queries, dataset/queries.lua is the one written by the exporter
+	queriesFiles = map[string]bool{"queries.lua": true, "dataset/queries.lua": true}
+
 	defaultMapperOptions = gluamapper.Option{
 		NameFunc: gluamapper.Id,
 		TagName:  "gluamapper",
@@ -59,9 +92,15 @@ func (e UserCodeError) Unwrap() error {
 	return e.cause
 }
 
-func Directory(ctx context.Context, target *cassette.Control, base string, allowCodebase bool) error {
+// Directory imports all files under base into target.
+//
+// Compressible assets are also stored with the given encodings (see cassette.CompressAsset),
+// which allows them to be served without compressing them on every request.
+func Directory(ctx context.Context, target *cassette.Control, base string, allowCodebase bool, encodings ...string) error {
 	var assets []string
 	var datasets []string
+	var queries []string
+	var hasManifest bool
 	base = filepath.Clean(base)
 	filepath.WalkDir(base, func(path string, d fs.DirEntry, err error) error {
 		// cassettes are restricted to files
@@ -70,6 +109,16 @@ func Directory(ctx context.Context, target *cassette.Control, base string, allow
 		}
 		// all assets must be relative
 		assetPath := path[len(base)+1:]
+		if assetPath == manifestFile {
+			// the manifest describes the cassette and it is not served as an asset
+			hasManifest = true
+			return nil
+		}
+		if queriesFiles[filepath.ToSlash(assetPath)] {
+			// canned queries are stored in the cassette and not served as an asset
+			queries = append(queries, assetPath)
+			return nil
+		}
 		// datasets undergo a different processing logic
 		if strings.HasPrefix(filepath.ToSlash(assetPath), "dataset/") {
 			if filepath.Base(path) == "dataset.lua" {
@@ -86,6 +135,12 @@ func Directory(ctx context.Context, target *cassette.Control, base string, allow
 		assets = append(assets, assetPath)
 		return nil
 	})
+	if hasManifest {
+		err := importManifest(ctx, target, filepath.Join(base, manifestFile))
+		if err != nil {
+			return err
+		}
+	}
 	var routes []auxRoute
 	for _, f := range assets {
 		if filepath.Base(f) == "routes.lua" {
@@ -95,7 +150,7 @@ func Directory(ctx context.Context, target *cassette.Control, base string, allow
 			}
 			continue
 		}
-		codebase, asset, err := ImportFile(ctx, target, base, f, allowCodebase)
+		codebase, asset, err := ImportFile(ctx, target, base, f, allowCodebase, encodings...)
 		if err != nil {
 			return err
 		}
@@ -106,14 +161,26 @@ func Directory(ctx context.Context, target *cassette.Control, base string, allow
 			}
 		}
 	}
+	// routes are checked by MapRouteWithOptions,
+	// so only conflicts between assets are left
+	err := target.ValidateRoutes(ctx)
+	if err != nil {
+		return err
+	}
 	for _, r := range routes {
-		err := target.MapRoute(ctx, r.methods, r.route, r.asset)
+		err := target.MapRouteWithOptions(ctx, r.methods, r.route, r.asset, r.options)
 		if err != nil {
 			return err
 		}
 	}
 	for _, d := range datasets {
-		err := importDataset(ctx, target, base, d)
+		err := importDataset(ctx, target, base, d, encodings)
+		if err != nil {
+			return err
+		}
+	}
+	for _, q := range queries {
+		err := importQueries(ctx, target, filepath.Join(base, q))
 		if err != nil {
 			return err
 		}
@@ -121,7 +188,7 @@ func Directory(ctx context.Context, target *cassette.Control, base string, allow
 	return nil
 }
 
-func importDataset(ctx context.Context, target *cassette.Control, base string, dataset string) error {
+func importDataset(ctx context.Context, target *cassette.Control, base string, dataset string, encodings []string) error {
 	log := logutil.GetOrDefault(ctx).With().Str("dirname", base).Str("asset", dataset).Logger()
 	l := lua.NewState(lua.Options{SkipOpenLibs: true})
 	datasources := map[string]map[string]interface{}{}
@@ -178,36 +245,211 @@ func importDataset(ctx context.Context, target *cassette.Control, base string, d
 
 		// now that we loaded the table
 		// let's map it to an asset path, so discovery is easier
-		_, err = target.StoreAsset(ctx, path.Join(tableAssetDir, fmt.Sprintf("%v.json", tableName)), "application/json", string(buf))
+		descriptorPath := path.Join(tableAssetDir, fmt.Sprintf("%v.json", tableName))
+		_, err = target.StoreAsset(ctx, descriptorPath, "application/json", string(buf))
 		if err != nil {
 			log.Error().Err(err).Msg("Unable to import CSV into casset")
 			l.RaiseError("unable to load datasource: %v, could not store table descriptor as asset", srcFile)
 		}
+		if len(encodings) > 0 {
+			_, err = target.CompressAsset(ctx, descriptorPath, encodings...)
+			if err != nil {
+				log.Error().Err(err).Msg("Unable to compress table descriptor")
+				l.RaiseError("unable to load datasource: %v, could not compress table descriptor", srcFile)
+			}
+		}
 		l.Push(lua.LNumber(float64(rows)))
 		return 1
 	}))
+	// ftsErr keeps the cause of add_fts failures, which is lost by the lua error
+	var ftsErr error
+	l.SetField(l.G.Global, "add_fts", l.NewFunction(func(l *lua.LState) int {
+		table := l.CheckString(1)
+		columns, ok := ltoj.ToJSONValue(l.CheckTable(2)).([]interface{})
+		if !ok {
+			l.RaiseError("unable to index %v: expecting a list of columns", table)
+		}
+		names := make([]string, len(columns))
+		for i, c := range columns {
+			names[i], ok = c.(string)
+			if !ok {
+				l.RaiseError("unable to index %v: column names must be strings", table)
+			}
+		}
+		err := target.AddFTS(ctx, table, names)
+		if err != nil {
+			ftsErr = err
+			log.Error().Err(err).Str("table", table).Msg("Unable to create full-text index")
+			l.RaiseError("unable to index %v: %v", table, err)
+		}
+		return 0
+	}))
+	l.SetField(l.G.Global, "add_query", addQueryFunction(ctx, l, target))
 
 	code, err := ioutil.ReadFile(filepath.Join(base, dataset))
 	if err != nil {
 		return err
 	}
 	err = l.DoString(string(code))
+	if err != nil && ftsErr != nil {
+		return fmt.Errorf("unable to import %v, cause %w", dataset, ftsErr)
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+func importManifest(ctx context.Context, target *cassette.Control, ap string) error {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	var manifest *auxManifest
+	L.SetField(L.G.Global, "manifest", L.NewFunction(func(L *lua.LState) int {
+		var aux auxManifest
+		err := gluamapper.NewMapper(defaultMapperOptions).Map(L.CheckTable(1), &aux)
+		if err != nil {
+			L.RaiseError("invalid manifest, %v", err)
+		}
+		manifest = &aux
+		return 0
+	}))
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	L.SetContext(ctx)
+	content, err := ioutil.ReadFile(ap)
 	if err != nil {
 		return err
 	}
+	err = L.DoString(string(content))
+	if err != nil {
+		return UserCodeError{Asset: ap, cause: err}
+	}
+	if manifest == nil {
+		return UserCodeError{Asset: ap, cause: errors.New("manifest function was never called")}
+	}
+	m := cassette.Manifest{
+		Name:        manifest.Name,
+		Title:       manifest.Title,
+		Description: manifest.Description,
+		License:     manifest.License,
+		Authors:     manifest.Authors,
+		Version:     manifest.Version,
+	}
+	if manifest.Query != nil {
+		m.Query = &cassette.QueryPolicy{
+			Pragmas:         manifest.Query.Pragmas,
+			DenyFunctions:   manifest.Query.DenyFunctions,
+			TempTables:      manifest.Query.TempTables,
+			MaxInstructions: manifest.Query.MaxInstructions,
+		}
+		if manifest.Query.MaxDuration != "" {
+			m.Query.MaxDuration, err = time.ParseDuration(manifest.Query.MaxDuration)
+			if err != nil {
+				return UserCodeError{Asset: ap, cause: fmt.Errorf("invalid max_duration, %w", err)}
+			}
+		}
+	}
+	return target.StoreManifest(ctx, m)
+}
+
+func importQueries(ctx context.Context, target *cassette.Control, ap string) error {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	L.SetField(L.G.Global, "add_query", addQueryFunction(ctx, L, target))
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	L.SetContext(ctx)
+	content, err := ioutil.ReadFile(ap)
+	if err != nil {
+		return err
+	}
+	err = L.DoString(string(content))
+	if err != nil {
+		return UserCodeError{Asset: ap, cause: err}
+	}
 	return nil
 }
 
+// addQueryFunction returns add_query(name, sql[, params[, options]]), which stores a canned query.
+//
+// params maps the name of each parameter to its type (int, real or text), or to a table
+// with the fields type, required, default and description. options accepts a description.
+func addQueryFunction(ctx context.Context, L *lua.LState, target *cassette.Control) *lua.LFunction {
+	return L.NewFunction(func(L *lua.LState) int {
+		query := cassette.CannedQuery{
+			Name: L.CheckString(1),
+			SQL:  L.CheckString(2),
+		}
+		if tbl := L.OptTable(3, nil); tbl != nil {
+			spec, ok := ltoj.ToJSONValue(tbl).(map[string]interface{})
+			if !ok {
+				L.RaiseError("invalid params for query %v: expecting a table with named fields", query.Name)
+			}
+			var err error
+			query.Params, err = parseQueryParams(spec)
+			if err != nil {
+				L.RaiseError("invalid params for query %v: %v", query.Name, err)
+			}
+		}
+		if tbl := L.OptTable(4, nil); tbl != nil {
+			query.Description = lua.LVAsString(tbl.RawGetString("description"))
+		}
+		err := target.StoreQuery(ctx, query)
+		if err != nil {
+			L.RaiseError("unable to store query %v: %v", query.Name, err)
+		}
+		return 0
+	})
+}
+
+func parseQueryParams(spec map[string]interface{}) ([]cassette.QueryParam, error) {
+	params := make([]cassette.QueryParam, 0, len(spec))
+	for name, v := range spec {
+		p := cassette.QueryParam{Name: name}
+		switch v := v.(type) {
+		case string:
+			p.Type = v
+		case map[string]interface{}:
+			p.Type, _ = v["type"].(string)
+			p.Required, _ = v["required"].(bool)
+			p.Description, _ = v["description"].(string)
+			switch def := v["default"].(type) {
+			case nil:
+			case string:
+				p.Default = def
+			case float64:
+				p.Default = strconv.FormatFloat(def, 'f', -1, 64)
+			default:
+				return nil, fmt.Errorf("default of parameter %v must be a string or a number", name)
+			}
+		default:
+			return nil, fmt.Errorf("parameter %v must be a type name or a table", name)
+		}
+		params = append(params, p)
+	}
+	return params, nil
+}
+
 func scanRoutes(ctx context.Context, out *[]auxRoute, ap string) error {
 	L := lua.NewState(lua.Options{SkipOpenLibs: true})
 	L.SetField(L.G.Global, "add_route", L.NewFunction(lua.LGFunction(func(L *lua.LState) int {
 		route := L.CheckString(1)
 		method := L.CheckString(2)
 		asset := L.CheckString(3)
+		var options cassette.RouteOptions
+		if tbl := L.OptTable(4, nil); tbl != nil {
+			values, ok := ltoj.ToJSONValue(tbl).(map[string]interface{})
+			if !ok {
+				L.RaiseError("invalid options for route %v: expecting a table with named fields", route)
+			}
+			var err error
+			options, err = cassette.ParseRouteOptions(values)
+			if err != nil {
+				L.RaiseError("invalid options for route %v: %v", route, err)
+			}
+		}
 		*out = append(*out, auxRoute{
 			route:   route,
 			methods: strings.Split(strings.ToUpper(method), "|"),
 			asset:   asset,
+			options: options,
 		})
 		return 0
 	})))
@@ -245,17 +487,27 @@ func MimetypeFromExtension(ext string) string {
 	return mt
 }
 
-func ImportFile(ctx context.Context, target *cassette.Control, base string, asset string, allowCodebase bool) (bool, string, error) {
+func ImportFile(ctx context.Context, target *cassette.Control, base string, asset string, allowCodebase bool, encodings ...string) (bool, string, error) {
 	assetPath := filepath.ToSlash(asset)
 	if !allowCodebase && strings.HasPrefix(assetPath, "codebase/") {
 		return false, "", ErrCodebaseNotAllowed{Base: base, Asset: asset}
 	}
 	mt := MimetypeFromExtension(filepath.Ext(asset))
-	content, err := ioutil.ReadFile(filepath.Join(base, asset))
+	content, err := os.Open(filepath.Join(base, asset))
 	if err != nil {
 		return false, "", err
 	}
-	_, err = target.StoreAsset(ctx, assetPath, mt, string(content))
+	defer content.Close()
+	_, err = target.StoreAssetFrom(ctx, assetPath, mt, content)
+	if err != nil {
+		return false, asset, err
+	}
+	if len(encodings) > 0 && cassette.IsCompressible(mt) {
+		_, err = target.CompressAsset(ctx, assetPath, encodings...)
+		if err != nil {
+			return false, asset, err
+		}
+	}
 	codebase := strings.HasPrefix(asset, "codebase/") && mt == "text/x-lua"
-	return codebase, asset, err
+	return codebase, asset, nil
 }
@@ -2,12 +2,14 @@ package importer
 
 import (
 	"context"
+	"errors"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/andrebq/boombox/cassette"
 )
@@ -37,6 +39,125 @@ func TestImportDirectory(t *testing.T) {
 	if !reflect.DeepEqual(actualAssets, expectedAssets) {
 		t.Fatalf("Expecting assets: %v got %v", expectedAssets, actualAssets)
 	}
+	manifest, err := c.Manifest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedManifest := cassette.Manifest{
+		Name:        "test-cassette",
+		Title:       "Test cassette",
+		Description: "Cassette used to test the importer",
+		License:     "CC0: Public Domain",
+		Authors:     []string{"boombox"},
+		Version:     "1.0.0",
+		Query: &cassette.QueryPolicy{
+			Pragmas:         []string{"user_version"},
+			TempTables:      true,
+			MaxInstructions: 1_000_000_000,
+			MaxDuration:     2 * time.Second,
+		},
+	}
+	if !reflect.DeepEqual(manifest, expectedManifest) {
+		t.Fatalf("Expecting manifest %#v got %#v", expectedManifest, manifest)
+	}
+}
+
+func TestImportQueries(t *testing.T) {
+	ctx := context.Background()
+	c, done := tempCassette(ctx, t, "test")
+	defer done()
+	err := Directory(ctx, c, filepath.Join("testdata", "fixtures", "test-cassette"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queries, err := c.ListQueries(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedQueries := []cassette.CannedQuery{
+		{
+			Name:   "capacity",
+			SQL:    "select max(wind_capacity) as capacity from wind where temperature > :minTemperature",
+			Params: []cassette.QueryParam{{Name: "minTemperature", Type: "real"}},
+		},
+		{
+			Name:        "daily-generation",
+			SQL:         "select utc_timestamp, wind_generation_actual from wind where utc_timestamp >= :since order by utc_timestamp limit :days",
+			Description: "Wind generation for a number of days",
+			Params: []cassette.QueryParam{
+				{Name: "days", Type: "int", Default: "7"},
+				{Name: "since", Type: "text", Required: true, Description: "first day, as YYYY-MM-DD"},
+			},
+		},
+	}
+	if !reflect.DeepEqual(queries, expectedQueries) {
+		t.Fatalf("Expecting queries %#v got %#v", expectedQueries, queries)
+	}
+}
+
+func TestImportCodebaseQueriesFile(t *testing.T) {
+	ctx := context.Background()
+	c, done := tempCassette(ctx, t, "test")
+	defer done()
+	base, err := ioutil.TempDir("", "boombox-tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+	// only queries.lua at the root or under dataset declares canned queries
+	os.MkdirAll(filepath.Join(base, "codebase"), 0755)
+	ioutil.WriteFile(filepath.Join(base, "codebase", "queries.lua"), []byte(`require('ctx').res:write_body('ok')`), 0644)
+	ioutil.WriteFile(filepath.Join(base, "codebase", "routes.lua"), []byte(`add_route('/queries', 'GET', 'codebase/queries.lua')`), 0644)
+	err = Directory(ctx, c, base, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes, err := c.ListRoutes(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 1 || routes[0].Route != "/queries" || routes[0].Asset != "codebase/queries.lua" {
+		t.Fatalf("codebase/queries.lua should be served by /queries, got %#v", routes)
+	}
+	queries, err := c.ListQueries(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queries) != 0 {
+		t.Fatalf("codebase/queries.lua should not declare queries, got %#v", queries)
+	}
+}
+
+func TestImportFTS(t *testing.T) {
+	ctx := context.Background()
+	c, done := tempCassette(ctx, t, "test")
+	defer done()
+	base, err := ioutil.TempDir("", "boombox-tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+	os.MkdirAll(filepath.Join(base, "dataset"), 0755)
+	ioutil.WriteFile(filepath.Join(base, "dataset", "notes.csv"), []byte("region,notes\nnorth,strong wind\n"), 0644)
+	ioutil.WriteFile(filepath.Join(base, "dataset", "dataset.lua"), []byte(`
+add_datasource('notes.csv', {})
+load_csv('notes.csv', 'notes')
+add_fts('notes', {'notes', 'region'})
+`), 0644)
+	err = Directory(ctx, c, base, false)
+	if errors.As(err, &cassette.FTSNotSupported{}) {
+		t.Skip("SQLite was built without FTS5, use the sqlite_fts5 build tag")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	indexes, err := c.ListFTS(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []cassette.FTSIndex{{Table: "notes", Columns: []string{"notes", "region"}}}
+	if !reflect.DeepEqual(indexes, expected) {
+		t.Fatalf("Expecting indexes %#v got %#v", expected, indexes)
+	}
 }
 
 func TestRouting(t *testing.T) {
@@ -57,6 +178,7 @@ func TestRouting(t *testing.T) {
 		loadRouteCode(t, "/index", "GET", "codebase/index.lua", basedir),
 		loadRouteCode(t, "/add-numbers", "GET|POST", "codebase/add_numbers.lua", basedir),
 	}
+	expectedRoutes[1].Options = cassette.RouteOptions{Timeout: 5 * time.Second, MaxBody: 1024}
 
 	if !reflect.DeepEqual(actualRoutes, expectedRoutes) {
 		t.Fatalf("Should get %v routes got %v", expectedRoutes, actualRoutes)
@@ -121,5 +243,6 @@ func loadRouteCode(t interface {
 		Route:   route,
 		Methods: strings.Split(strings.ToUpper(methods), "|"),
 		Code:    string(data),
+		Asset:   codebase,
 	}
 }
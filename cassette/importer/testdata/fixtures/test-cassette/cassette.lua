@@ -0,0 +1,14 @@
+manifest({
+  name='test-cassette',
+  title='Test cassette',
+  description='Cassette used to test the importer',
+  license='CC0: Public Domain',
+  authors={'boombox'},
+  version='1.0.0',
+  query={
+    pragmas={'user_version'},
+    temp_tables=true,
+    max_instructions=1000000000,
+    max_duration='2s'
+  }
+})
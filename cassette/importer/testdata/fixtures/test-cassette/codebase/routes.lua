@@ -1,2 +1,5 @@
 add_route('/index', 'GET', 'codebase/index.lua')
-add_route('/add-numbers', 'GET|POST', 'codebase/add_numbers.lua')
+add_route('/add-numbers', 'GET|POST', 'codebase/add_numbers.lua', {
+  timeout = '5s',
+  max_body = '1KiB',
+})
@@ -5,3 +5,8 @@ add_datasource('germany-wind-energy.csv', {
 })
 
 load_csv('germany-wind-energy.csv', 'wind')
+
+add_query('daily-generation', 'select utc_timestamp, wind_generation_actual from wind where utc_timestamp >= :since order by utc_timestamp limit :days', {
+  since={type='text', required=true, description='first day, as YYYY-MM-DD'},
+  days={type='int', default=7}
+}, {description='Wind generation for a number of days'})
@@ -0,0 +1,3 @@
+add_query('capacity', 'select max(wind_capacity) as capacity from wind where temperature > :minTemperature', {
+  minTemperature='real'
+})
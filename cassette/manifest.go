@@ -0,0 +1,74 @@
+package cassette
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+type (
+	// Manifest identifies a cassette and describes its content
+	Manifest struct {
+		Name        string   `json:"name"`
+		Title       string   `json:"title,omitempty"`
+		Description string   `json:"description,omitempty"`
+		License     string   `json:"license,omitempty"`
+		Authors     []string `json:"authors,omitempty"`
+		Version     string   `json:"version,omitempty"`
+		// Query is the policy applied to queries, the default policy is used if nil
+		Query *QueryPolicy `json:"query,omitempty"`
+	}
+)
+
+var (
+	reValidCassetteName = regexp.MustCompile(`^[a-zA-Z0-9][-_a-zA-Z0-9]{0,127}$`)
+)
+
+// Manifest returns the manifest stored in the cassette,
+// if the cassette does not have one, ManifestNotFound is returned.
+func (c *Control) Manifest(ctx context.Context) (Manifest, error) {
+	var content string
+	err := c.db.QueryRowContext(ctx, `select content from manifest where manifest_id = 1`).Scan(&content)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Manifest{}, ManifestNotFound{}
+	} else if err != nil {
+		return Manifest{}, fmt.Errorf("unable to load manifest from cassette, cause %w", err)
+	}
+	var m Manifest
+	err = json.Unmarshal([]byte(content), &m)
+	if err != nil {
+		return Manifest{}, fmt.Errorf("unable to decode manifest, cause %w", err)
+	}
+	return m, nil
+}
+
+// StoreManifest replaces the manifest of the cassette
+func (c *Control) StoreManifest(ctx context.Context, m Manifest) error {
+	if !c.writeable {
+		return ReadonlyCassette{}
+	}
+	if !reValidCassetteName.MatchString(m.Name) {
+		return InvalidManifest{Reason: fmt.Sprintf("name %q does not match %v", m.Name, reValidCassetteName.String())}
+	}
+	if m.Query != nil {
+		if err := m.Query.validate(); err != nil {
+			return InvalidManifest{Reason: fmt.Sprintf("invalid query policy, %v", err)}
+		}
+	}
+	content, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("unable to encode manifest, cause %w", err)
+	}
+	_, err = c.db.ExecContext(ctx, `insert into manifest(manifest_id, content) values (1, ?) on conflict (manifest_id) do update set content = EXCLUDED.content`, string(content))
+	if err != nil {
+		return fmt.Errorf("unable to store manifest, cause %w", err)
+	}
+	// the query policy is compiled from the manifest the next time it is used
+	c.policyMu.Lock()
+	c.policy = nil
+	c.policyMu.Unlock()
+	return nil
+}
@@ -0,0 +1,254 @@
+package cassette
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+type (
+	// ColumnMetadata describes a column returned by a query,
+	// the source of the column is only known when it references a table column directly
+	ColumnMetadata struct {
+		Name string `json:"name"`
+		// Type is the declared type of the column, empty for expressions
+		Type     string `json:"type,omitempty"`
+		Nullable *bool  `json:"nullable,omitempty"`
+		Table    string `json:"table,omitempty"`
+		Column   string `json:"column,omitempty"`
+		// Doc is taken from the columns field of the dataset descriptor
+		Doc string `json:"doc,omitempty"`
+	}
+
+	sourceColumn struct {
+		table    string
+		schema   string
+		name     string
+		declared string
+		notnull  bool
+	}
+)
+
+// columnMetadata returns the metadata of the columns returned by query.
+//
+// The source of a column is the origin reported by SQLite (full_column_names), looked up
+// among the tables read by the query, which are taken from its bytecode (EXPLAIN).
+// Renamed columns and expressions have no origin, so their source is left empty.
+func (c *Control) columnMetadata(ctx context.Context, query string, args []interface{}) ([]ColumnMetadata, error) {
+	// rows are never read, so the query is prepared but not executed
+	rows, err := c.queryRows(ctx, query, args)
+	if err != nil {
+		return nil, err
+	}
+	columnTypes, err := rows.ColumnTypes()
+	if err != nil {
+		rows.Close()
+		return nil, QueryError{Query: query, cause: err, Params: args}
+	}
+	origins, err := columnOrigins(ctx, rows.conn, query, args)
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]ColumnMetadata, len(columnTypes))
+	var candidates []sourceColumn
+	for i, ct := range columnTypes {
+		out[i] = ColumnMetadata{Name: ct.Name(), Type: ct.DatabaseTypeName()}
+		if out[i].Type != "" && candidates == nil {
+			candidates, err = c.queryColumns(ctx, query, args)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	var docs map[string]map[string]string
+	for i := range out {
+		if out[i].Type == "" || i >= len(origins) {
+			continue
+		}
+		src, ok := matchSourceColumn(candidates, origins[i], out[i].Type)
+		if !ok {
+			continue
+		}
+		nullable := !src.notnull
+		out[i].Table, out[i].Column, out[i].Nullable = src.table, src.name, &nullable
+		if src.schema != "dataset" {
+			continue
+		}
+		if docs == nil {
+			docs, err = c.columnDocs(ctx)
+			if err != nil {
+				return nil, err
+			}
+		}
+		out[i].Doc = docs[src.table][src.name]
+	}
+	return out, nil
+}
+
+// columnOrigins returns the names of the columns of query with full_column_names enabled,
+// columns which reference a table directly are named TABLE.COLUMN, using the real name
+// of the table, while renamed columns keep their alias.
+//
+// query must have been accepted by the query policy on conn already,
+// it is prepared again but never executed.
+func columnOrigins(ctx context.Context, conn *sql.Conn, query string, args []interface{}) ([]string, error) {
+	_, err := conn.ExecContext(ctx, `pragma full_column_names = on`)
+	if err != nil {
+		return nil, fmt.Errorf("unable to enable full column names, cause %w", err)
+	}
+	// the connection goes back to the pool, so the pragma must always be reset
+	defer conn.ExecContext(context.Background(), `pragma full_column_names = off`)
+	rows, err := conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, QueryError{Query: query, cause: err, Params: args}
+	}
+	defer rows.Close()
+	names, err := rows.Columns()
+	if err != nil {
+		return nil, QueryError{Query: query, cause: err, Params: args}
+	}
+	return names, nil
+}
+
+// matchSourceColumn returns the only candidate named by origin (TABLE.COLUMN)
+// with the declared type of the result column
+func matchSourceColumn(candidates []sourceColumn, origin, declared string) (sourceColumn, bool) {
+	sep := strings.Index(origin, ".")
+	if sep < 0 {
+		return sourceColumn{}, false
+	}
+	table, name := origin[:sep], origin[sep+1:]
+	var found []sourceColumn
+	for _, sc := range candidates {
+		if strings.EqualFold(sc.table, table) && strings.EqualFold(sc.name, name) && strings.EqualFold(sc.declared, declared) {
+			found = append(found, sc)
+		}
+	}
+	if len(found) != 1 {
+		return sourceColumn{}, false
+	}
+	return found[0], true
+}
+
+// queryColumns returns the columns of every table opened by query.
+//
+// EXPLAIN runs through queryRows, so it is checked by the query policy and metered
+// like the query itself, the schemas are read from the same connection, since
+// the bytecode refers to them by their position in the database list.
+func (c *Control) queryColumns(ctx context.Context, query string, args []interface{}) ([]sourceColumn, error) {
+	rows, err := c.queryRows(ctx, "explain "+query, args)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	type openRead struct {
+		db       int64
+		rootpage int64
+	}
+	var opened []openRead
+	for rows.Next() {
+		var addr, p1, p2, p3 int64
+		var opcode string
+		var p4, p5, comment sql.NullString
+		if err = rows.Scan(&addr, &opcode, &p1, &p2, &p3, &p4, &p5, &comment); err != nil {
+			return nil, QueryError{Query: query, cause: err, Params: args}
+		}
+		if opcode == "OpenRead" {
+			opened = append(opened, openRead{db: p3, rootpage: p2})
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, QueryError{Query: query, cause: err, Params: args}
+	}
+
+	schemas := map[int64]string{}
+	list, err := rows.conn.QueryContext(ctx, `pragma database_list`)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list databases, cause %w", err)
+	}
+	for list.Next() {
+		var seq int64
+		var name string
+		var file sql.NullString
+		if err = list.Scan(&seq, &name, &file); err != nil {
+			list.Close()
+			return nil, fmt.Errorf("unable to list databases, cause %w", err)
+		}
+		schemas[seq] = name
+	}
+	list.Close()
+	rootpages := map[string][]interface{}{}
+	var order []string
+	for _, o := range opened {
+		schema, ok := schemas[o.db]
+		if !ok {
+			continue
+		}
+		if _, ok := rootpages[schema]; !ok {
+			order = append(order, schema)
+		}
+		rootpages[schema] = append(rootpages[schema], o.rootpage)
+	}
+
+	var out []sourceColumn
+	for _, schema := range order {
+		pages := rootpages[schema]
+		// index rootpages are resolved to the table they belong to
+		tables, err := queryStrings(ctx, rows.conn, fmt.Sprintf(`select distinct tbl_name from %q.sqlite_master
+		where rootpage in (%v) order by tbl_name`, schema, strings.TrimSuffix(strings.Repeat("?,", len(pages)), ",")), pages...)
+		if err != nil {
+			return nil, fmt.Errorf("unable to find tables used by query, cause %w", err)
+		}
+		for _, table := range tables {
+			columns, err := tableColumns(ctx, rows.conn, schema, table)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, columns...)
+		}
+	}
+	if out == nil {
+		out = []sourceColumn{}
+	}
+	return out, nil
+}
+
+func tableColumns(ctx context.Context, db dbtx, schema, table string) ([]sourceColumn, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(`pragma %q.table_info(%q)`, schema, table))
+	if err != nil {
+		return nil, fmt.Errorf("unable to inspect table %v, cause %w", table, err)
+	}
+	defer rows.Close()
+	var out []sourceColumn
+	for rows.Next() {
+		var cid, pk int64
+		var notnull bool
+		var name, declared string
+		var dflt sql.NullString
+		if err = rows.Scan(&cid, &name, &declared, &notnull, &dflt, &pk); err != nil {
+			return nil, fmt.Errorf("unable to inspect table %v, cause %w", table, err)
+		}
+		// an integer primary key is an alias for the rowid, which is never null
+		if pk > 0 && strings.EqualFold(declared, "integer") {
+			notnull = true
+		}
+		out = append(out, sourceColumn{table: table, schema: schema, name: name, declared: declared, notnull: notnull})
+	}
+	return out, rows.Err()
+}
+
+// columnDocs returns the documentation of the columns declared by
+// the descriptors of dataset tables, indexed by table and column
+func (c *Control) columnDocs(ctx context.Context) (map[string]map[string]string, error) {
+	descriptors, err := c.datasetDescriptors(ctx)
+	if err != nil {
+		return nil, err
+	}
+	out := map[string]map[string]string{}
+	for _, d := range descriptors {
+		out[d.table] = d.columns
+	}
+	return out, nil
+}
@@ -0,0 +1,370 @@
+package cassette
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type (
+	migration struct {
+		version int
+		name    string
+		stmts   []string
+		// upgrade runs after stmts, inside the same transaction,
+		// to convert data which cannot be handled by plain statements
+		upgrade func(ctx context.Context, tx *sql.Tx, m migration) error
+	}
+
+	// AppliedMigration describes a migration executed by Migrate
+	AppliedMigration struct {
+		Database string
+		Version  int
+		Name     string
+	}
+)
+
+var (
+	// controlMigrations must be kept in order and existing entries must never change,
+	// any change to the schema of k7.db must be done by appending a new migration
+	controlMigrations = []migration{
+		{
+			version: 1,
+			name:    "initial schema",
+			stmts: []string{
+				`create table if not exists counters(
+					name text not null primary key,
+					val integer not null
+				)`,
+				`create table if not exists blobs(
+					content_hash text not null primary key,
+					size integer not null,
+					utf8 integer not null
+				)`,
+				`create table if not exists blob_chunks(
+					content_hash text not null,
+					chunk integer not null,
+					data blob not null,
+					primary key (content_hash, chunk)
+				)`,
+				`create table if not exists assets(
+					asset_id integer not null primary key,
+					path text not null unique,
+					path_hash64 integer not null,
+					mime_type string not null,
+					content_hash text not null,
+					foreign key (content_hash) references blobs(content_hash)
+				)`,
+				`create index if not exists idx_assets_path_hash64
+					on assets(path_hash64)
+				`,
+				`create table if not exists asset_variants(
+					asset_id integer not null,
+					encoding text not null,
+					content_hash text not null,
+					primary key (asset_id, encoding),
+					foreign key (asset_id) references assets(asset_id),
+					foreign key (content_hash) references blobs(content_hash)
+				)`,
+				`create table if not exists asset_revisions(
+					asset_id integer not null,
+					revision integer not null,
+					mime_type string not null,
+					content_hash text not null,
+					created_at integer not null,
+					primary key (asset_id, revision),
+					foreign key (asset_id) references assets(asset_id),
+					foreign key (content_hash) references blobs(content_hash)
+				)`,
+				`create table if not exists codebase(
+					asset_id integer not null primary key,
+					foreign key (asset_id) references assets(asset_id)
+				)`,
+				`create table if not exists routes(
+					route text not null primary key,
+					methods text not null,
+					asset_id integer,
+					foreign key(asset_id) references codebase(asset_id)
+				)`,
+			},
+			upgrade: upgradeBaseline,
+		},
+		{
+			version: 2,
+			name:    "cassette manifest",
+			stmts: []string{
+				`create table manifest(
+					manifest_id integer not null primary key check (manifest_id = 1),
+					content text not null
+				)`,
+			},
+		},
+		{
+			version: 3,
+			name:    "cassette signatures",
+			stmts: []string{
+				`create table signatures(
+					public_key text not null primary key,
+					signature text not null,
+					digest text not null,
+					signed_at integer not null
+				)`,
+			},
+		},
+		{
+			version: 4,
+			name:    "route options",
+			stmts: []string{
+				`alter table routes add column options text not null default '{}'`,
+			},
+		},
+		{
+			version: 5,
+			name:    "canned queries",
+			stmts: []string{
+				`create table queries(
+					name text not null primary key,
+					sql text not null,
+					description text not null default '',
+					params text not null default '[]'
+				)`,
+			},
+		},
+	}
+
+	// dataMigrations is the equivalent of controlMigrations for datak7.db,
+	// tables created by ImportCSVDataset are not part of the schema
+	dataMigrations = []migration{
+		{
+			version: 1,
+			name:    "initial schema",
+		},
+		{
+			version: 2,
+			name:    "fts indexes",
+			stmts: []string{
+				`create table fts_indexes(
+					name text not null primary key,
+					source text not null,
+					columns text not null
+				)`,
+			},
+		},
+	}
+)
+
+// Migrate upgrades both databases of the cassette to the latest schema version
+// and returns the list of migrations which were applied.
+//
+// Cassettes created before schema versioning are upgraded as well,
+// the content of their assets is moved to blobs.
+func Migrate(ctx context.Context, tape string) ([]AppliedMigration, error) {
+	if _, err := os.Stat(filepath.Join(tape, "k7.db")); err != nil {
+		return nil, fmt.Errorf("unable to migrate cassette %v, cause %w", tape, err)
+	}
+	var applied []AppliedMigration
+	for _, target := range []struct {
+		dbname     string
+		migrations []migration
+	}{
+		{"k7.db", controlMigrations},
+		{"datak7.db", dataMigrations},
+	} {
+		conn, _, err := openCassetteDatabase(ctx, tape, target.dbname, true)
+		if err != nil {
+			return applied, err
+		}
+		items, err := applyMigrations(ctx, conn, target.dbname, target.migrations)
+		conn.Close()
+		applied = append(applied, items...)
+		if err != nil {
+			return applied, err
+		}
+	}
+	return applied, nil
+}
+
+// prepareSchema ensures the database is using the latest schema version,
+// empty databases opened in read-write mode are initialized, anything else
+// must be upgraded explicitly with Migrate.
+func prepareSchema(ctx context.Context, db *sql.DB, dbname string, migrations []migration, readwrite bool) error {
+	version, err := schemaVersion(ctx, db)
+	if err != nil {
+		return err
+	}
+	latest := migrations[len(migrations)-1].version
+	if version == latest {
+		return nil
+	}
+	if readwrite && version == 0 {
+		empty, err := emptyDatabase(ctx, db)
+		if err != nil {
+			return err
+		}
+		// datak7.db created before schema versioning only contains imported tables,
+		// therefore it is safe to bring it up to date
+		if empty || dbname == "datak7.db" {
+			_, err = applyMigrations(ctx, db, dbname, migrations)
+			return err
+		}
+	}
+	return SchemaVersionMismatch{Database: dbname, Found: version, Expected: latest}
+}
+
+func applyMigrations(ctx context.Context, db *sql.DB, dbname string, migrations []migration) ([]AppliedMigration, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to start migration of %v, cause %w", dbname, err)
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx, `create table if not exists schema_version(
+		version integer not null primary key,
+		name text not null,
+		applied_at integer not null
+	)`)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create schema_version table on %v, cause %w", dbname, err)
+	}
+	version, err := schemaVersion(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+	if latest := migrations[len(migrations)-1].version; version > latest {
+		return nil, SchemaVersionMismatch{Database: dbname, Found: version, Expected: latest}
+	}
+	var applied []AppliedMigration
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+		for _, stmt := range m.stmts {
+			_, err = tx.ExecContext(ctx, stmt)
+			if err != nil {
+				return nil, fmt.Errorf("unable to apply migration %v (%v) to %v, cause %w", m.version, m.name, dbname, err)
+			}
+		}
+		if m.upgrade != nil {
+			err = m.upgrade(ctx, tx, m)
+			if err != nil {
+				return nil, fmt.Errorf("unable to apply migration %v (%v) to %v, cause %w", m.version, m.name, dbname, err)
+			}
+		}
+		_, err = tx.ExecContext(ctx, `insert into schema_version(version, name, applied_at) values (?, ?, ?)`, m.version, m.name, time.Now().UnixMilli())
+		if err != nil {
+			return nil, fmt.Errorf("unable to record migration %v of %v, cause %w", m.version, dbname, err)
+		}
+		applied = append(applied, AppliedMigration{Database: dbname, Version: m.version, Name: m.name})
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("unable to commit migrations of %v, cause %w", dbname, err)
+	}
+	return applied, nil
+}
+
+// upgradeBaseline converts the assets of cassettes created before schema versioning,
+// which kept the content inline, to the layout of the initial schema.
+//
+// Tables which already exist are not touched by the statements of the migration,
+// so the old assets table is replaced and the statements are executed again.
+func upgradeBaseline(ctx context.Context, tx *sql.Tx, m migration) error {
+	var inline int
+	err := tx.QueryRowContext(ctx, `select count(*) from pragma_table_info('assets') where name = 'content'`).Scan(&inline)
+	if err != nil {
+		return fmt.Errorf("unable to inspect assets table, cause %w", err)
+	}
+	if inline == 0 {
+		return nil
+	}
+	for _, stmt := range []string{
+		`create table baseline_assets as select asset_id, path, path_hash64, mime_type, content from assets`,
+		`drop table assets`,
+	} {
+		_, err = tx.ExecContext(ctx, stmt)
+		if err != nil {
+			return fmt.Errorf("unable to replace baseline assets table, cause %w", err)
+		}
+	}
+	for _, stmt := range m.stmts {
+		_, err = tx.ExecContext(ctx, stmt)
+		if err != nil {
+			return err
+		}
+	}
+	rows, err := tx.QueryContext(ctx, `select asset_id, path, path_hash64, mime_type, content from baseline_assets order by asset_id`)
+	if err != nil {
+		return fmt.Errorf("unable to read baseline assets, cause %w", err)
+	}
+	type baselineAsset struct {
+		id       int64
+		path     string
+		pathHash int64
+		mimeType string
+		content  []byte
+	}
+	var assets []baselineAsset
+	for rows.Next() {
+		var a baselineAsset
+		err = rows.Scan(&a.id, &a.path, &a.pathHash, &a.mimeType, &a.content)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("unable to read baseline assets, cause %w", err)
+		}
+		assets = append(assets, a)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("unable to read baseline assets, cause %w", err)
+	}
+	for _, a := range assets {
+		blob, err := storeBlob(ctx, tx, bytes.NewReader(a.content))
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `insert into assets(asset_id, path, path_hash64, mime_type, content_hash) values (?, ?, ?, ?, ?)`,
+			a.id, a.path, a.pathHash, a.mimeType, blob.hash)
+		if err != nil {
+			return fmt.Errorf("unable to move asset %v to blobs, cause %w", a.path, err)
+		}
+		// baseline cassettes did not keep revisions, the current content becomes the first one
+		_, err = recordRevision(ctx, tx, a.id, a.mimeType, blob.hash)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.ExecContext(ctx, `drop table baseline_assets`)
+	if err != nil {
+		return fmt.Errorf("unable to drop baseline assets table, cause %w", err)
+	}
+	return nil
+}
+
+func schemaVersion(ctx context.Context, db dbtx) (int, error) {
+	var tables int
+	err := db.QueryRowContext(ctx, `select count(*) from sqlite_master where type = 'table' and name = 'schema_version'`).Scan(&tables)
+	if err != nil {
+		return 0, fmt.Errorf("unable to check schema version, cause %w", err)
+	}
+	if tables == 0 {
+		return 0, nil
+	}
+	var version int
+	err = db.QueryRowContext(ctx, `select coalesce(max(version), 0) from schema_version`).Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("unable to check schema version, cause %w", err)
+	}
+	return version, nil
+}
+
+func emptyDatabase(ctx context.Context, db dbtx) (bool, error) {
+	var objects int
+	err := db.QueryRowContext(ctx, `select count(*) from sqlite_master`).Scan(&objects)
+	if err != nil {
+		return false, fmt.Errorf("unable to inspect database, cause %w", err)
+	}
+	return objects == 0, nil
+}
@@ -0,0 +1,228 @@
+package cassette
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	DefaultPageSize = 100
+	MaxPageSize     = 10_000
+)
+
+type (
+	// Page selects a page of a query using keyset pagination
+	Page struct {
+		// OrderBy lists the sort keys, a key prefixed by - is sorted in descending order.
+		// Keys should identify a row uniquely, otherwise rows which share the same keys
+		// might be skipped between pages.
+		OrderBy []string
+		// Limit is the number of rows in the page, DefaultPageSize is used if zero
+		Limit int
+		// Cursor is the next value returned by the previous page, empty for the first page
+		Cursor string
+	}
+
+	sortKey struct {
+		column string
+		desc   bool
+	}
+
+	pageCursor struct {
+		// Query is a checksum of the query and sort keys,
+		// so a cursor cannot be used with a different query
+		Query string        `json:"q"`
+		Keys  []interface{} `json:"k"`
+	}
+)
+
+// QueryPage runs query sorted by the keys of page, starting after the row
+// identified by page.Cursor. The output is the same document written by Query
+// with an additional next field, which contains the cursor of the following page
+// or null when the last page was reached.
+//
+// Sort keys must be columns returned by query and cannot be NULL.
+func (c *Control) QueryPage(ctx context.Context, out io.Writer, maxSize int, page Page, query string, args ...interface{}) (string, error) {
+	keys, err := parseSortKeys(page.OrderBy)
+	if err != nil {
+		return "", err
+	}
+	limit := page.Limit
+	if limit <= 0 {
+		limit = DefaultPageSize
+	} else if limit > MaxPageSize {
+		limit = MaxPageSize
+	}
+	query = strings.TrimRight(strings.TrimSpace(query), ";")
+	// cursors are bound to the query, its order and its arguments,
+	// so a cursor cannot be used to page through a different result
+	checksum := sha256.New()
+	io.WriteString(checksum, query+"\x00"+strings.Join(page.OrderBy, ","))
+	for _, a := range args {
+		fmt.Fprintf(checksum, "\x00%T:%#v", a, a)
+	}
+	queryID := hex.EncodeToString(checksum.Sum(nil)[:8])
+
+	var where string
+	pageArgs := append([]interface{}{}, args...)
+	if page.Cursor != "" {
+		values, err := decodeCursor(page.Cursor, queryID, len(keys))
+		if err != nil {
+			return "", err
+		}
+		var cond string
+		cond, pageArgs = keysetCondition(keys, values, pageArgs)
+		where = " where " + cond
+	}
+	order := make([]string, len(keys))
+	for i, k := range keys {
+		order[i] = fmt.Sprintf("%q asc", k.column)
+		if k.desc {
+			order[i] = fmt.Sprintf("%q desc", k.column)
+		}
+	}
+	pageQuery := fmt.Sprintf("select * from (%v)%v order by %v limit %v", query, where, strings.Join(order, ", "), limit)
+
+	var buf bytes.Buffer
+	err = c.Query(ctx, &buf, maxSize, pageQuery, pageArgs...)
+	if err != nil {
+		return "", err
+	}
+	var result struct {
+		Columns []string
+		Rows    [][]interface{}
+	}
+	dec := json.NewDecoder(bytes.NewReader(buf.Bytes()))
+	// numbers are kept as written, so integer keys do not lose precision
+	dec.UseNumber()
+	err = dec.Decode(&result)
+	if err != nil {
+		return "", fmt.Errorf("unable to decode page, cause %w", err)
+	}
+	var next string
+	if len(result.Rows) == limit {
+		next, err = encodeCursor(queryID, keys, result.Columns, result.Rows[len(result.Rows)-1])
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// replace the closing brace of the document with the next field
+	doc := bytes.TrimRight(buf.Bytes(), "\n")
+	doc = doc[:len(doc)-1]
+	encodedNext := []byte("null")
+	if next != "" {
+		encodedNext, _ = json.Marshal(next)
+	}
+	_, err = fmt.Fprintf(out, "%s,\"next\":%s}", doc, encodedNext)
+	return next, err
+}
+
+func parseSortKeys(orderBy []string) ([]sortKey, error) {
+	if len(orderBy) == 0 {
+		return nil, InvalidPage{Reason: "at least one sort key is required"}
+	}
+	keys := make([]sortKey, len(orderBy))
+	for i, k := range orderBy {
+		k = strings.TrimSpace(k)
+		if strings.HasPrefix(k, "-") {
+			keys[i].desc = true
+			k = k[1:]
+		}
+		if err := validDatasetColumn(k); err != nil {
+			return nil, InvalidPage{Reason: fmt.Sprintf("invalid sort key %q", orderBy[i])}
+		}
+		keys[i].column = k
+	}
+	return keys, nil
+}
+
+// keysetCondition returns the condition which selects the rows after values,
+// (a > ?) or (a = ? and b > ?) ... since keys might use different directions.
+func keysetCondition(keys []sortKey, values []interface{}, args []interface{}) (string, []interface{}) {
+	var terms []string
+	for i := range keys {
+		var term []string
+		for j := 0; j < i; j++ {
+			term = append(term, fmt.Sprintf("%q = :pageKey%v", keys[j].column, j))
+		}
+		op := ">"
+		if keys[i].desc {
+			op = "<"
+		}
+		term = append(term, fmt.Sprintf("%q %v :pageKey%v", keys[i].column, op, i))
+		terms = append(terms, "("+strings.Join(term, " and ")+")")
+	}
+	// named parameters do not interfere with the parameters used by the query
+	for i, v := range values {
+		args = append(args, sql.Named(fmt.Sprintf("pageKey%v", i), v))
+	}
+	return "(" + strings.Join(terms, " or ") + ")", args
+}
+
+func encodeCursor(queryID string, keys []sortKey, columns []string, row []interface{}) (string, error) {
+	cursor := pageCursor{Query: queryID, Keys: make([]interface{}, len(keys))}
+	for i, k := range keys {
+		idx := -1
+		for j, col := range columns {
+			if col == k.column {
+				idx = j
+				break
+			}
+		}
+		if idx < 0 {
+			return "", InvalidPage{Reason: fmt.Sprintf("sort key %v is not returned by the query", k.column)}
+		}
+		if row[idx] == nil {
+			return "", InvalidPage{Reason: fmt.Sprintf("sort key %v cannot be null", k.column)}
+		}
+		cursor.Keys[i] = row[idx]
+	}
+	content, err := json.Marshal(cursor)
+	if err != nil {
+		return "", fmt.Errorf("unable to encode cursor, cause %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(content), nil
+}
+
+func decodeCursor(encoded string, queryID string, numKeys int) ([]interface{}, error) {
+	content, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, InvalidPage{Reason: "malformed cursor"}
+	}
+	var cursor pageCursor
+	dec := json.NewDecoder(bytes.NewReader(content))
+	dec.UseNumber()
+	if err = dec.Decode(&cursor); err != nil {
+		return nil, InvalidPage{Reason: "malformed cursor"}
+	}
+	if cursor.Query != queryID || len(cursor.Keys) != numKeys {
+		return nil, InvalidPage{Reason: "cursor belongs to a different query"}
+	}
+	values := make([]interface{}, numKeys)
+	for i, v := range cursor.Keys {
+		switch v := v.(type) {
+		case json.Number:
+			if n, err := v.Int64(); err == nil {
+				values[i] = n
+			} else if f, err := v.Float64(); err == nil {
+				values[i] = f
+			} else {
+				return nil, InvalidPage{Reason: "malformed cursor"}
+			}
+		case string, bool:
+			values[i] = v
+		default:
+			return nil, InvalidPage{Reason: "malformed cursor"}
+		}
+	}
+	return values, nil
+}
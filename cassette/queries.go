@@ -0,0 +1,290 @@
+package cassette
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type (
+	// CannedQuery is a named query stored in the cassette,
+	// it can be executed by name with the parameters it declares
+	CannedQuery struct {
+		Name        string       `json:"name"`
+		SQL         string       `json:"sql"`
+		Description string       `json:"description,omitempty"`
+		Params      []QueryParam `json:"params"`
+	}
+
+	// QueryParam declares a named parameter (:name) of a canned query
+	QueryParam struct {
+		Name string `json:"name"`
+		// Type is one of int, real or text
+		Type     string `json:"type"`
+		Required bool   `json:"required,omitempty"`
+		// Default is used when the parameter is not required and has no value
+		Default     string `json:"default,omitempty"`
+		Description string `json:"description,omitempty"`
+	}
+)
+
+var (
+	reValidQueryName = regexp.MustCompile(`^[a-zA-Z0-9][-_a-zA-Z0-9]{0,127}$`)
+
+	// reservedQueryParams are used by the query endpoints to control the output,
+	// so they cannot be used as the name of a parameter
+	reservedQueryParams = map[string]bool{
+		"sql": true, "format": true, "maxRows": true, "timeout": true, "maxBuffer": true,
+		"orderBy": true, "limit": true, "cursor": true, "metadata": true,
+		"maxInstructions": true, "maxDuration": true,
+	}
+)
+
+// StoreQuery adds or replaces the canned query with the same name,
+// the query must be accepted by the query policy of the cassette.
+func (c *Control) StoreQuery(ctx context.Context, q CannedQuery) error {
+	if !c.writeable {
+		return ReadonlyCassette{}
+	}
+	if err := q.validate(); err != nil {
+		return err
+	}
+	if err := c.prepareQuery(ctx, q); err != nil {
+		return err
+	}
+	params, err := json.Marshal(q.Params)
+	if err != nil {
+		return fmt.Errorf("unable to encode parameters of query %v, cause %w", q.Name, err)
+	}
+	_, err = c.db.ExecContext(ctx, `insert into queries(name, sql, description, params) values (?, ?, ?, ?)
+	on conflict (name) do update set sql = EXCLUDED.sql, description = EXCLUDED.description, params = EXCLUDED.params`,
+		q.Name, q.SQL, q.Description, string(params))
+	if err != nil {
+		return fmt.Errorf("unable to store query %v, cause %w", q.Name, err)
+	}
+	return nil
+}
+
+// RemoveQuery removes the canned query
+func (c *Control) RemoveQuery(ctx context.Context, name string) error {
+	if !c.writeable {
+		return ReadonlyCassette{}
+	}
+	res, err := c.db.ExecContext(ctx, `delete from queries where name = ?`, name)
+	if err != nil {
+		return fmt.Errorf("unable to remove query %v, cause %w", name, err)
+	}
+	if removed, _ := res.RowsAffected(); removed == 0 {
+		return QueryNotFound{Name: name}
+	}
+	return nil
+}
+
+// ListQueries returns the canned queries ordered by name
+func (c *Control) ListQueries(ctx context.Context) ([]CannedQuery, error) {
+	rows, err := c.db.QueryContext(ctx, `select name, sql, description, params from queries order by name asc`)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list queries, cause %w", err)
+	}
+	defer rows.Close()
+	out := []CannedQuery{}
+	for rows.Next() {
+		q, err := scanQuery(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, q)
+	}
+	return out, rows.Err()
+}
+
+// LookupQuery returns the canned query called name, or QueryNotFound
+func (c *Control) LookupQuery(ctx context.Context, name string) (CannedQuery, error) {
+	q, err := scanQuery(c.db.QueryRowContext(ctx, `select name, sql, description, params from queries where name = ?`, name))
+	if errors.Is(err, sql.ErrNoRows) {
+		return CannedQuery{}, QueryNotFound{Name: name}
+	}
+	return q, err
+}
+
+func scanQuery(row interface{ Scan(...interface{}) error }) (CannedQuery, error) {
+	var q CannedQuery
+	var params string
+	err := row.Scan(&q.Name, &q.SQL, &q.Description, &params)
+	if errors.Is(err, sql.ErrNoRows) {
+		return q, err
+	} else if err != nil {
+		return q, fmt.Errorf("unable to read query, cause %w", err)
+	}
+	err = json.Unmarshal([]byte(params), &q.Params)
+	if err != nil {
+		return q, fmt.Errorf("unable to decode parameters of query %v, cause %w", q.Name, err)
+	}
+	return q, nil
+}
+
+// Bind converts values to the arguments of the query, values without a
+// matching parameter are ignored. Parameters are bound by name, so the
+// arguments are always sql.NamedArg values.
+func (q CannedQuery) Bind(values map[string]string) ([]interface{}, error) {
+	args := make([]interface{}, 0, len(q.Params))
+	for _, p := range q.Params {
+		value, ok := values[p.Name]
+		if !ok || value == "" {
+			if p.Required {
+				return nil, InvalidQueryParams{Query: q.Name, Reason: fmt.Sprintf("parameter %v is required", p.Name)}
+			}
+			if p.Default == "" {
+				args = append(args, sql.Named(p.Name, nil))
+				continue
+			}
+			value = p.Default
+		}
+		converted, err := parseParam(p.Type, value)
+		if err != nil {
+			return nil, InvalidQueryParams{Query: q.Name, Reason: fmt.Sprintf("parameter %v expects a value of type %v", p.Name, p.Type)}
+		}
+		args = append(args, sql.Named(p.Name, converted))
+	}
+	return args, nil
+}
+
+func (q *CannedQuery) validate() error {
+	if !reValidQueryName.MatchString(q.Name) {
+		return InvalidQuery{Name: q.Name, Reason: fmt.Sprintf("name must match %v", reValidQueryName.String())}
+	}
+	if strings.TrimSpace(q.SQL) == "" {
+		return InvalidQuery{Name: q.Name, Reason: "sql cannot be empty"}
+	}
+	seen := map[string]bool{}
+	for _, p := range q.Params {
+		switch {
+		case !reValidIdentifiers.MatchString(p.Name):
+			return InvalidQuery{Name: q.Name, Reason: fmt.Sprintf("parameter %q is not a valid identifier", p.Name)}
+		case reservedQueryParams[p.Name]:
+			return InvalidQuery{Name: q.Name, Reason: fmt.Sprintf("parameter %q is reserved", p.Name)}
+		case seen[p.Name]:
+			return InvalidQuery{Name: q.Name, Reason: fmt.Sprintf("parameter %q is declared more than once", p.Name)}
+		}
+		seen[p.Name] = true
+		if _, err := parseParam(p.Type, "0"); err != nil {
+			return InvalidQuery{Name: q.Name, Reason: fmt.Sprintf("parameter %v has an unknown type %q, use int, real or text", p.Name, p.Type)}
+		}
+		if p.Default != "" {
+			if _, err := parseParam(p.Type, p.Default); err != nil {
+				return InvalidQuery{Name: q.Name, Reason: fmt.Sprintf("default of parameter %v is not a valid %v", p.Name, p.Type)}
+			}
+		}
+	}
+	named, positional := queryPlaceholders(q.SQL)
+	if positional {
+		return InvalidQuery{Name: q.Name, Reason: "sql uses positional parameters, use :name instead"}
+	}
+	for _, name := range named {
+		if !seen[name] {
+			return InvalidQuery{Name: q.Name, Reason: fmt.Sprintf("sql uses parameter %v which is not declared", name)}
+		}
+		delete(seen, name)
+	}
+	for _, p := range q.Params {
+		if seen[p.Name] {
+			return InvalidQuery{Name: q.Name, Reason: fmt.Sprintf("parameter %v is not used by the sql", p.Name)}
+		}
+	}
+	sort.Slice(q.Params, func(i, j int) bool { return q.Params[i].Name < q.Params[j].Name })
+	return nil
+}
+
+// prepareQuery checks every statement of q against the query policy,
+// without running them.
+func (c *Control) prepareQuery(ctx context.Context, q CannedQuery) error {
+	args := make([]interface{}, 0, len(q.Params))
+	for _, p := range q.Params {
+		args = append(args, sql.Named(p.Name, nil))
+	}
+	rows, err := c.queryRows(ctx, q.SQL, args)
+	var notAllowed QueryNotAllowed
+	var queryErr QueryError
+	switch {
+	case errors.As(err, &notAllowed):
+		return InvalidQuery{Name: q.Name, Reason: notAllowed.Reason}
+	case errors.As(err, &queryErr):
+		return InvalidQuery{Name: q.Name, Reason: fmt.Sprintf("sql cannot be prepared, %v", queryErr.cause)}
+	case err != nil:
+		return fmt.Errorf("unable to prepare query %v, cause %w", q.Name, err)
+	}
+	// rows are only read by Next, so closing them before that
+	// prevents the statements from doing any work
+	return rows.Close()
+}
+
+// queryPlaceholders returns the names of the parameters (:name, @name or $name) used by query,
+// in the order they first appear, and whether query uses positional parameters (? or ?NNN).
+func queryPlaceholders(query string) (named []string, positional bool) {
+	seen := map[string]bool{}
+	isIdent := func(b byte) bool {
+		return b == '_' || (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || (b >= '0' && b <= '9')
+	}
+	for i := 0; i < len(query); i++ {
+		switch ch := query[i]; {
+		case ch == '\'' || ch == '"' || ch == '`':
+			// quotes are escaped by doubling them, which is the same as
+			// ending the literal and starting a new one
+			if end := strings.IndexByte(query[i+1:], ch); end >= 0 {
+				i += end + 1
+			} else {
+				i = len(query)
+			}
+		case ch == '[':
+			if end := strings.IndexByte(query[i+1:], ']'); end >= 0 {
+				i += end + 1
+			} else {
+				i = len(query)
+			}
+		case strings.HasPrefix(query[i:], "--"):
+			if end := strings.IndexByte(query[i:], '\n'); end >= 0 {
+				i += end
+			} else {
+				i = len(query)
+			}
+		case strings.HasPrefix(query[i:], "/*"):
+			if end := strings.Index(query[i+2:], "*/"); end >= 0 {
+				i += end + 3
+			} else {
+				i = len(query)
+			}
+		case ch == '?':
+			positional = true
+		case ch == '$' && i > 0 && isIdent(query[i-1]):
+			// $ can be part of an identifier
+		case ch == ':' || ch == '@' || ch == '$':
+			start := i + 1
+			for i+1 < len(query) && isIdent(query[i+1]) {
+				i++
+			}
+			if name := query[start : i+1]; name != "" && !seen[name] {
+				seen[name] = true
+				named = append(named, name)
+			}
+		}
+	}
+	return named, positional
+}
+
+func parseParam(paramType, value string) (interface{}, error) {
+	switch paramType {
+	case "int":
+		return strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	case "real":
+		return strconv.ParseFloat(strings.TrimSpace(value), 64)
+	case "text":
+		return value, nil
+	}
+	return nil, fmt.Errorf("unknown type %q", paramType)
+}
@@ -0,0 +1,124 @@
+package cassette
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+const (
+	QueryCompleted = "completed"
+	QueryTruncated = "truncated"
+	QueryFailed    = "error"
+)
+
+type (
+	// QueryStatus is written as the last line of a NDJSON stream,
+	// the $status key makes it easy to tell it apart from the rows
+	QueryStatus struct {
+		Status string `json:"$status"`
+		Rows   int64  `json:"rows"`
+		Reason string `json:"reason,omitempty"`
+	}
+)
+
+// QueryNDJSON streams the result of query to out, one JSON object per row
+// followed by a QueryStatus line.
+//
+// Instead of a size limit, the stream stops after maxRows rows (zero means no limit)
+// or when ctx is done, in both cases the status line reports the result as truncated.
+// Errors which happen before the first byte is written are returned without writing
+// anything to out, later errors are also reported on the status line.
+func (c *Control) QueryNDJSON(ctx context.Context, out io.Writer, maxRows int64, query string, args ...interface{}) (QueryStatus, error) {
+	if c.writeable {
+		return QueryStatus{}, CannotQuery{}
+	}
+	rows, err := c.queryRows(ctx, query, args)
+	if err != nil {
+		return QueryStatus{}, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return QueryStatus{}, QueryError{Query: query, cause: err, Params: args}
+	}
+	// keys are encoded once, which also keeps the order of the columns in each object
+	keys := make([][]byte, len(columns))
+	for i, col := range columns {
+		keys[i], err = json.Marshal(col)
+		if err != nil {
+			return QueryStatus{}, err
+		}
+	}
+
+	r := make(Row, len(columns))
+	scanTarget := make([]interface{}, len(r))
+	for i := range scanTarget {
+		scanTarget[i] = &r[i]
+	}
+	var status QueryStatus
+	var line bytes.Buffer
+	for {
+		if !rows.Next() {
+			err = rows.Err()
+			break
+		}
+		if maxRows > 0 && status.Rows >= maxRows {
+			status.Status, status.Reason = QueryTruncated, "row limit reached"
+			break
+		}
+		err = rows.Scan(scanTarget...)
+		if err != nil {
+			break
+		}
+		line.Reset()
+		line.WriteByte('{')
+		for i, v := range r {
+			if i > 0 {
+				line.WriteByte(',')
+			}
+			line.Write(keys[i])
+			line.WriteByte(':')
+			var value []byte
+			value, err = json.Marshal(v)
+			if err != nil {
+				break
+			}
+			line.Write(value)
+		}
+		if err != nil {
+			break
+		}
+		line.WriteString("}\n")
+		_, err = out.Write(line.Bytes())
+		if err != nil {
+			// the client is gone, there is no point in writing the status
+			return status, err
+		}
+		status.Rows++
+	}
+	status, err = finishQuery(ctx, status, err, query, args)
+	if encErr := json.NewEncoder(out).Encode(status); err == nil {
+		err = encErr
+	}
+	return status, err
+}
+
+// finishQuery sets the final state of a streamed query, a query interrupted by
+// its deadline is truncated instead of failed
+func finishQuery(ctx context.Context, status QueryStatus, err error, query string, args []interface{}) (QueryStatus, error) {
+	switch {
+	case status.Status != "":
+	case err == nil:
+		status.Status = QueryCompleted
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		status.Status, status.Reason = QueryTruncated, "time limit reached"
+		err = nil
+	default:
+		status.Status, status.Reason = QueryFailed, err.Error()
+		err = QueryError{Query: query, cause: err, Params: args}
+	}
+	return status, err
+}
@@ -0,0 +1,243 @@
+// Package querycache keeps the output of queries made to read-only cassettes,
+// since cassettes do not change, the same query always produces the same bytes.
+package querycache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// spillExt is the extension of the files written to the spill directory
+	spillExt = ".qcache"
+)
+
+type (
+	// Options bound the size of the cache, entries older than TTL are never returned
+	Options struct {
+		// MaxBytes is the size of the entries kept in memory
+		MaxBytes int64
+		// TTL is how long an entry is kept, zero means entries do not expire
+		TTL time.Duration
+		// Dir receives the entries evicted from memory, spilling is disabled if empty
+		Dir string
+		// MaxDiskBytes is the size of the entries kept in Dir
+		MaxDiskBytes int64
+	}
+
+	// Stats counts how the cache was used since it was created
+	Stats struct {
+		Hits      int64 `json:"hits"`
+		Misses    int64 `json:"misses"`
+		DiskHits  int64 `json:"diskHits"`
+		Evictions int64 `json:"evictions"`
+		Entries   int   `json:"entries"`
+		Bytes     int64 `json:"bytes"`
+		DiskBytes int64 `json:"diskBytes"`
+	}
+
+	// Cache is a LRU cache of query outputs, it is safe for concurrent use
+	Cache struct {
+		mu   sync.Mutex
+		opts Options
+
+		memory  *list.List
+		onDisk  *list.List
+		entries map[string]*list.Element
+
+		stats Stats
+		now   func() time.Time
+	}
+
+	entry struct {
+		key      string
+		content  []byte
+		size     int64
+		storedAt time.Time
+		spilled  bool
+	}
+)
+
+// New returns an empty cache, files left in opts.Dir by a previous cache are removed
+func New(opts Options) (*Cache, error) {
+	if opts.Dir != "" {
+		err := os.MkdirAll(opts.Dir, 0755)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create cache directory %v, cause %w", opts.Dir, err)
+		}
+		stale, err := filepath.Glob(filepath.Join(opts.Dir, "*"+spillExt))
+		if err != nil {
+			return nil, fmt.Errorf("unable to list cache directory %v, cause %w", opts.Dir, err)
+		}
+		for _, f := range stale {
+			os.Remove(f)
+		}
+	}
+	return &Cache{
+		opts:    opts,
+		memory:  list.New(),
+		onDisk:  list.New(),
+		entries: map[string]*list.Element{},
+		now:     time.Now,
+	}, nil
+}
+
+// Key returns the cache key of a query, which is also safe to use as an ETag.
+//
+// The key covers the digest of the cassette, the sql (see NormalizeSQL), its parameters
+// and any other value which changes the output (eg.: the output format).
+func Key(digest []byte, sql string, params []interface{}, variant ...string) string {
+	h := sha256.New()
+	h.Write(digest)
+	fmt.Fprintf(h, "\x00%v\x00", NormalizeSQL(sql))
+	for _, p := range params {
+		// the type is part of the key, since 1 and '1' might produce different results
+		fmt.Fprintf(h, "%T:%v\x00", p, p)
+	}
+	for _, v := range variant {
+		fmt.Fprintf(h, "%v\x00", v)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// NormalizeSQL collapses whitespace outside of quoted strings and identifiers
+// and removes trailing semicolons, so formatting changes do not produce new keys
+func NormalizeSQL(sql string) string {
+	var sb strings.Builder
+	var quote rune
+	space := false
+	for _, r := range strings.TrimSpace(sql) {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"' || r == '`':
+			quote = r
+		case r == '[':
+			quote = ']'
+		case r == ' ' || r == '\t' || r == '\n' || r == '\r':
+			space = true
+			continue
+		}
+		if space {
+			sb.WriteByte(' ')
+			space = false
+		}
+		sb.WriteRune(r)
+	}
+	return strings.TrimRight(strings.TrimSpace(sb.String()), "; ")
+}
+
+// Get returns the content stored under key, entries found on disk are moved back to memory
+func (c *Cache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+	e := el.Value.(*entry)
+	if c.opts.TTL > 0 && c.now().Sub(e.storedAt) > c.opts.TTL {
+		c.remove(el)
+		c.stats.Misses++
+		return nil, false
+	}
+	if !e.spilled {
+		c.memory.MoveToFront(el)
+		c.stats.Hits++
+		return e.content, true
+	}
+	content, err := ioutil.ReadFile(c.spillPath(key))
+	if err != nil {
+		c.remove(el)
+		c.stats.Misses++
+		return nil, false
+	}
+	c.remove(el)
+	c.insert(&entry{key: key, content: content, size: int64(len(content)), storedAt: e.storedAt})
+	c.stats.Hits++
+	c.stats.DiskHits++
+	return content, true
+}
+
+// Put stores content under key, content larger than the cache is ignored
+func (c *Cache) Put(key string, content []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+	if int64(len(content)) > c.opts.MaxBytes {
+		return
+	}
+	c.insert(&entry{key: key, content: content, size: int64(len(content)), storedAt: c.now()})
+}
+
+// Stats returns the counters of the cache
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.stats
+	s.Entries = len(c.entries)
+	return s
+}
+
+func (c *Cache) insert(e *entry) {
+	c.entries[e.key] = c.memory.PushFront(e)
+	c.stats.Bytes += e.size
+	for c.stats.Bytes > c.opts.MaxBytes {
+		c.spill(c.memory.Back())
+	}
+}
+
+// spill moves el from memory to disk, or drops it when spilling is disabled
+func (c *Cache) spill(el *list.Element) {
+	e := el.Value.(*entry)
+	if c.opts.Dir == "" || e.size > c.opts.MaxDiskBytes {
+		c.remove(el)
+		c.stats.Evictions++
+		return
+	}
+	c.memory.Remove(el)
+	c.stats.Bytes -= e.size
+	err := ioutil.WriteFile(c.spillPath(e.key), e.content, 0644)
+	if err != nil {
+		delete(c.entries, e.key)
+		c.stats.Evictions++
+		return
+	}
+	e.content, e.spilled = nil, true
+	c.entries[e.key] = c.onDisk.PushFront(e)
+	c.stats.DiskBytes += e.size
+	for c.stats.DiskBytes > c.opts.MaxDiskBytes {
+		c.remove(c.onDisk.Back())
+		c.stats.Evictions++
+	}
+}
+
+func (c *Cache) remove(el *list.Element) {
+	e := el.Value.(*entry)
+	delete(c.entries, e.key)
+	if e.spilled {
+		c.onDisk.Remove(el)
+		c.stats.DiskBytes -= e.size
+		os.Remove(c.spillPath(e.key))
+		return
+	}
+	c.memory.Remove(el)
+	c.stats.Bytes -= e.size
+}
+
+func (c *Cache) spillPath(key string) string {
+	return filepath.Join(c.opts.Dir, key+spillExt)
+}
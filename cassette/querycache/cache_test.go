@@ -0,0 +1,112 @@
+package querycache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNormalizeSQL(t *testing.T) {
+	for _, c := range []struct {
+		sql      string
+		expected string
+	}{
+		{"select 1", "select 1"},
+		{"  select\n\t1 ;; ", "select 1"},
+		{"select 'a  b',  \"c  d\" from   [e  f]", "select 'a  b', \"c  d\" from [e  f]"},
+	} {
+		if actual := NormalizeSQL(c.sql); actual != c.expected {
+			t.Errorf("NormalizeSQL(%q) should be %q got %q", c.sql, c.expected, actual)
+		}
+	}
+
+	digest := []byte("digest")
+	base := Key(digest, "select ?", []interface{}{int64(1)}, "json")
+	if Key(digest, "select  ?;", []interface{}{int64(1)}, "json") != base {
+		t.Error("Formatting changes should not change the key")
+	}
+	for name, other := range map[string]string{
+		"digest":     Key([]byte("other"), "select ?", []interface{}{int64(1)}, "json"),
+		"param type": Key(digest, "select ?", []interface{}{"1"}, "json"),
+		"variant":    Key(digest, "select ?", []interface{}{int64(1)}, "csv"),
+	} {
+		if other == base {
+			t.Errorf("Changing the %v should change the key", name)
+		}
+	}
+}
+
+func TestCache(t *testing.T) {
+	cache, err := New(Options{MaxBytes: 10, TTL: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	cache.Put("a", []byte("aaaa"))
+	cache.Put("b", []byte("bbbb"))
+	if _, ok := cache.Get("a"); !ok {
+		t.Fatal("a should be cached")
+	}
+	// b is the least recently used entry
+	cache.Put("c", []byte("cccc"))
+	if _, ok := cache.Get("b"); ok {
+		t.Fatal("b should have been evicted")
+	}
+	cache.Put("too-big", []byte("0123456789abc"))
+	if _, ok := cache.Get("too-big"); ok {
+		t.Fatal("Entries larger than the cache should be ignored")
+	}
+
+	now = now.Add(2 * time.Minute)
+	if _, ok := cache.Get("a"); ok {
+		t.Fatal("a should have expired")
+	}
+	stats := cache.Stats()
+	expected := Stats{Hits: 1, Misses: 3, Evictions: 1, Entries: 1, Bytes: 4}
+	if stats != expected {
+		t.Fatalf("Expecting stats %#v got %#v", expected, stats)
+	}
+}
+
+func TestCacheSpill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "boombox-querycache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "stale"+spillExt), []byte("stale"), 0644)
+
+	cache, err := New(Options{MaxBytes: 4, Dir: dir, MaxDiskBytes: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "stale"+spillExt)); !os.IsNotExist(err) {
+		t.Fatal("Files from previous caches should be removed")
+	}
+	cache.Put("a", []byte("aaaa"))
+	cache.Put("b", []byte("bbbb"))
+	cache.Put("c", []byte("cccc"))
+	if stats := cache.Stats(); stats.Bytes != 4 || stats.DiskBytes != 8 {
+		t.Fatalf("a and b should have been spilled to disk, got %#v", stats)
+	}
+	content, ok := cache.Get("a")
+	if !ok || string(content) != "aaaa" {
+		t.Fatalf("a should be read from disk, got %q", content)
+	}
+	// reading a moves it back to memory, which spills c
+	if _, err := os.Stat(filepath.Join(dir, "a"+spillExt)); !os.IsNotExist(err) {
+		t.Fatal("a should have been removed from disk")
+	}
+	cache.Put("d", []byte("dddd"))
+	if _, ok := cache.Get("b"); ok {
+		t.Fatal("b should have been evicted from disk")
+	}
+	stats := cache.Stats()
+	if stats.DiskHits != 1 || stats.Evictions != 1 || stats.Entries != 3 {
+		t.Fatalf("Unexpected stats %#v", stats)
+	}
+}
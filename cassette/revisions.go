@@ -0,0 +1,135 @@
+package cassette
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+type (
+	// Revision describes one of the versions stored for a given asset,
+	// the revision with the highest number is the one being served.
+	Revision struct {
+		Revision  int64
+		MimeType  string
+		Size      int64
+		CreatedAt time.Time
+	}
+)
+
+// ListRevisions returns all revisions recorded for the given asset,
+// ordered from the oldest to the newest
+func (c *Control) ListRevisions(ctx context.Context, assetPath string) ([]Revision, error) {
+	assetPath, pathHash := c.normalizeAssetPath(assetPath)
+	id, err := c.lookupAssetID(ctx, c.db, assetPath, pathHash)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := c.db.QueryContext(ctx, `select r.revision, r.mime_type, b.size, r.created_at from asset_revisions r
+	inner join blobs b on r.content_hash = b.content_hash
+	where r.asset_id = ? order by r.revision asc`, id)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list revisions of %v, cause %w", assetPath, err)
+	}
+	defer rows.Close()
+	var out []Revision
+	for rows.Next() {
+		var r Revision
+		var createdAt int64
+		err = rows.Scan(&r.Revision, &r.MimeType, &r.Size, &createdAt)
+		if err != nil {
+			return nil, fmt.Errorf("unable to scan revision of %v, cause %w", assetPath, err)
+		}
+		r.CreatedAt = time.UnixMilli(createdAt).UTC()
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+// RollbackAsset restores the content and mime-type of the asset to the given revision.
+//
+// History is never rewritten, instead a new revision is recorded with the old content,
+// which means a rollback can be undone by another rollback.
+func (c *Control) RollbackAsset(ctx context.Context, assetPath string, revision int64) (int64, error) {
+	if !c.writeable {
+		return 0, ReadonlyCassette{}
+	}
+	assetPath, pathHash := c.normalizeAssetPath(assetPath)
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("unable to start transaction to rollback %v, cause %w", assetPath, err)
+	}
+	defer tx.Rollback()
+	id, err := c.lookupAssetID(ctx, tx, assetPath, pathHash)
+	if err != nil {
+		return 0, err
+	}
+	var mt string
+	var contentHash string
+	err = tx.QueryRowContext(ctx, `select mime_type, content_hash from asset_revisions where asset_id = ? and revision = ?`, id, revision).Scan(&mt, &contentHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, RevisionNotFound{Path: assetPath, Revision: revision}
+	} else if err != nil {
+		return 0, fmt.Errorf("unable to load revision %v of %v, cause %w", revision, assetPath, err)
+	}
+	_, err = tx.ExecContext(ctx, `update assets set mime_type = ?, content_hash = ? where asset_id = ?`, mt, contentHash, id)
+	if err != nil {
+		return 0, fmt.Errorf("unable to rollback %v to revision %v, cause %w", assetPath, revision, err)
+	}
+	err = c.dropVariants(ctx, tx, id)
+	if err != nil {
+		return 0, err
+	}
+	newRevision, err := recordRevision(ctx, tx, id, mt, contentHash)
+	if err != nil {
+		return 0, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, fmt.Errorf("unable to rollback %v to revision %v, cause %w", assetPath, revision, err)
+	}
+	return newRevision, nil
+}
+
+// recordRevision stores contentHash as the next revision of the asset
+func recordRevision(ctx context.Context, tx dbtx, assetID int64, mimetype string, contentHash string) (int64, error) {
+	var revision int64
+	err := tx.QueryRowContext(ctx, `insert into asset_revisions(asset_id, revision, mime_type, content_hash, created_at)
+	select ?, coalesce(max(revision), 0) + 1, ?, ?, ? from asset_revisions where asset_id = ?
+	returning revision`, assetID, mimetype, contentHash, time.Now().UnixMilli(), assetID).Scan(&revision)
+	if err != nil {
+		return 0, fmt.Errorf("unable to record revision for asset %v, cause %w", assetID, err)
+	}
+	return revision, nil
+}
+
+func (c *Control) lookupAssetID(ctx context.Context, tx dbtx, assetPath string, pathHash int64) (int64, error) {
+	var id int64
+	err := tx.QueryRowContext(ctx, `select asset_id from assets where path_hash64 = ? and path = ?`, pathHash, assetPath).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, AssetNotFound{Path: assetPath}
+	} else if err != nil {
+		return 0, fmt.Errorf("unable to load %v from cassete, cause %w", assetPath, err)
+	}
+	return id, nil
+}
+
+// removeAsset deletes the asset with all its revisions, variants and routes,
+// blobs which are no longer referenced are removed as well.
+func (c *Control) removeAsset(ctx context.Context, tx dbtx, assetID int64) error {
+	for _, stmt := range []string{
+		`delete from routes where asset_id = ?`,
+		`delete from codebase where asset_id = ?`,
+		`delete from asset_variants where asset_id = ?`,
+		`delete from asset_revisions where asset_id = ?`,
+		`delete from assets where asset_id = ?`,
+	} {
+		_, err := tx.ExecContext(ctx, stmt, assetID)
+		if err != nil {
+			return fmt.Errorf("unable to remove asset %v, cause %w", assetID, err)
+		}
+	}
+	return c.pruneBlobs(ctx, tx)
+}
@@ -0,0 +1,441 @@
+package cassette
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type (
+	// RouteOptions changes how a route is served,
+	// zero values mean the server defaults are used
+	RouteOptions struct {
+		// Timeout limits how long the code handling the route can run
+		Timeout time.Duration `json:"timeout,omitempty"`
+		// MaxBody is the largest request body accepted, in bytes
+		MaxBody int64 `json:"max_body,omitempty"`
+		// Cache is sent as the Cache-Control header
+		Cache string `json:"cache,omitempty"`
+		// ContentType is sent as the Content-Type header
+		ContentType string `json:"content_type,omitempty"`
+	}
+
+	// RouteHandler is a path registered in the HTTP router,
+	// Source describes where the handler comes from (an asset, a route...)
+	RouteHandler struct {
+		Method string
+		Path   string
+		Source string
+		// Asset is the asset served by the handler, if any
+		Asset string
+		// Route is the route served by the handler, if any
+		Route string
+	}
+
+	// RouteConflict describes a handler which cannot be registered,
+	// Other is empty when the path itself is invalid
+	RouteConflict struct {
+		Handler RouteHandler
+		Other   RouteHandler
+		Reason  string
+	}
+)
+
+var (
+	byteUnits = map[string]int64{
+		"":    1,
+		"B":   1,
+		"KB":  1_000,
+		"MB":  1_000_000,
+		"GB":  1_000_000_000,
+		"KIB": 1 << 10,
+		"MIB": 1 << 20,
+		"GIB": 1 << 30,
+	}
+
+	// InternalPaths are served by every cassette, in addition to its assets and routes
+	InternalPaths = []string{"/.internals/asset-list", "/.internals/manifest", "/.queries", "/.queries/:name"}
+
+	allowedMethods = map[string]bool{
+		"GET":     true,
+		"HEAD":    true,
+		"POST":    true,
+		"PUT":     true,
+		"PATCH":   true,
+		"DELETE":  true,
+		"OPTIONS": true,
+	}
+
+	reWildcardName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// ParseRouteOptions converts the options table given to add_route,
+// timeout accepts a duration ("2s", "500ms") or a number of seconds and
+// max_body accepts a size ("1MB", "64KiB") or a number of bytes.
+func ParseRouteOptions(values map[string]interface{}) (RouteOptions, error) {
+	var opts RouteOptions
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := values[k]
+		var err error
+		switch k {
+		case "timeout":
+			opts.Timeout, err = parseTimeout(v)
+		case "max_body":
+			opts.MaxBody, err = parseByteSize(v)
+		case "cache":
+			opts.Cache, err = optionString(v)
+		case "content_type":
+			opts.ContentType, err = optionString(v)
+		default:
+			err = fmt.Errorf("unknown option")
+		}
+		if err != nil {
+			return RouteOptions{}, InvalidRouteOptions{Option: k, Reason: err.Error()}
+		}
+	}
+	return opts, nil
+}
+
+// IsZero returns true if none of the options is set
+func (o RouteOptions) IsZero() bool {
+	return o == RouteOptions{}
+}
+
+func (o RouteOptions) encode() (string, error) {
+	buf, err := json.Marshal(o)
+	if err != nil {
+		return "", fmt.Errorf("unable to encode route options, cause %w", err)
+	}
+	return string(buf), nil
+}
+
+func decodeRouteOptions(content string) (RouteOptions, error) {
+	var o RouteOptions
+	err := json.Unmarshal([]byte(content), &o)
+	if err != nil {
+		return RouteOptions{}, fmt.Errorf("unable to decode route options, cause %w", err)
+	}
+	return o, nil
+}
+
+func parseTimeout(v interface{}) (time.Duration, error) {
+	var d time.Duration
+	switch v := v.(type) {
+	case float64:
+		d = time.Duration(v * float64(time.Second))
+	case string:
+		var err error
+		d, err = time.ParseDuration(v)
+		if err != nil {
+			return 0, err
+		}
+	default:
+		return 0, fmt.Errorf("expecting a duration got %T", v)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("must be positive")
+	}
+	return d, nil
+}
+
+func parseByteSize(v interface{}) (int64, error) {
+	var size int64
+	switch v := v.(type) {
+	case float64:
+		size = int64(v)
+	case string:
+		str := strings.TrimSpace(v)
+		idx := strings.IndexFunc(str, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+		if idx < 0 {
+			idx = len(str)
+		}
+		unit, ok := byteUnits[strings.ToUpper(strings.TrimSpace(str[idx:]))]
+		if !ok {
+			return 0, fmt.Errorf("unknown unit in %q", v)
+		}
+		n, err := strconv.ParseFloat(str[:idx], 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid size %q", v)
+		}
+		size = int64(n * float64(unit))
+	default:
+		return 0, fmt.Errorf("expecting a size got %T", v)
+	}
+	if size <= 0 {
+		return 0, fmt.Errorf("must be positive")
+	}
+	return size, nil
+}
+
+func optionString(v interface{}) (string, error) {
+	str, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("expecting a string got %T", v)
+	}
+	if strings.ContainsAny(str, "\r\n") {
+		return "", fmt.Errorf("header values cannot contain line breaks")
+	}
+	return str, nil
+}
+
+// ValidateRoute checks if methods and route can be registered in the HTTP router,
+// route parameters (:name) and catch-all parameters (*name) must span a whole
+// path segment and catch-all parameters are only allowed at the end of the route.
+func ValidateRoute(methods []string, route string) error {
+	if len(methods) == 0 {
+		return InvalidRoute{Route: route, Reason: "at least one method is required"}
+	}
+	for _, m := range methods {
+		if !allowedMethods[strings.ToUpper(m)] {
+			return InvalidRoute{Route: route, Reason: fmt.Sprintf("method %q is not supported", m)}
+		}
+	}
+	if err := validateRoutePath(route); err != nil {
+		return InvalidRoute{Route: route, Reason: err.Error()}
+	}
+	return nil
+}
+
+func validateRoutePath(route string) error {
+	if !strings.HasPrefix(route, "/") {
+		return fmt.Errorf("must start with /")
+	}
+	if strings.ContainsAny(route, "?#") {
+		return fmt.Errorf("cannot contain a query string or fragment")
+	}
+	for _, r := range route {
+		if r <= ' ' || r == 0x7f {
+			return fmt.Errorf("cannot contain spaces or control characters")
+		}
+	}
+	segments := pathSegments(route)
+	for i, seg := range segments {
+		switch {
+		case seg == "" && i < len(segments)-1:
+			return fmt.Errorf("cannot contain empty segments")
+		case seg == "." || seg == "..":
+			return fmt.Errorf("cannot contain relative segments")
+		case isWildcard(seg):
+			if !reWildcardName.MatchString(seg[1:]) {
+				return fmt.Errorf("parameter %v must have a valid name", seg)
+			}
+			if seg[0] == '*' && i < len(segments)-1 {
+				return fmt.Errorf("catch-all parameter %v must be the last segment", seg)
+			}
+		case strings.ContainsAny(seg, ":*"):
+			return fmt.Errorf("parameters must span a whole segment, got %v", seg)
+		}
+	}
+	return nil
+}
+
+// RouteHandlers returns every handler served by the cassette: each asset (and the directory
+// of index.html files), the internal endpoints (see InternalPaths) and each method of the routes
+// under /api. Handlers are returned in the order they are registered in the HTTP router.
+func (c *Control) RouteHandlers(ctx context.Context) ([]RouteHandler, error) {
+	return c.routeHandlers(ctx, c.db)
+}
+
+// ValidateRoutes checks if all handlers of the cassette can be registered in the HTTP router,
+// the error lists every conflict found.
+func (c *Control) ValidateRoutes(ctx context.Context) error {
+	handlers, err := c.RouteHandlers(ctx)
+	if err != nil {
+		return err
+	}
+	if conflicts := FindRouteConflicts(handlers); len(conflicts) > 0 {
+		return RouteConflicts{Conflicts: conflicts}
+	}
+	return nil
+}
+
+func (c *Control) routeHandlers(ctx context.Context, db dbtx) ([]RouteHandler, error) {
+	// using reverse order makes longer paths to appear before smaller ones
+	// which makes handling `index.html` default much simpler
+	assets, err := queryStrings(ctx, db, `select path from assets order by path desc`)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list assets, cause %w", err)
+	}
+	var handlers []RouteHandler
+	for _, s := range assets {
+		source := fmt.Sprintf("asset %v", s)
+		handlers = append(handlers, RouteHandler{Method: "GET", Path: fmt.Sprintf("/%v", s), Source: source, Asset: s})
+		if path.Base(s) == "index.html" {
+			dir := path.Dir(s)
+			if dir == "." {
+				dir = "/"
+			}
+			switch {
+			case !strings.HasPrefix(dir, "/") && !strings.HasSuffix(dir, "/"):
+				dir = fmt.Sprintf("/%v/", dir)
+			case !strings.HasPrefix(dir, "/"):
+				dir = fmt.Sprintf("/%v", dir)
+			case !strings.HasSuffix(dir, "/"):
+				dir = fmt.Sprintf("%v/", dir)
+			}
+			handlers = append(handlers, RouteHandler{Method: "GET", Path: dir, Source: source, Asset: s})
+		}
+	}
+	for _, p := range InternalPaths {
+		handlers = append(handlers, RouteHandler{Method: "GET", Path: p, Source: "internal"})
+	}
+	rows, err := db.QueryContext(ctx, `select r.route, r.methods from routes r
+	inner join codebase c on r.asset_id = c.asset_id
+	inner join assets a on c.asset_id = a.asset_id
+	order by r.route asc`)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list routes, cause %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var route, methods string
+		err = rows.Scan(&route, &methods)
+		if err != nil {
+			return nil, fmt.Errorf("unable to list routes, cause %w", err)
+		}
+		apiRoute := path.Join("/api", route)
+		for _, m := range strings.Split(strings.ToUpper(methods), "|") {
+			handlers = append(handlers, RouteHandler{Method: m, Path: apiRoute, Source: fmt.Sprintf("route %v", route), Route: route})
+		}
+	}
+	return handlers, rows.Err()
+}
+
+// routeConflicts returns the conflicts which involve route
+func (c *Control) routeConflicts(ctx context.Context, db dbtx, route string) ([]RouteConflict, error) {
+	handlers, err := c.routeHandlers(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	var out []RouteConflict
+	for _, conflict := range FindRouteConflicts(handlers) {
+		if conflict.Handler.Route == route || conflict.Other.Route == route {
+			out = append(out, conflict)
+		}
+	}
+	return out, nil
+}
+
+// FindRouteConflicts returns every handler which would make the HTTP router reject the
+// list of handlers, either because its path is invalid or because it conflicts with
+// another handler registered for the same method.
+func FindRouteConflicts(handlers []RouteHandler) []RouteConflict {
+	var conflicts []RouteConflict
+	type entry struct {
+		handler  RouteHandler
+		segments []string
+		wildcard bool
+	}
+	byMethod := map[string][]entry{}
+	var methods []string
+	for _, h := range handlers {
+		switch {
+		case h.Route != "":
+			// only routes are written by hand, asset paths come from
+			// file names and are served as they are
+			if err := validateRoutePath(h.Path); err != nil {
+				conflicts = append(conflicts, RouteConflict{Handler: h, Reason: err.Error()})
+				continue
+			}
+		case h.ExactMatch():
+			// served outside of the router, so it cannot conflict with other handlers
+			continue
+		}
+		e := entry{handler: h, segments: pathSegments(h.Path)}
+		for _, seg := range e.segments {
+			e.wildcard = e.wildcard || isWildcard(seg)
+		}
+		if _, ok := byMethod[h.Method]; !ok {
+			methods = append(methods, h.Method)
+		}
+		byMethod[h.Method] = append(byMethod[h.Method], e)
+	}
+	for _, m := range methods {
+		entries := byMethod[m]
+		static := map[string]RouteHandler{}
+		for i, e := range entries {
+			if !e.wildcard {
+				// static paths only conflict with identical paths,
+				// which keeps this check linear for the common case of many assets
+				if first, ok := static[e.handler.Path]; ok {
+					conflicts = append(conflicts, RouteConflict{Handler: e.handler, Other: first, Reason: "duplicate path"})
+				} else {
+					static[e.handler.Path] = e.handler
+				}
+				continue
+			}
+			for j, other := range entries {
+				if j == i || (other.wildcard && j > i) {
+					continue
+				}
+				if reason := segmentsConflict(e.segments, other.segments); reason != "" {
+					conflicts = append(conflicts, RouteConflict{Handler: e.handler, Other: other.handler, Reason: reason})
+				}
+			}
+		}
+	}
+	return conflicts
+}
+
+// ExactMatch returns true when the path of an asset contains : or *, which the HTTP router
+// would read as parameters. Those assets are matched by their exact path instead
+// and only when no other handler matches the request.
+func (h RouteHandler) ExactMatch() bool {
+	return h.Asset != "" && strings.ContainsAny(h.Path, ":*")
+}
+
+func (r RouteConflict) String() string {
+	if r.Other.Path == "" {
+		return fmt.Sprintf("%v %v (%v): %v", r.Handler.Method, r.Handler.Path, r.Handler.Source, r.Reason)
+	}
+	return fmt.Sprintf("%v %v (%v) conflicts with %v (%v): %v", r.Handler.Method, r.Handler.Path, r.Handler.Source,
+		r.Other.Path, r.Other.Source, r.Reason)
+}
+
+// segmentsConflict mimics the rules used by httprouter when building its tree
+func segmentsConflict(a, b []string) string {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		x, y := a[i], b[i]
+		wx, wy := isWildcard(x), isWildcard(y)
+		switch {
+		case x == y:
+			continue
+		case !wx && !wy:
+			return ""
+		case (x == "" && y[0] == ':') || (y == "" && x[0] == ':'):
+			// a trailing slash never matches a parameter, which cannot be empty
+			return ""
+		case wx && wy:
+			return fmt.Sprintf("parameter %v conflicts with parameter %v", x, y)
+		case wx && x[0] == '*', wy && y[0] == '*':
+			return "catch-all parameter conflicts with another path in the same segment"
+		case wx:
+			return fmt.Sprintf("parameter %v conflicts with static segment %q", x, y)
+		default:
+			return fmt.Sprintf("static segment %q conflicts with parameter %v", x, y)
+		}
+	}
+	if len(a) == len(b) {
+		return "duplicate path"
+	}
+	return ""
+}
+
+func pathSegments(p string) []string {
+	return strings.Split(strings.TrimPrefix(p, "/"), "/")
+}
+
+func isWildcard(segment string) bool {
+	return len(segment) > 0 && (segment[0] == ':' || segment[0] == '*')
+}
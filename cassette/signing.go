@@ -0,0 +1,307 @@
+package cassette
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"time"
+)
+
+const (
+	digestVersion = "boombox-cassette-digest-v1"
+)
+
+type (
+	// Signature is a signature stored in the cassette
+	Signature struct {
+		PublicKey ed25519.PublicKey
+		Signature []byte
+		Digest    []byte
+		SignedAt  time.Time
+	}
+)
+
+// Digest computes a canonical hash over the content of the cassette:
+// manifest, assets and their variants, codebase, routes, queries and dataset tables.
+//
+// Revisions and signatures are not part of the digest,
+// as they do not change what the cassette serves.
+//
+// Assets are represented by their content hash, so the content of every blob
+// is checked against its hash before, returning CorruptBlob on any mismatch.
+func (c *Control) Digest(ctx context.Context) ([]byte, error) {
+	if c.datadb == nil {
+		return nil, DatasetNotAllowed{}
+	}
+	err := c.checkBlobs(ctx, c.db)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	io.WriteString(h, digestVersion)
+	io.WriteString(h, "\n")
+	for _, section := range []struct {
+		name  string
+		query string
+	}{
+		{"manifest", `select content from manifest`},
+		{"assets", `select path, mime_type, content_hash from assets order by path asc`},
+		{"codebase", `select a.path from codebase c inner join assets a on c.asset_id = a.asset_id order by a.path asc`},
+		{"routes", `select r.route, r.methods, a.path from routes r inner join assets a on r.asset_id = a.asset_id order by r.route asc`},
+	} {
+		err := digestRows(ctx, h, c.db, section.name, section.query)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// route options were introduced after the first version of the digest,
+	// the section is omitted when unused to keep existing signatures valid
+	var customized int
+	err = c.db.QueryRowContext(ctx, `select count(*) from routes where options != '{}'`).Scan(&customized)
+	if err != nil {
+		return nil, fmt.Errorf("unable to compute digest of route options, cause %w", err)
+	}
+	if customized > 0 {
+		err = digestRows(ctx, h, c.db, "route options", `select route, options from routes where options != '{}' order by route asc`)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// the same applies to canned queries
+	var queries int
+	err = c.db.QueryRowContext(ctx, `select count(*) from queries`).Scan(&queries)
+	if err != nil {
+		return nil, fmt.Errorf("unable to compute digest of queries, cause %w", err)
+	}
+	if queries > 0 {
+		err = digestRows(ctx, h, c.db, "queries", `select name, sql, description, params from queries order by name asc`)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// variants are served to clients which accept their encoding
+	var variants int
+	err = c.db.QueryRowContext(ctx, `select count(*) from asset_variants`).Scan(&variants)
+	if err != nil {
+		return nil, fmt.Errorf("unable to compute digest of asset variants, cause %w", err)
+	}
+	if variants > 0 {
+		err = digestRows(ctx, h, c.db, "variants", `select a.path, v.encoding, v.content_hash from asset_variants v
+		inner join assets a on a.asset_id = v.asset_id order by a.path asc, v.encoding asc`)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var indexes int
+	err = c.datadb.QueryRowContext(ctx, `select count(*) from fts_indexes`).Scan(&indexes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to compute digest of fts indexes, cause %w", err)
+	}
+	if indexes > 0 {
+		err = digestRows(ctx, h, c.datadb, "fts indexes", `select name, source, columns from fts_indexes order by name asc`)
+		if err != nil {
+			return nil, err
+		}
+	}
+	tables, err := c.datasetTables(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range tables {
+		err = digestRows(ctx, h, c.datadb, "table "+t.Name, `select sql from sqlite_master where type = 'table' and name = ?`, t.Name)
+		if err != nil {
+			return nil, err
+		}
+		err = digestRows(ctx, h, c.datadb, "rows "+t.Name, fmt.Sprintf(`select * from %v order by rowid asc`, t.Name))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return h.Sum(nil), nil
+}
+
+// Sign computes the digest of the cassette and stores its signature,
+// a cassette might be signed by multiple keys.
+func (c *Control) Sign(ctx context.Context, key ed25519.PrivateKey) (Signature, error) {
+	if !c.writeable {
+		return Signature{}, ReadonlyCassette{}
+	}
+	digest, err := c.Digest(ctx)
+	if err != nil {
+		return Signature{}, err
+	}
+	sig := Signature{
+		PublicKey: key.Public().(ed25519.PublicKey),
+		Signature: ed25519.Sign(key, digest),
+		Digest:    digest,
+		SignedAt:  time.Now().UTC(),
+	}
+	_, err = c.db.ExecContext(ctx, `insert into signatures(public_key, signature, digest, signed_at) values (?, ?, ?, ?)
+	on conflict (public_key) do update set signature = EXCLUDED.signature, digest = EXCLUDED.digest, signed_at = EXCLUDED.signed_at`,
+		hex.EncodeToString(sig.PublicKey), hex.EncodeToString(sig.Signature), hex.EncodeToString(sig.Digest), sig.SignedAt.UnixMilli())
+	if err != nil {
+		return Signature{}, fmt.Errorf("unable to store signature, cause %w", err)
+	}
+	return sig, nil
+}
+
+// ListSignatures returns all signatures stored in the cassette
+func (c *Control) ListSignatures(ctx context.Context) ([]Signature, error) {
+	rows, err := c.db.QueryContext(ctx, `select public_key, signature, digest, signed_at from signatures order by signed_at asc`)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list signatures, cause %w", err)
+	}
+	defer rows.Close()
+	var out []Signature
+	for rows.Next() {
+		var pub, sig, digest string
+		var signedAt int64
+		err = rows.Scan(&pub, &sig, &digest, &signedAt)
+		if err != nil {
+			return nil, fmt.Errorf("unable to scan signature, cause %w", err)
+		}
+		var s Signature
+		var pubBytes []byte
+		if pubBytes, err = hex.DecodeString(pub); err == nil {
+			if s.Signature, err = hex.DecodeString(sig); err == nil {
+				s.Digest, err = hex.DecodeString(digest)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode signature, cause %w", err)
+		}
+		s.PublicKey = ed25519.PublicKey(pubBytes)
+		s.SignedAt = time.UnixMilli(signedAt).UTC()
+		out = append(out, s)
+	}
+	return out, rows.Err()
+}
+
+// Verify checks if the cassette was signed by any of the trusted keys and if
+// its content did not change after it was signed.
+//
+// If trusted is empty, any valid signature is accepted.
+func (c *Control) Verify(ctx context.Context, trusted ...ed25519.PublicKey) (Signature, error) {
+	signatures, err := c.ListSignatures(ctx)
+	if err != nil {
+		return Signature{}, err
+	}
+	if len(signatures) == 0 {
+		return Signature{}, UnsignedCassette{}
+	}
+	digest, err := c.Digest(ctx)
+	if err != nil {
+		return Signature{}, err
+	}
+	var tampered bool
+	for _, s := range signatures {
+		if len(trusted) > 0 && !containsKey(trusted, s.PublicKey) {
+			continue
+		}
+		if len(s.PublicKey) == ed25519.PublicKeySize && ed25519.Verify(s.PublicKey, digest, s.Signature) {
+			return s, nil
+		}
+		tampered = true
+	}
+	if tampered {
+		return Signature{}, InvalidSignature{}
+	}
+	return Signature{}, UntrustedSignature{}
+}
+
+// ParsePrivateKey decodes a PEM encoded (PKCS #8) ed25519 private key
+func ParsePrivateKey(data []byte) (ed25519.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("unable to decode private key, PEM block not found")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode private key, cause %w", err)
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("unable to decode private key, expecting ed25519 got %T", key)
+	}
+	return priv, nil
+}
+
+// ParsePublicKey decodes a PEM encoded (PKIX) ed25519 public key
+func ParsePublicKey(data []byte) (ed25519.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("unable to decode public key, PEM block not found")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode public key, cause %w", err)
+	}
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("unable to decode public key, expecting ed25519 got %T", key)
+	}
+	return pub, nil
+}
+
+// EncodeKeyPair returns the PEM encoding of the private (PKCS #8) and public (PKIX) keys
+func EncodeKeyPair(priv ed25519.PrivateKey) ([]byte, []byte, error) {
+	privDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, nil, err
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(priv.Public())
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER}),
+		pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}), nil
+}
+
+func containsKey(keys []ed25519.PublicKey, key ed25519.PublicKey) bool {
+	for _, k := range keys {
+		if k.Equal(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// digestRows feeds the result of query into h, each row is encoded as a JSON array
+// which gives an unambiguous and stable representation of values
+func digestRows(ctx context.Context, h hash.Hash, db dbtx, section string, query string, args ...interface{}) error {
+	fmt.Fprintf(h, "%v\n", section)
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("unable to compute digest of %v, cause %w", section, err)
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return fmt.Errorf("unable to compute digest of %v, cause %w", section, err)
+	}
+	enc := json.NewEncoder(h)
+	r := make(Row, len(columns))
+	scanTarget := make([]interface{}, len(r))
+	for i := range scanTarget {
+		scanTarget[i] = &r[i]
+	}
+	for rows.Next() {
+		err = rows.Scan(scanTarget...)
+		if err != nil {
+			return fmt.Errorf("unable to compute digest of %v, cause %w", section, err)
+		}
+		err = enc.Encode(r)
+		if err != nil {
+			return fmt.Errorf("unable to compute digest of %v, cause %w", section, err)
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,172 @@
+package cassette
+
+import (
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+const (
+	EncodingGzip   = "gzip"
+	EncodingBrotli = "br"
+)
+
+type (
+	// Variant is an alternative representation of an asset,
+	// usually a pre-compressed version of its content
+	Variant struct {
+		Encoding    string
+		ContentHash string
+		Size        int64
+	}
+)
+
+// IsCompressible returns true if assets with the given mime-type
+// are likely to benefit from compression
+func IsCompressible(mimetype string) bool {
+	if strings.HasPrefix(mimetype, "text/") {
+		return true
+	}
+	switch mimetype {
+	case "application/javascript", "application/json", "application/x-lua", "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+// ListVariants returns the encoded representations of the given asset,
+// the original content is not included in the list
+func (c *Control) ListVariants(ctx context.Context, assetPath string) ([]Variant, error) {
+	assetPath, pathHash := c.normalizeAssetPath(assetPath)
+	id, err := c.lookupAssetID(ctx, c.db, assetPath, pathHash)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := c.db.QueryContext(ctx, `select v.encoding, v.content_hash, b.size from asset_variants v
+	inner join blobs b on v.content_hash = b.content_hash
+	where v.asset_id = ? order by v.encoding asc`, id)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list variants of %v, cause %w", assetPath, err)
+	}
+	defer rows.Close()
+	var out []Variant
+	for rows.Next() {
+		var v Variant
+		err = rows.Scan(&v.Encoding, &v.ContentHash, &v.Size)
+		if err != nil {
+			return nil, fmt.Errorf("unable to scan variant of %v, cause %w", assetPath, err)
+		}
+		out = append(out, v)
+	}
+	return out, rows.Err()
+}
+
+// CopyAssetVariant writes the encoded representation of the asset to out
+func (c *Control) CopyAssetVariant(ctx context.Context, out io.Writer, assetPath string, encoding string) error {
+	assetPath, pathHash := c.normalizeAssetPath(assetPath)
+	var contentHash string
+	err := c.db.QueryRowContext(ctx, `select v.content_hash from asset_variants v
+	inner join assets a on v.asset_id = a.asset_id
+	where a.path_hash64 = ? and a.path = ? and v.encoding = ?`, pathHash, assetPath, encoding).Scan(&contentHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return VariantNotFound{Path: assetPath, Encoding: encoding}
+	} else if err != nil {
+		return fmt.Errorf("unable to load variant %v of %v, cause %w", encoding, assetPath, err)
+	}
+	err = c.copyBlob(ctx, c.db, out, contentHash)
+	if err != nil {
+		return fmt.Errorf("unable to copy variant %v of %v to destination, cause %w", encoding, assetPath, err)
+	}
+	return nil
+}
+
+// CompressAsset computes and stores the given encodings of the asset.
+//
+// Variants which are not smaller than the original content are discarded,
+// therefore the returned list might contain less items than encodings.
+func (c *Control) CompressAsset(ctx context.Context, assetPath string, encodings ...string) ([]Variant, error) {
+	if !c.writeable {
+		return nil, ReadonlyCassette{}
+	}
+	asset, err := c.StatAsset(ctx, assetPath)
+	if err != nil {
+		return nil, err
+	}
+	var out []Variant
+	for _, enc := range encodings {
+		v, stored, err := c.compressAsset(ctx, asset, enc)
+		if err != nil {
+			return nil, err
+		}
+		if stored {
+			out = append(out, v)
+		}
+	}
+	return out, nil
+}
+
+func (c *Control) compressAsset(ctx context.Context, asset Asset, encoding string) (Variant, bool, error) {
+	if _, err := newEncoder(encoding, io.Discard); err != nil {
+		return Variant{}, false, err
+	}
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Variant{}, false, fmt.Errorf("unable to start transaction to compress %v, cause %w", asset.Path, err)
+	}
+	defer tx.Rollback()
+
+	pr, pw := io.Pipe()
+	go func() {
+		enc, _ := newEncoder(encoding, pw)
+		err := c.copyBlob(ctx, c.db, enc, asset.ContentHash)
+		if err == nil {
+			err = enc.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	blob, err := storeBlob(ctx, tx, pr)
+	// unblocks the encoder in case storeBlob aborted earlier
+	pr.CloseWithError(io.ErrClosedPipe)
+	if err != nil {
+		return Variant{}, false, fmt.Errorf("unable to compress %v using %v, cause %w", asset.Path, encoding, err)
+	}
+	if blob.size >= asset.Size {
+		return Variant{}, false, nil
+	}
+	_, err = tx.ExecContext(ctx, `insert into asset_variants(asset_id, encoding, content_hash) values (?, ?, ?)
+	on conflict (asset_id, encoding) do update set content_hash = EXCLUDED.content_hash`, asset.ID, encoding, blob.hash)
+	if err != nil {
+		return Variant{}, false, fmt.Errorf("unable to store variant %v of %v, cause %w", encoding, asset.Path, err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return Variant{}, false, fmt.Errorf("unable to store variant %v of %v, cause %w", encoding, asset.Path, err)
+	}
+	return Variant{Encoding: encoding, ContentHash: blob.hash, Size: blob.size}, true, nil
+}
+
+// dropVariants removes all variants of the asset, it must be called
+// whenever the content of the asset changes
+func (c *Control) dropVariants(ctx context.Context, tx dbtx, assetID int64) error {
+	_, err := tx.ExecContext(ctx, `delete from asset_variants where asset_id = ?`, assetID)
+	if err != nil {
+		return fmt.Errorf("unable to remove stale variants of asset %v, cause %w", assetID, err)
+	}
+	return nil
+}
+
+func newEncoder(encoding string, out io.Writer) (io.WriteCloser, error) {
+	switch encoding {
+	case EncodingGzip:
+		return gzip.NewWriterLevel(out, gzip.BestCompression)
+	case EncodingBrotli:
+		return brotli.NewWriterLevel(out, brotli.BestCompression), nil
+	}
+	return nil, UnsupportedEncoding{Encoding: encoding}
+}
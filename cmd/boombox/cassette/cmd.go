@@ -1,13 +1,43 @@
 package cassette
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
 	"github.com/andrebq/boombox/cassette"
+	"github.com/andrebq/boombox/cassette/diff"
+	"github.com/andrebq/boombox/cassette/exporter"
 	"github.com/andrebq/boombox/cassette/importer"
+	"github.com/andrebq/boombox/cmd/boombox/keys"
 	"github.com/urfave/cli/v2"
 )
 
 func Cmd() *cli.Command {
 	var tape string
+	subcommands := []*cli.Command{
+		importCmd(&tape),
+		exportCmd(&tape),
+		packCmd(&tape),
+		unpackCmd(&tape),
+		fsckCmd(&tape),
+		rmCmd(&tape),
+		unrouteCmd(&tape),
+		dropTableCmd(&tape),
+		revisionsCmd(&tape),
+		rollbackCmd(&tape),
+		migrateCmd(&tape),
+		signCmd(&tape),
+		verifyCmd(&tape),
+	}
+	for _, sc := range subcommands {
+		sc.Before = requireTape(&tape)
+	}
 	return &cli.Command{
 		Name:    "cassette",
 		Aliases: []string{"k7", "tapes"},
@@ -15,20 +45,34 @@ func Cmd() *cli.Command {
 			&cli.StringFlag{
 				Name:        "file",
 				Aliases:     []string{"f"},
-				Usage:       "Filepath to the the cassette tape",
-				Required:    true,
+				Usage:       "Filepath to the the cassette tape (required by all commands except diff)",
 				Destination: &tape,
 			},
 		},
-		Subcommands: []*cli.Command{
-			importCmd(&tape),
-		},
+		// diff receives both tapes as arguments
+		Subcommands: append(subcommands, diffCmd()),
+	}
+}
+
+// hasDataset returns true if the cassette directory contains a dataset database
+func hasDataset(tape string) bool {
+	_, err := os.Stat(filepath.Join(tape, "datak7.db"))
+	return err == nil
+}
+
+func requireTape(tape *string) cli.BeforeFunc {
+	return func(ctx *cli.Context) error {
+		if *tape == "" {
+			return errors.New(`Required flag "file" not set`)
+		}
+		return nil
 	}
 }
 
 func importCmd(tape *string) *cli.Command {
 	var dir string
 	var nocode bool
+	var compress cli.StringSlice
 	return &cli.Command{
 		Name:    "import",
 		Aliases: []string{"i"},
@@ -44,15 +88,455 @@ func importCmd(tape *string) *cli.Command {
 				Usage:       "Disable codebase imports",
 				Destination: &nocode,
 			},
+			&cli.StringSliceFlag{
+				Name:        "compress",
+				Usage:       "Store pre-compressed variants of compressible assets (gzip, br)",
+				Destination: &compress,
+			},
 		},
 		Action: func(ctx *cli.Context) error {
 			k7, err := cassette.LoadControlCassette(ctx.Context, *tape, true, true)
 			if err != nil {
 				return err
 			}
-			err = importer.Directory(ctx.Context, k7, dir, !nocode)
+			err = importer.Directory(ctx.Context, k7, dir, !nocode, compress.Value()...)
 			k7.Close()
 			return err
 		},
 	}
 }
+
+func exportCmd(tape *string) *cli.Command {
+	var dir string
+	return &cli.Command{
+		Name:    "export",
+		Aliases: []string{"e"},
+		Usage:   "Write the content of the cassette to a directory which can be imported again",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "dir",
+				Usage:       "Directory where the cassette will be exported",
+				Required:    true,
+				Destination: &dir,
+			},
+		},
+		Action: func(ctx *cli.Context) error {
+			k7, err := cassette.LoadControlCassette(ctx.Context, *tape, false, true)
+			if err != nil {
+				return err
+			}
+			defer k7.Close()
+			return exporter.Directory(ctx.Context, k7, dir)
+		},
+	}
+}
+
+func packCmd(tape *string) *cli.Command {
+	var output string
+	return &cli.Command{
+		Name:  "pack",
+		Usage: "Create a single-file bundle (.k7) with the content of the cassette",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "output",
+				Aliases:     []string{"o"},
+				Usage:       "Path of the bundle, defaults to the path of the cassette with the .k7 extension",
+				Destination: &output,
+			},
+		},
+		Action: func(ctx *cli.Context) error {
+			if output == "" {
+				output = filepath.Clean(*tape) + cassette.BundleExtension
+			}
+			k7, err := cassette.LoadControlCassette(ctx.Context, *tape, false, hasDataset(*tape))
+			if err != nil {
+				return err
+			}
+			defer k7.Close()
+			fd, err := os.OpenFile(output, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+			if err != nil {
+				return err
+			}
+			files, err := k7.Pack(ctx.Context, fd)
+			if closeErr := fd.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				os.Remove(output)
+				return err
+			}
+			for _, f := range files {
+				fmt.Fprintf(ctx.App.Writer, "%v  %v (%v bytes)\n", f.SHA256, f.Name, f.Size)
+			}
+			fmt.Fprintf(ctx.App.Writer, "bundle written to %v\n", output)
+			return nil
+		},
+	}
+}
+
+func unpackCmd(tape *string) *cli.Command {
+	var bundle string
+	return &cli.Command{
+		Name:  "unpack",
+		Usage: "Extract a single-file bundle (.k7) into the cassette directory",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "bundle",
+				Aliases:     []string{"b"},
+				Usage:       "Path of the bundle to extract",
+				Required:    true,
+				Destination: &bundle,
+			},
+		},
+		Action: func(ctx *cli.Context) error {
+			fd, err := os.Open(bundle)
+			if err != nil {
+				return err
+			}
+			defer fd.Close()
+			files, err := cassette.Unpack(ctx.Context, fd, *tape)
+			if err != nil {
+				return err
+			}
+			for _, f := range files {
+				fmt.Fprintf(ctx.App.Writer, "%v  %v (%v bytes)\n", f.SHA256, f.Name, f.Size)
+			}
+			return nil
+		},
+	}
+}
+
+func fsckCmd(tape *string) *cli.Command {
+	var repair bool
+	return &cli.Command{
+		Name:  "fsck",
+		Usage: "Check the consistency of the cassette",
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:        "repair",
+				Usage:       "Fix the problems which can be repaired safely",
+				Destination: &repair,
+			},
+		},
+		Action: func(ctx *cli.Context) error {
+			k7, err := cassette.LoadControlCassette(ctx.Context, *tape, repair, hasDataset(*tape))
+			if err != nil {
+				return err
+			}
+			defer k7.Close()
+			problems, err := k7.Fsck(ctx.Context, repair)
+			if err != nil {
+				return err
+			}
+			if len(problems) == 0 {
+				fmt.Fprintln(ctx.App.Writer, "no problems found")
+				return nil
+			}
+			w := tabwriter.NewWriter(ctx.App.Writer, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "DATABASE\tPROBLEM\tSUBJECT\tDETAIL\tREPAIRED")
+			var pending int
+			for _, p := range problems {
+				fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n", p.Database, p.Kind, p.Subject, p.Detail, p.Repaired)
+				if !p.Repaired {
+					pending++
+				}
+			}
+			if err = w.Flush(); err != nil {
+				return err
+			}
+			if pending > 0 {
+				return cli.Exit(fmt.Sprintf("%v problem(s) were not repaired", pending), 1)
+			}
+			return nil
+		},
+	}
+}
+
+func rmCmd(tape *string) *cli.Command {
+	var assetPath string
+	return &cli.Command{
+		Name:  "rm",
+		Usage: "Delete an asset, including its revisions, variants and routes",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "path",
+				Usage:       "Path of the asset inside the cassette",
+				Required:    true,
+				Destination: &assetPath,
+			},
+		},
+		Action: func(ctx *cli.Context) error {
+			k7, err := cassette.LoadControlCassette(ctx.Context, *tape, true, false)
+			if err != nil {
+				return err
+			}
+			defer k7.Close()
+			return k7.DeleteAsset(ctx.Context, assetPath)
+		},
+	}
+}
+
+func unrouteCmd(tape *string) *cli.Command {
+	var route string
+	return &cli.Command{
+		Name:  "unroute",
+		Usage: "Remove a route, the asset which handled it is kept",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "route",
+				Usage:       "Route to remove",
+				Required:    true,
+				Destination: &route,
+			},
+		},
+		Action: func(ctx *cli.Context) error {
+			k7, err := cassette.LoadControlCassette(ctx.Context, *tape, true, false)
+			if err != nil {
+				return err
+			}
+			defer k7.Close()
+			return k7.UnmapRoute(ctx.Context, route)
+		},
+	}
+}
+
+func dropTableCmd(tape *string) *cli.Command {
+	var table string
+	return &cli.Command{
+		Name:  "drop-table",
+		Usage: "Remove a table from the dataset",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "table",
+				Usage:       "Name of the table",
+				Required:    true,
+				Destination: &table,
+			},
+		},
+		Action: func(ctx *cli.Context) error {
+			k7, err := cassette.LoadControlCassette(ctx.Context, *tape, true, true)
+			if err != nil {
+				return err
+			}
+			defer k7.Close()
+			return k7.DropDatasetTable(ctx.Context, table)
+		},
+	}
+}
+
+func diffCmd() *cli.Command {
+	var format string
+	var exitCode bool
+	return &cli.Command{
+		Name:      "diff",
+		Usage:     "Show the differences between two cassettes",
+		ArgsUsage: "<old tape> <new tape>",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "format",
+				Usage:       "Output format (text or json)",
+				Value:       "text",
+				Destination: &format,
+			},
+			&cli.BoolFlag{
+				Name:        "exit-code",
+				Usage:       "Exit with status 1 if the cassettes are different",
+				Destination: &exitCode,
+			},
+		},
+		Action: func(ctx *cli.Context) error {
+			if ctx.NArg() != 2 {
+				return fmt.Errorf("diff requires exactly two tapes, got %v", ctx.NArg())
+			}
+			if format != "text" && format != "json" {
+				return fmt.Errorf("invalid format %q, use text or json", format)
+			}
+			old, err := cassette.LoadControlCassette(ctx.Context, ctx.Args().Get(0), false, true)
+			if err != nil {
+				return err
+			}
+			defer old.Close()
+			updated, err := cassette.LoadControlCassette(ctx.Context, ctx.Args().Get(1), false, true)
+			if err != nil {
+				return err
+			}
+			defer updated.Close()
+			report, err := diff.Compare(ctx.Context, old, updated)
+			if err != nil {
+				return err
+			}
+			if format == "json" {
+				enc := json.NewEncoder(ctx.App.Writer)
+				enc.SetIndent("", "  ")
+				err = enc.Encode(report)
+			} else {
+				err = report.WriteText(ctx.App.Writer)
+			}
+			if err != nil {
+				return err
+			}
+			if exitCode && !report.Empty() {
+				return cli.Exit("", 1)
+			}
+			return nil
+		},
+	}
+}
+
+func revisionsCmd(tape *string) *cli.Command {
+	var assetPath string
+	return &cli.Command{
+		Name:  "revisions",
+		Usage: "List all revisions stored for a given asset",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "path",
+				Usage:       "Path of the asset inside the cassette",
+				Required:    true,
+				Destination: &assetPath,
+			},
+		},
+		Action: func(ctx *cli.Context) error {
+			k7, err := cassette.LoadControlCassette(ctx.Context, *tape, false, false)
+			if err != nil {
+				return err
+			}
+			defer k7.Close()
+			revisions, err := k7.ListRevisions(ctx.Context, assetPath)
+			if err != nil {
+				return err
+			}
+			w := tabwriter.NewWriter(ctx.App.Writer, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "REVISION\tMIME-TYPE\tSIZE\tCREATED AT")
+			for _, r := range revisions {
+				fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", r.Revision, r.MimeType, r.Size, r.CreatedAt.Format(time.RFC3339))
+			}
+			return w.Flush()
+		},
+	}
+}
+
+func rollbackCmd(tape *string) *cli.Command {
+	var assetPath string
+	var revision int64
+	return &cli.Command{
+		Name:  "rollback",
+		Usage: "Restore an asset to the content it had on a previous revision",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "path",
+				Usage:       "Path of the asset inside the cassette",
+				Required:    true,
+				Destination: &assetPath,
+			},
+			&cli.Int64Flag{
+				Name:        "revision",
+				Usage:       "Revision to restore (check the revisions command)",
+				Required:    true,
+				Destination: &revision,
+			},
+		},
+		Action: func(ctx *cli.Context) error {
+			k7, err := cassette.LoadControlCassette(ctx.Context, *tape, true, false)
+			if err != nil {
+				return err
+			}
+			defer k7.Close()
+			newRevision, err := k7.RollbackAsset(ctx.Context, assetPath, revision)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(ctx.App.Writer, "%v restored from revision %v as revision %v\n", assetPath, revision, newRevision)
+			return nil
+		},
+	}
+}
+
+func migrateCmd(tape *string) *cli.Command {
+	return &cli.Command{
+		Name:  "migrate",
+		Usage: "Upgrade the cassette to the latest schema version",
+		Action: func(ctx *cli.Context) error {
+			applied, err := cassette.Migrate(ctx.Context, *tape)
+			for _, m := range applied {
+				fmt.Fprintf(ctx.App.Writer, "%v: applied migration %v (%v)\n", m.Database, m.Version, m.Name)
+			}
+			if err != nil {
+				return err
+			}
+			if len(applied) == 0 {
+				fmt.Fprintln(ctx.App.Writer, "cassette is already up to date")
+			}
+			return nil
+		},
+	}
+}
+
+func signCmd(tape *string) *cli.Command {
+	var keyFile string
+	return &cli.Command{
+		Name:  "sign",
+		Usage: "Sign the content of the cassette",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "key",
+				Usage:       "File with the PEM encoded ed25519 private key (check boombox keys generate)",
+				Required:    true,
+				Destination: &keyFile,
+			},
+		},
+		Action: func(ctx *cli.Context) error {
+			data, err := ioutil.ReadFile(keyFile)
+			if err != nil {
+				return err
+			}
+			key, err := cassette.ParsePrivateKey(data)
+			if err != nil {
+				return err
+			}
+			k7, err := cassette.LoadControlCassette(ctx.Context, *tape, true, true)
+			if err != nil {
+				return err
+			}
+			defer k7.Close()
+			sig, err := k7.Sign(ctx.Context, key)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(ctx.App.Writer, "digest %x signed by %x\n", sig.Digest, sig.PublicKey)
+			return nil
+		},
+	}
+}
+
+func verifyCmd(tape *string) *cli.Command {
+	var trusted cli.StringSlice
+	return &cli.Command{
+		Name:  "verify",
+		Usage: "Verify if the cassette was signed by a trusted key and was not modified afterwards",
+		Flags: []cli.Flag{
+			&cli.StringSliceFlag{
+				Name:        "trusted-key",
+				Usage:       "File with a PEM encoded ed25519 public key, if omitted any valid signature is accepted",
+				Destination: &trusted,
+			},
+		},
+		Action: func(ctx *cli.Context) error {
+			keys, err := keys.LoadPublicKeys(trusted.Value())
+			if err != nil {
+				return err
+			}
+			k7, err := cassette.LoadControlCassette(ctx.Context, *tape, false, true)
+			if err != nil {
+				return err
+			}
+			defer k7.Close()
+			sig, err := k7.Verify(ctx.Context, keys...)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(ctx.App.Writer, "cassette signed by %x at %v\n", sig.PublicKey, sig.SignedAt.Format(time.RFC3339))
+			return nil
+		},
+	}
+}
@@ -0,0 +1,81 @@
+package keys
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/andrebq/boombox/cassette"
+	"github.com/urfave/cli/v2"
+)
+
+func Cmd() *cli.Command {
+	return &cli.Command{
+		Name:  "keys",
+		Usage: "Manage keys used to sign and verify cassettes",
+		Subcommands: []*cli.Command{
+			generateCmd(),
+		},
+	}
+}
+
+func generateCmd() *cli.Command {
+	var private, public string
+	return &cli.Command{
+		Name:    "generate",
+		Aliases: []string{"gen"},
+		Usage:   "Generate a new ed25519 key pair",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "private",
+				Usage:       "File to store the private key (keep it safe!)",
+				Required:    true,
+				Destination: &private,
+			},
+			&cli.StringFlag{
+				Name:        "public",
+				Usage:       "File to store the public key",
+				Required:    true,
+				Destination: &public,
+			},
+		},
+		Action: func(ctx *cli.Context) error {
+			_, priv, err := ed25519.GenerateKey(rand.Reader)
+			if err != nil {
+				return err
+			}
+			privPEM, pubPEM, err := cassette.EncodeKeyPair(priv)
+			if err != nil {
+				return err
+			}
+			err = ioutil.WriteFile(private, privPEM, 0600)
+			if err != nil {
+				return err
+			}
+			err = ioutil.WriteFile(public, pubPEM, 0644)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(ctx.App.Writer, "public key: %x\n", priv.Public())
+			return nil
+		},
+	}
+}
+
+// LoadPublicKeys reads the PEM encoded public keys from the given files
+func LoadPublicKeys(files []string) ([]ed25519.PublicKey, error) {
+	var out []ed25519.PublicKey
+	for _, f := range files {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		pub, err := cassette.ParsePublicKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load public key from %v, cause %w", f, err)
+		}
+		out = append(out, pub)
+	}
+	return out, nil
+}
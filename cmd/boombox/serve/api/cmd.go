@@ -1,10 +1,10 @@
 package api
 
 import (
-	"path/filepath"
+	"fmt"
 
-	"github.com/andrebq/boombox/cassette"
 	capi "github.com/andrebq/boombox/cassette/api"
+	"github.com/andrebq/boombox/cmd/boombox/keys"
 	"github.com/andrebq/boombox/internal/httpserver"
 	tplua "github.com/andrebq/boombox/internal/lua/bindings/tapedeck"
 	"github.com/andrebq/boombox/tapedeck"
@@ -15,6 +15,7 @@ import (
 func Cmd() *cli.Command {
 	bindAddr := "localhost:7008"
 	var tapes cli.StringSlice
+	var trusted cli.StringSlice
 	idxCassette := "index"
 	return &cli.Command{
 		Name:  "api",
@@ -29,7 +30,7 @@ func Cmd() *cli.Command {
 			&cli.StringSliceFlag{
 				Name:        "cassette",
 				Aliases:     []string{"t", "tape"},
-				Usage:       "Path to a control cassette (basename will be used as tape name)",
+				Usage:       "Path to a control cassette (manifest name or basename will be used as tape name)",
 				Destination: &tapes,
 			},
 			&cli.StringFlag{
@@ -39,17 +40,30 @@ func Cmd() *cli.Command {
 				Value:       idxCassette,
 				Destination: &idxCassette,
 			},
+			&cli.StringSliceFlag{
+				Name:        "trusted-key",
+				Usage:       "File with a PEM encoded ed25519 public key, when set, only cassettes signed by one of the trusted keys are loaded",
+				Destination: &trusted,
+			},
 		},
 		Action: func(ctx *cli.Context) error {
+			trustedKeys, err := keys.LoadPublicKeys(trusted.Value())
+			if err != nil {
+				return err
+			}
 			deck := tapedeck.New()
 			defer deck.Close()
 			for _, t := range tapes.Value() {
-				c, err := cassette.LoadControlCassette(ctx.Context, t, false, true)
+				name, err := deck.LoadTape(ctx.Context, t)
 				if err != nil {
 					return err
 				}
-				tapeName := filepath.Base(t)
-				deck.Load(tapeName[:len(tapeName)-len(filepath.Ext(tapeName))], c)
+				if len(trustedKeys) == 0 {
+					continue
+				}
+				if _, err := deck.Get(name).Verify(ctx.Context, trustedKeys...); err != nil {
+					return fmt.Errorf("refusing to load cassette %v, cause %w", t, err)
+				}
 			}
 			deck.IndexCassette(idxCassette)
 
@@ -1,10 +1,10 @@
 package query
 
 import (
-	"path/filepath"
+	"time"
 
-	"github.com/andrebq/boombox/cassette"
 	capi "github.com/andrebq/boombox/cassette/api"
+	"github.com/andrebq/boombox/cassette/querycache"
 	"github.com/andrebq/boombox/internal/httpserver"
 	"github.com/andrebq/boombox/tapedeck"
 	"github.com/andrebq/boombox/tapedeck/api"
@@ -14,6 +14,11 @@ import (
 func Cmd() *cli.Command {
 	bindAddr := "localhost:7008"
 	var tapes cli.StringSlice
+	cacheOpts := querycache.Options{
+		MaxBytes:     64 << 20,
+		TTL:          10 * time.Minute,
+		MaxDiskBytes: 1 << 30,
+	}
 	return &cli.Command{
 		Name:  "query",
 		Usage: "Start a boombox api/query instance",
@@ -27,23 +32,51 @@ func Cmd() *cli.Command {
 			&cli.StringSliceFlag{
 				Name:        "cassette",
 				Aliases:     []string{"t", "tape"},
-				Usage:       "Path to a control cassette (basename will be used as tape name)",
+				Usage:       "Path to a control cassette (manifest name or basename will be used as tape name)",
 				Destination: &tapes,
 			},
+			&cli.Int64Flag{
+				Name:        "cache-size",
+				Usage:       "Bytes of query results kept in memory, use 0 to disable the cache",
+				Value:       cacheOpts.MaxBytes,
+				Destination: &cacheOpts.MaxBytes,
+			},
+			&cli.DurationFlag{
+				Name:        "cache-ttl",
+				Usage:       "How long query results are cached, use 0 to keep them until they are evicted",
+				Value:       cacheOpts.TTL,
+				Destination: &cacheOpts.TTL,
+			},
+			&cli.StringFlag{
+				Name:        "cache-dir",
+				Usage:       "Directory which receives query results evicted from memory",
+				Destination: &cacheOpts.Dir,
+			},
+			&cli.Int64Flag{
+				Name:        "cache-disk-size",
+				Usage:       "Bytes of query results kept in cache-dir",
+				Value:       cacheOpts.MaxDiskBytes,
+				Destination: &cacheOpts.MaxDiskBytes,
+			},
 		},
 		Action: func(ctx *cli.Context) error {
 			deck := tapedeck.New()
 			defer deck.Close()
 			for _, t := range tapes.Value() {
-				c, err := cassette.LoadControlCassette(ctx.Context, t, false, true)
+				_, err := deck.LoadTape(ctx.Context, t)
 				if err != nil {
 					return err
 				}
-				tapeName := filepath.Base(t)
-				deck.Load(tapeName[:len(tapeName)-len(filepath.Ext(tapeName))], c)
 			}
 
 			toHandler := capi.AsQueryHandler
+			if cacheOpts.MaxBytes > 0 {
+				cache, err := querycache.New(cacheOpts)
+				if err != nil {
+					return err
+				}
+				toHandler = capi.CachedQueryHandler(cache)
+			}
 
 			handler, err := api.AsHandler(ctx.Context, deck, nil, toHandler)
 			if err != nil {
@@ -22,6 +22,8 @@ func AsHandler(ctx context.Context, apiCalls *url.URL, queryCalls *url.URL) http
 	queryProxy := httputil.NewSingleHostReverseProxy(queryCalls)
 
 	router.Handler("GET", "/:cassette/.query", queryProxy)
+	router.Handler("POST", "/:cassette/.query", queryProxy)
+	router.Handler("GET", "/:cassette/.search/:table", queryProxy)
 
 	// delegate to apiProxy if not found
 	router.NotFound = apiProxy
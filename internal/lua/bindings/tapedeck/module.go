@@ -53,47 +53,75 @@ func newCassetteObject(L *lua.LState, c *cassette.Control) *lua.LUserData {
 	meta := L.NewTable()
 	L.SetField(meta, "__index", L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
 		"query": func(L *lua.LState) int {
-			ctx := L.Context()
-			if ctx == nil {
-				L.RaiseError("Cannot perform a cassette query without a context object!")
-			}
-			if _, ok := ctx.Deadline(); !ok {
-				L.RaiseError("Cannot perform a cassette query from a lua.LState not bound to a context with deadline!")
-			}
-			log := logutil.GetOrDefault(ctx)
-			if !c.Queryable() {
-				L.RaiseError("Cassette is not queryable")
-			}
-			ud := L.CheckUserData(1)
-			if ud.Value != c {
-				L.RaiseError("Invalid condition, cannot query one cassette using another one as parameter!")
-			}
+			checkQueryable(L, c)
 			sql := L.CheckString(2)
 			var args []interface{}
 			for i := 3; i < L.GetTop(); i++ {
 				args = append(args, L.CheckString(i))
 			}
-			var out bytes.Buffer
-			// use the default max size
-			// TODO: this is unsafe, because callers could call Query multiple times and load more than 1MB of data
-			// While this might be safe for dynamic code loaded from a cassette (the cassette is more trustworthy than user-code)
-			// this function should never be used with untrusted code (aka user input!)
-			err := c.Query(ctx, &out, -1, sql, args...)
-			if err != nil {
-				// TODO: this log should be sampled
-				log.Warn().Err(err).Str("sql", sql).Msg("Unable to perform query against cassette")
-				L.RaiseError("Unable to run query against cassette, check logs for more information")
+			L.Push(queryResult(L, c, sql, args))
+			return 1
+		},
+		// search(table, text[, options]) runs a full-text search over the index of table,
+		// options accepts limit and raw (to use the FTS5 query syntax)
+		"search": func(L *lua.LState) int {
+			checkQueryable(L, c)
+			table := L.CheckString(2)
+			search := cassette.Search{Text: L.CheckString(3)}
+			if opts := L.OptTable(4, nil); opts != nil {
+				search.Limit = int(lua.LVAsNumber(opts.RawGetString("limit")))
+				search.Raw = lua.LVAsBool(opts.RawGetString("raw"))
 			}
-			var obj map[string]interface{}
-			err = json.Unmarshal(out.Bytes(), &obj)
+			sql, args, err := c.SearchQuery(L.Context(), table, search)
 			if err != nil {
-				log.Error().Err(err).Msg("This should neven happen, but a cassette query could not be decoded as JSON")
-				L.RaiseError("Unable to decode query results to an appropriate representation")
+				L.RaiseError("Unable to search %v: %v", table, err)
 			}
-			L.Push(ltoj.ToLuaValue(L, obj))
+			L.Push(queryResult(L, c, sql, args))
 			return 1
 		},
 	}))
 	L.SetMetatable(ud, meta)
 	return ud
 }
+
+// checkQueryable ensures the state can be used to query c, which must be the first argument
+func checkQueryable(L *lua.LState, c *cassette.Control) {
+	ctx := L.Context()
+	if ctx == nil {
+		L.RaiseError("Cannot perform a cassette query without a context object!")
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		L.RaiseError("Cannot perform a cassette query from a lua.LState not bound to a context with deadline!")
+	}
+	if !c.Queryable() {
+		L.RaiseError("Cassette is not queryable")
+	}
+	ud := L.CheckUserData(1)
+	if ud.Value != c {
+		L.RaiseError("Invalid condition, cannot query one cassette using another one as parameter!")
+	}
+}
+
+// queryResult runs sql and converts its JSON output to a Lua table
+func queryResult(L *lua.LState, c *cassette.Control, sql string, args []interface{}) lua.LValue {
+	ctx := L.Context()
+	log := logutil.GetOrDefault(ctx)
+	var out bytes.Buffer
+	// use the default max size
+	// TODO: this is unsafe, because callers could call Query multiple times and load more than 1MB of data
+	// While this might be safe for dynamic code loaded from a cassette (the cassette is more trustworthy than user-code)
+	// this function should never be used with untrusted code (aka user input!)
+	err := c.Query(ctx, &out, -1, sql, args...)
+	if err != nil {
+		// TODO: this log should be sampled
+		log.Warn().Err(err).Str("sql", sql).Msg("Unable to perform query against cassette")
+		L.RaiseError("Unable to run query against cassette, check logs for more information")
+	}
+	var obj map[string]interface{}
+	err = json.Unmarshal(out.Bytes(), &obj)
+	if err != nil {
+		log.Error().Err(err).Msg("This should neven happen, but a cassette query could not be decoded as JSON")
+		L.RaiseError("Unable to decode query results to an appropriate representation")
+	}
+	return ltoj.ToLuaValue(L, obj)
+}
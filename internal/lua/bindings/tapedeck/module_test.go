@@ -2,9 +2,11 @@ package tapedeck
 
 import (
 	"context"
+	"errors"
 	"testing"
 	"time"
 
+	"github.com/andrebq/boombox/cassette"
 	"github.com/andrebq/boombox/internal/lua/luadefaults"
 	"github.com/andrebq/boombox/internal/testutil"
 	lua "github.com/yuin/gopher-lua"
@@ -40,3 +42,44 @@ func TestTapedeck(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestTapedeckSearch(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	var supported bool
+	deck, cleanup := testutil.AcquirePopulatedTapedeck(ctx, t, func(ctx context.Context, name string, c *cassette.Control) error {
+		if name != "people" {
+			return nil
+		}
+		err := c.AddFTS(ctx, "people", []string{"name"})
+		if errors.As(err, &cassette.FTSNotSupported{}) {
+			return nil
+		}
+		supported = err == nil
+		return err
+	})
+	defer cleanup()
+	if !supported {
+		t.Skip("SQLite was built without FTS5, use the sqlite_fts5 build tag")
+	}
+	L := lua.NewState(lua.Options{
+		SkipOpenLibs:        true,
+		IncludeGoStackTrace: true,
+	})
+	luadefaults.InjectDynamicCodeLibs(L)
+	L.SetContext(ctx)
+	L.PreloadModule("tapedeck", OpenModule(deck))
+	err := L.DoString(`
+	local deck = require('tapedeck')
+	local resultset = deck.load('people'):search('people', 'bob', {limit=5})
+	if #resultset.rows ~= 1 then
+		error("search should return one row, got " .. #resultset.rows)
+	end
+	if resultset.rows[1][3] ~= '<mark>bob</mark>' then
+		error("snippet should highlight the name, got " .. resultset.rows[1][3])
+	end
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
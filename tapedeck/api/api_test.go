@@ -2,10 +2,14 @@ package api
 
 import (
 	"context"
+	"encoding/json"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
 	"testing"
 
 	"github.com/andrebq/boombox/cassette"
@@ -97,6 +101,53 @@ func TestDynamicPageCasseteQuery(t *testing.T) {
 		End()
 }
 
+func TestQueryPagination(t *testing.T) {
+	ctx := context.Background()
+	deck, cleanup := testutil.AcquirePopulatedTapedeck(ctx, t, nil)
+	defer cleanup()
+	handler, err := AsHandler(ctx, deck, nil, api.AsQueryHandler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type page struct {
+		Rows [][]interface{}
+		Next *string
+	}
+	fetch := func(orderBy, cursor string, expectedStatus int) page {
+		params := url.Values{}
+		params.Set("sql", "select name, age from dataset.people")
+		params.Set("orderBy", orderBy)
+		params.Set("limit", "2")
+		if cursor != "" {
+			params.Set("cursor", cursor)
+		}
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, httptest.NewRequest("GET", "/people/.query?"+params.Encode(), nil))
+		if res.Code != expectedStatus {
+			t.Fatalf("Expecting status %v got %v: %v", expectedStatus, res.Code, res.Body.String())
+		}
+		var p page
+		if expectedStatus == http.StatusOK {
+			if err := json.Unmarshal(res.Body.Bytes(), &p); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return p
+	}
+
+	first := fetch("-age", "", http.StatusOK)
+	if !reflect.DeepEqual(first.Rows, [][]interface{}{{"ana", float64(66)}, {"charlie", float64(44)}}) || first.Next == nil {
+		t.Fatalf("Unexpected first page %#v", first)
+	}
+	second := fetch("-age", *first.Next, http.StatusOK)
+	if !reflect.DeepEqual(second.Rows, [][]interface{}{{"bob", float64(22)}}) || second.Next != nil {
+		t.Fatalf("Unexpected last page %#v", second)
+	}
+	// cursors cannot be used with a different sort order
+	fetch("age", *first.Next, http.StatusBadRequest)
+	fetch("age", "not-a-cursor", http.StatusBadRequest)
+}
+
 func tempCassette(ctx context.Context, t interface {
 	Fatal(...interface{})
 	Log(...interface{})
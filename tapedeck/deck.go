@@ -1,6 +1,10 @@
 package tapedeck
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
 	"sort"
 
 	"github.com/andrebq/boombox/cassette"
@@ -11,6 +15,13 @@ type (
 		cassettes map[string]*cassette.Control
 		index     string
 	}
+
+	// DuplicateTape is returned when a tape uses the name of
+	// a cassette which is already loaded
+	DuplicateTape struct {
+		Name string
+		Tape string
+	}
 )
 
 func New() *D {
@@ -26,6 +37,41 @@ func (d *D) Load(name string, cassette *cassette.Control) {
 	d.cassettes[name] = cassette
 }
 
+// LoadTape opens the cassette stored at tape in read-only mode and loads it into the deck.
+//
+// The name comes from the cassette manifest, if the cassette does not have one,
+// the basename of tape (without extension) is used instead.
+// Loading two tapes with the same name fails with DuplicateTape.
+func (d *D) LoadTape(ctx context.Context, tape string) (string, error) {
+	c, err := cassette.LoadControlCassette(ctx, tape, false, true)
+	if err != nil {
+		return "", err
+	}
+	name, err := TapeName(ctx, tape, c)
+	if err != nil {
+		c.Close()
+		return "", err
+	}
+	if d.cassettes[name] != nil {
+		c.Close()
+		return "", DuplicateTape{Name: name, Tape: tape}
+	}
+	d.Load(name, c)
+	return name, nil
+}
+
+// TapeName returns the name used to identify the cassette in a deck
+func TapeName(ctx context.Context, tape string, c *cassette.Control) (string, error) {
+	manifest, err := c.Manifest(ctx)
+	if errors.Is(err, cassette.ManifestNotFound{}) {
+		base := filepath.Base(tape)
+		return base[:len(base)-len(filepath.Ext(base))], nil
+	} else if err != nil {
+		return "", err
+	}
+	return manifest.Name, nil
+}
+
 func (d *D) IndexCassette(name string) {
 	d.index = name
 }
@@ -55,3 +101,7 @@ func (d *D) Close() error {
 	}
 	return nil
 }
+
+func (d DuplicateTape) Error() string {
+	return fmt.Sprintf("tape %v cannot be loaded as %v, a cassette with the same name is already loaded", d.Tape, d.Name)
+}
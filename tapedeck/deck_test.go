@@ -0,0 +1,47 @@
+package tapedeck
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/andrebq/boombox/cassette"
+)
+
+func TestLoadTapeDuplicateName(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "boombox-tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var tapes []string
+	for _, parent := range []string{"first", "second"} {
+		tape := filepath.Join(dir, parent, "index")
+		c, err := cassette.LoadControlCassette(ctx, tape, true, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+		tapes = append(tapes, tape)
+	}
+
+	d := New()
+	defer d.Close()
+	name, err := d.LoadTape(ctx, tapes[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := d.Get(name)
+	_, err = d.LoadTape(ctx, tapes[1])
+	if !errors.As(err, &DuplicateTape{}) {
+		t.Fatalf("Loading two tapes with the same name should fail with DuplicateTape, got %#v", err)
+	}
+	if d.Get(name) != loaded {
+		t.Fatal("The cassette loaded first should be kept")
+	}
+}
@@ -0,0 +1,7 @@
+manifest({
+  name='index',
+  title='Boombox sample cassette',
+  description='Static page, dynamic code and the germany wind energy dataset',
+  license='CC0: Public Domain',
+  version='0.1.0'
+})